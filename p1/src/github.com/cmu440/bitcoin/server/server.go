@@ -22,7 +22,10 @@ type server struct {
     eMinerJoinChan chan *miner // NewJoin
     eMinerResultChan chan *minerResult // NewResult
     processRequestChan chan *clientRequest
-    dropChan chan int
+    eConnOpenedChan chan lsp.ConnEvent // a client or miner connected
+    dropChan chan *drop
+    conns map[int]string // address of every open connection
+    closedConns map[int]bool // connections lost but not yet failed in Read, late messages from them are ignored
     requestWaitingArray []*clientRequest // all queueing requests that has not been processed
     currRequest *clientRequest // the current request being processed
     minersArray []*miner // miners not dropped
@@ -41,6 +44,11 @@ type clientRequest struct {
     dropped bool // if the client is being dropped
 }
 
+type drop struct {
+    connID int
+    lost bool // reported by eventRoutine, Read may still return messages from it
+}
+
 type minerResult struct {
     minerID int 
     hash uint64
@@ -121,7 +129,8 @@ func (S *server) readRoutine(){
         connID, bytes, err := S.lspServer.Read()
         if (err != nil){
             // one client or miner must be dropped
-            S.dropChan <- connID
+            S.dropChan <- &drop{connID: connID, lost: false}
+            continue
         }
         var msg bitcoin.Message
         err2 := unmarshal(bytes, &msg)
@@ -161,6 +170,19 @@ func (S *server) readRoutine(){
     }
 }
 
+// eventRoutine tells mainRoutine about connections as they open and end,
+// without waiting for their messages to be read
+func (S *server) eventRoutine() {
+    for event := range S.lspServer.Events() {
+        if (event.Type == lsp.ConnOpened){
+            S.eConnOpenedChan <- event
+        } else {
+            // drop it now rather than once its messages are read
+            S.dropChan <- &drop{connID: event.ConnID, lost: true}
+        }
+    }
+}
+
 // do the load balancing. All miners must be available
 func (S *server) loadBalance(request *clientRequest) {
     S.currRequest = request
@@ -208,7 +230,15 @@ func (S *server) mainRoutine() {
     for {
         // fmt.Println("inside main")
         select{
+        case event := <- S.eConnOpenedChan:
+            S.conns[event.ConnID] = event.Addr
+            fmt.Printf("server: connection %d opened from %s \n", event.ConnID, event.Addr)
+
         case request := <- S.eClientRequestChan:
+            if (S.closedConns[request.connID]){
+                // the client dropped before its request was read
+                continue
+            }
             if len(S.requestWaitingArray) == 0 && S.currRequest == nil && len(S.minersArray) != 0 {
                 //set curRequest and loadBalance + write to all miners
                 fmt.Printf("server: client %d joined, gonna do load balance \n", request.connID)
@@ -220,6 +250,10 @@ func (S *server) mainRoutine() {
         
 
         case miner := <- S.eMinerJoinChan:
+            if (S.closedConns[miner.minerID]){
+                // the miner dropped before its join was read
+                continue
+            }
             // this is the timing to check the dropped miner array
             if (len(S.droppedMinersArray) != 0){
                 droppedMiner := S.droppedMinersArray[0]
@@ -323,7 +357,22 @@ func (S *server) mainRoutine() {
                     S.loadBalance(request)
                 }
             }           
-        case connID := <- S.dropChan:
+        case d := <- S.dropChan:
+            connID := d.connID
+            if (d.lost){
+                if _, ok := S.conns[connID]; !ok {
+                    // already dropped when Read failed, or the opened event
+                    // was missed and Read failing will drop it
+                    continue
+                }
+                S.closedConns[connID] = true
+            } else if (S.closedConns[connID]){
+                // dropped when it was lost, and nothing more comes from it
+                delete(S.closedConns, connID)
+                continue
+            }
+            fmt.Printf("server: connection %d from %s ended \n", connID, S.conns[connID])
+            delete(S.conns, connID)
             if inListMinersArray(S.minersArray, connID) {
                 // minerID := connID
                 fmt.Printf("server: miner %d dropped \n", connID)
@@ -417,7 +466,10 @@ func StartServer(port int) (*server, error) {
         eMinerResultChan: make(chan *minerResult),
         processRequestChan: make(chan *clientRequest),
         requestWaitingArray: make([]*clientRequest, 0),
-        dropChan: make(chan int),
+        eConnOpenedChan: make(chan lsp.ConnEvent),
+        dropChan: make(chan *drop),
+        conns: make(map[int]string),
+        closedConns: make(map[int]bool),
         currRequest:nil,
         minersArray: make([]*miner, 0),
         droppedMinersArray: make([]*miner, 0),
@@ -465,6 +517,7 @@ func main() {
 
     // TODO: implement this!
     go srv.readRoutine()
+    go srv.eventRoutine()
     srv.mainRoutine()
 
     defer srv.lspServer.Close()
@@ -2,6 +2,8 @@
 
 package lsp
 
+import "context"
+
 // Client defines the interface for a LSP client.
 type Client interface {
 	// ConnID returns the connection ID associated with this client.
@@ -27,4 +29,38 @@ type Client interface {
 	// You may assume that Read, Write, and Close will not be called after
 	// Close has been called.
 	Close() error
+
+	// ReadContext behaves like Read, but returns ctx.Err() if ctx is done
+	// before a message is ready to be returned.
+	ReadContext(ctx context.Context) ([]byte, error)
+
+	// WriteContext behaves like Write, but returns ctx.Err() if ctx is done
+	// before the payload has been handed off to the client.
+	WriteContext(ctx context.Context, payload []byte) error
+
+	// CloseContext behaves like Close, but stops waiting once ctx is done.
+	// Any messages that are still unacknowledged at that point are abandoned,
+	// all background goroutines are shut down, and ctx.Err() is returned.
+	CloseContext(ctx context.Context) error
+
+	// CongestionWindow returns the number of messages the client currently
+	// lets be in flight to the server. It is WindowSize unless
+	// Params.CongestionControl is set.
+	CongestionWindow() int
+
+	// OpenStream opens a new stream on the connection, ordered independently
+	// of the connection's own Read and Write and of every other stream. It
+	// returns a non-nil error if the server doesn't support streams or the
+	// connection has been closed or lost.
+	OpenStream() (Stream, error)
+
+	// WriteMode sends a message to the server with the given delivery mode.
+	// ReliableOrdered behaves like Write. The other modes only take payloads
+	// up to MaxFragmentSize, and fall back to ReliableOrdered if the server
+	// doesn't support them.
+	WriteMode(payload []byte, mode DeliveryMode) error
+
+	// Stats returns a snapshot of the connection's counters and gauges. It
+	// returns a non-nil error once the client has been closed.
+	Stats() (ConnStats, error)
 }
@@ -3,15 +3,17 @@
 package lsp
 
 import (
-	"github.com/cmu440/lspnet"
+	"context"
 	"encoding/json"
 	"errors"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
 type client struct {
-	clientConn  *lspnet.UDPConn
-	serverAddr  *lspnet.UDPAddr
+	transport   PacketTransport
+	serverAddr  net.Addr
 	connID      int
 	curSeqNum   int
 	seqExpected int
@@ -19,39 +21,76 @@ type client struct {
 
 	//Read
 	messageToPush   *readReturn      //save the one message to return to Read()
+	unordered       unorderedQueue   //messages read ahead of the in-order ones
 	pendingMessages []*Message       //save out of order messages
+	fragments       reassembly       //the fragmented message being reassembled
 	messageChan     chan *Message    //deal with data messages
 	readReturnChan  chan *readReturn //channel to send message to Read() back
 
 	//Write
 
-	writeChan         chan []byte // write request sends to this channel
+	writeChan         chan *writeRequest // write request sends to this channel
 	writeBackChan     chan error  // the chan sent back from main routine
 	readChan          chan int    // read request sends to this channel
 	payloadChan       chan []byte // where payload is sent from main routine
-	writeAckChan      chan int    // ack is going to be sent
 	writeConnChan     chan int    // connect is going to be sent
 	connIDChan        chan int
+	cookieChan        chan []byte      // cookies from a server that wants our address proven
+	codec             Codec            // wire format agreed with the server during connect
+	features          Feature          // optional features agreed with the server during connect
+	connectAckChan    chan *Message    // readRoutine hands the connect ack to mainRoutine
+	token             uint64           // connection secret from the connect ack
+	resumeChan        chan *Message    // connect acks that arrive after connecting
+	suspended         bool             // lost the server, trying to resume the session
+	graceChan         <-chan time.Time // fires when it's too late to resume
+	resumeConnect     *windowElem      // connect message resent while suspended
+	closeElem         *windowElem      // close message resent until the server acks it
+	closeReturn       *readReturn      // what Read gets once the server closed the connection
+	peerCloseChan     chan int         // the server sent a close message
+	closeAckChan      chan int         // the server acked our close message
 	connIDRequestChan chan int // when function connID() calls send data to this channel
 	connIDReturnChan  chan int // the function returns value from this channel
 	closeChan         chan int
 	mainCloseChan     chan int
 	readCloseChan     chan int
-	timeCloseChan     chan int
 	allClosedChan     chan int
+	cancelChan        chan int // closed by CloseContext to abandon pending messages
+	quitChan          chan int // closed by terminateAll to unblock background routines
 	statusChan        chan int
 	statusReturnChan  chan bool
 	// below is for partA
-	connDropped       bool
-	aboutToClose      bool
-	window            []*windowElem // the window that contains all the elements that are trying to resend
-	windowStart       int
-	addToWindowChan   chan *windowElem
-	resendSuccessChan chan int // index := <- chan, which index from the window start has succeeded
-	writeBuffer       []*windowElem
+	connDropped          bool
+	aboutToClose         bool
+	window               []*windowElem // the window that contains all the elements that are trying to resend
+	windowStart          int
+	addToWindowChan      chan *windowElem
+	resendSuccessChan    chan *Message // ack := <- chan, which message from the window has succeeded
+	sackChan             chan *Message // selective acks, each may retire many window elements
+	writeBuffer          sendQueue
+	streams              map[int]*streamState // streams opened with OpenStream, by ID
+	openStreamChan       chan int
+	openStreamReturnChan chan *stream
+	statsChan            chan int
+	statsReturnChan      chan ConnStats
+	stats                connCounters
+	unackedData          int              // in-order data messages not acked yet, only with SACK
+	sackTimerChan        <-chan time.Time // fires to ack a lone in-order data message, only with SACK
+	rtt                  *rttEstimator    // retransmission timeout, owned by mainRoutine
+	congestion           *congestionWindow
+	timeouts             *timeoutQueue // seqNums of messages that timed out, for the congestion window
+	peerWindow           int           // receive window last advertised by the server
 
-	connDropChan   chan int //notify clientMain that connection dropped
-	gotMessageChan chan int //notify clientTime that got message from this client
+	connDropChan      chan int    //notify clientMain that connection dropped
+	connectFailedChan chan int    //notify NewClient that the server never acked the connect
+	wheel             *timerWheel // runs the retransmissions and epochs
+	epochs            *epochTimer
+
+	psk     []byte                        // pre-shared key, nil unless in secure mode
+	nonce   []byte                        // sent in the connect message in secure mode
+	session atomic.Pointer[secureSession] // set by readRoutine once the connect ack is in
+
+	integrity atomic.Pointer[integrity] // set by readRoutine once the connect ack is in
+	agreed    atomic.Pointer[Params]    // set by readRoutine once the connect ack is in, see connParams
 }
 
 // NewClient creates, initiates, and returns a new client. This function
@@ -63,19 +102,29 @@ type client struct {
 // connection requests).
 //
 // hostport is a colon-separated string identifying the server's host address
-// and port number (i.e., "localhost:9999").
+// and port number (i.e., "localhost:9999", or "[::1]:9999" over IPv6). The
+// client binds to params.LocalAddr if it is set.
 func NewClient(hostport string, params *Params) (Client, error) {
-	serverAddr, err := lspnet.ResolveUDPAddr("udp", hostport)
+	transport, err := dialUDP(params.LocalAddr, hostport)
 	if err != nil {
 		return nil, err
 	}
-	clientConn, err := lspnet.DialUDP("udp", nil, serverAddr)
+	return NewClientTransport(transport, transport.peer, params)
+}
+
+// NewClientTransport behaves like NewClient, but connects to the server at
+// serverAddr over the given transport, which it closes once the client is
+// closed, or right away if it returns an error. Every packet the transport
+// reads is taken to come from the server.
+func NewClientTransport(transport PacketTransport, serverAddr net.Addr, params *Params) (Client, error) {
+	psk, err := params.preSharedKey()
 	if err != nil {
+		transport.Close()
 		return nil, err
 	}
 	// to do: wait to receive ack from server
 	c := &client{
-		clientConn:     clientConn,
+		transport:      transport,
 		serverAddr:     serverAddr,
 		connID:         -1,
 		curSeqNum:      1,
@@ -85,57 +134,105 @@ func NewClient(hostport string, params *Params) (Client, error) {
 		readReturnChan: make(chan *readReturn), //channel to send message to Read() back
 		params:         params,
 
-		pendingMessages:   make([]*Message, 0),
-		writeChan:         make(chan []byte),
-		writeBackChan:     make(chan error),
-		readChan:          make(chan int),
-		payloadChan:       make(chan []byte),
-		writeAckChan:      make(chan int),
-		writeConnChan:     make(chan int),
-		connIDChan:        make(chan int),
-		connIDRequestChan: make(chan int),
-		connIDReturnChan:  make(chan int),
-		mainCloseChan:     make(chan int),
-		readCloseChan:     make(chan int),
-		timeCloseChan:     make(chan int),
-		allClosedChan:     make(chan int),
-		statusChan:        make(chan int),
-		statusReturnChan:  make(chan bool),
-		connDropped:       false,
-		aboutToClose:      false,
-		window:            make([]*windowElem, params.WindowSize), // the window that contains all the elements that are trying to resend
-		windowStart:       1,
-		resendSuccessChan: make(chan int),
-		addToWindowChan:   make(chan *windowElem),
-		connDropChan:      make(chan int), //notify clientMain that connection dropped
-		gotMessageChan:    make(chan int),
-		writeBuffer:       make([]*windowElem, 0),
+		pendingMessages:      make([]*Message, 0),
+		writeChan:            make(chan *writeRequest),
+		writeBackChan:        make(chan error),
+		readChan:             make(chan int),
+		payloadChan:          make(chan []byte),
+		writeConnChan:        make(chan int),
+		connIDChan:           make(chan int),
+		cookieChan:           make(chan []byte, 1),
+		codec:                CodecJSON,
+		connectAckChan:       make(chan *Message),
+		resumeChan:           make(chan *Message),
+		peerCloseChan:        make(chan int, 1),
+		closeAckChan:         make(chan int, 1),
+		connIDRequestChan:    make(chan int),
+		connIDReturnChan:     make(chan int),
+		mainCloseChan:        make(chan int),
+		readCloseChan:        make(chan int),
+		allClosedChan:        make(chan int),
+		cancelChan:           make(chan int),
+		quitChan:             make(chan int),
+		statusChan:           make(chan int),
+		statusReturnChan:     make(chan bool),
+		connDropped:          false,
+		aboutToClose:         false,
+		window:               make([]*windowElem, params.WindowSize), // the window that contains all the elements that are trying to resend
+		windowStart:          1,
+		resendSuccessChan:    make(chan *Message),
+		peerWindow:           unlimitedWindow,
+		sackChan:             make(chan *Message),
+		rtt:                  newRTTEstimator(params),
+		congestion:           newCongestionWindow(params),
+		timeouts:             newTimeoutQueue(),
+		addToWindowChan:      make(chan *windowElem),
+		connDropChan:         make(chan int, 1), //notify clientMain that connection dropped
+		connectFailedChan:    make(chan int, 1),
+		wheel:                newTimerWheel(params.clock()),
+		streams:              make(map[int]*streamState),
+		openStreamChan:       make(chan int),
+		openStreamReturnChan: make(chan *stream),
+		statsChan:            make(chan int),
+		statsReturnChan:      make(chan ConnStats),
+		psk:                  psk,
 	}
 
+	c.epochs = newEpochTimer(c.wheel, &c.stats.lastHeard, params, nil, c.epochLost) //no heartbeats before the ack
 	go c.mainRoutine()
 	go c.readRoutine()
-	go c.timeRoutine()
 	msg := NewConnect()
+	msg.Codec = params.Codec //propose a codec, the ack says which one we got
+	msg.Features = params.features()
+	params.connParams().put(msg) //the ack says what the server agreed on
+	if psk != nil {              //prove we hold the key, the ack has to do the same
+		c.nonce = newNonce()
+		msg.Nonce = c.nonce
+		msg.MAC = connectMAC(psk, msg)
+	}
 	byteMsg, err := marshal(msg)
-	_ = err
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
 	elem := &windowElem{
-		seqNum:  0,
-		ackChan: make(chan int),
-		msg:     byteMsg,
+		seqNum: 0,
+		msg:    byteMsg,
 	}
 	//assume gonna get ack back
-	go c.resendRoutine(elem) //start resend routine for connect
+	c.resend(elem, params.maxRTO()) //start resending the connect
 	//insert routine to wait for ack and block later
-	connID := <-c.connIDChan
+	var connID int
+	for waiting := true; waiting; {
+		select {
+		case connID = <-c.connIDChan:
+			waiting = false
+		case <-c.connectFailedChan: //connID stays 0
+			waiting = false
+		case cookie := <-c.cookieChan: //connect again, echoing the cookie
+			elem.stop()
+			msg.Cookie = cookie
+			byteMsg, _ = marshal(msg)
+			elem = &windowElem{
+				seqNum: 0,
+				msg:    byteMsg,
+			}
+			c.resend(elem, params.maxRTO())
+		}
+	}
 	if connID == 0 { //connection unsuccessful
 		//stop read/main routine?
-		elem.ackChan <- 1 //stop resending
+		elem.stop() //stop resending
 		//do the same with close read/main routine
 		c.Close()
 		return nil, errors.New("connection couldn't be made")
 	}
-	elem.ackChan <- 1 //stop resending
-	c.connID = connID
+	elem.stop() //stop resending, mainRoutine set c.connID
+	select {
+	case c.connIDRequestChan <- 1: //answered once mainRoutine restarted the epochs
+		<-c.connIDReturnChan
+	case <-c.quitChan:
+	}
 	return c, nil
 }
 
@@ -145,31 +242,122 @@ func (c *client) ConnID() int {
 	return res
 }
 
+func (c *client) CongestionWindow() int {
+	return int(c.congestion.effective.Load())
+}
+
 func (c *client) Read() ([]byte, error) {
-	message := <-c.readReturnChan
-	return message.payload, message.err
+	return c.ReadContext(context.Background())
 }
 
 func (c *client) Write(payload []byte) error {
-	c.statusChan <- 1
+	return c.WriteContext(context.Background(), payload)
+}
+
+func (c *client) Close() error {
+	return c.CloseContext(context.Background())
+}
+
+func (c *client) ReadContext(ctx context.Context) ([]byte, error) {
+	select {
+	case message := <-c.readReturnChan:
+		return message.payload, message.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *client) WriteContext(ctx context.Context, payload []byte) error {
+	return c.write(ctx, 0, payload)
+}
+
+func (c *client) WriteMode(payload []byte, mode DeliveryMode) error {
+	if err := checkMode(c.params, mode, payload); err != nil {
+		return err
+	}
+	return c.submit(context.Background(), &writeRequest{payload: payload, mode: mode})
+}
+
+func (c *client) OpenStream() (Stream, error) {
+	select {
+	case c.openStreamChan <- 1:
+	case <-c.quitChan:
+		return nil, errors.New("Connection closed/dropped already")
+	}
+	st := <-c.openStreamReturnChan
+	if st == nil {
+		return nil, errors.New("Can't open a stream on this connection")
+	}
+	return st, nil
+}
+
+func (c *client) Stats() (ConnStats, error) {
+	select {
+	case c.statsChan <- 1:
+	case <-c.quitChan:
+		return ConnStats{}, errors.New("Connection closed already")
+	}
+	return <-c.statsReturnChan, nil
+}
+
+// write hands a payload for the given stream to mainRoutine
+func (c *client) write(ctx context.Context, stream int, payload []byte) error {
+	return c.submit(ctx, &writeRequest{stream: stream, payload: payload})
+}
+
+func (c *client) submit(ctx context.Context, request *writeRequest) error {
+	payload := request.payload
+	if err := ctx.Err(); err != nil { //don't race a done context against a ready channel
+		return err
+	}
+	if len(payload) > c.params.maxMessageSize() {
+		return errors.New("Payload exceeds MaxMessageSize")
+	}
+	select {
+	case c.statusChan <- 1:
+	case <-c.quitChan: //Close returned already
+		return errors.New("Connection closed/dropped already")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	dropped := <-c.statusReturnChan
 	if dropped {
 		return errors.New("Connection closed/dropped already")
 
 	}
-	c.writeChan <- payload
+	select {
+	case c.writeChan <- request:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	res := <-c.writeBackChan
 	return res
 }
 
-func (c *client) Close() error {
-	c.mainCloseChan <- 1
-	<-c.allClosedChan //wait for everything to close
-	return nil
+func (c *client) CloseContext(ctx context.Context) error {
+	select {
+	case c.mainCloseChan <- 1:
+	case <-ctx.Done():
+		close(c.cancelChan) //mainRoutine gives up on pending messages
+		<-c.allClosedChan
+		return ctx.Err()
+	}
+	select {
+	case <-c.allClosedChan: //wait for everything to close
+		return nil
+	case <-ctx.Done():
+		close(c.cancelChan)
+		<-c.allClosedChan
+		return ctx.Err()
+	}
 }
 
 // other functions defined below
 
+// maxPacketSize is the most lspnet reads from a single datagram, so every
+// encoded message has to fit in it
+const maxPacketSize = 2000
+
 func marshal(msg *Message) ([]byte, error) {
 	res, err := json.Marshal(msg)
 	return res, err
@@ -180,7 +368,9 @@ func unmarshal(data []byte, v *Message) error {
 	return err
 }
 
-func makeCheckSum(connID, seqNum, size int, payload []byte) uint16 {
+// makeCheckSum also folds in any extra header fields, a zero field leaves
+// the checksum unchanged
+func makeCheckSum(connID, seqNum, size int, payload []byte, extra ...int) uint16 {
 	connIDSum := Int2Checksum(connID)
 	seqNumSum := Int2Checksum(seqNum)
 	sizeSum := Int2Checksum(size)
@@ -188,6 +378,9 @@ func makeCheckSum(connID, seqNum, size int, payload []byte) uint16 {
 	payloadSum := ByteArray2Checksum(payload)
 	// all of these are uint32
 	sum := connIDSum + seqNumSum + sizeSum + payloadSum
+	for _, value := range extra {
+		sum += Int2Checksum(value)
+	}
 	for sum > 0xffff {
 		carry := sum >> 16
 		primary := 0x0000ffff & sum
@@ -197,20 +390,88 @@ func makeCheckSum(connID, seqNum, size int, payload []byte) uint16 {
 	return uint16(sum)
 }
 
-func integrityCheck(msg *Message) bool {
-	if msg.Type == MsgConnect || msg.Type == MsgAck {
+// integrityCheck checks msg with the algorithm its connection agreed on, a
+// nil ig being the plain checksum
+func integrityCheck(msg *Message, ig *integrity) bool {
+	if msg.Type == MsgConnect || msg.Type == MsgAck || msg.Type == MsgClose || msg.Type == MsgCloseAck || msg.Type == MsgCookie {
 		return true
 	}
+	if ig.usesDigest() {
+		if msg.Size < 0 || len(msg.Payload) < msg.Size {
+			return false
+		}
+		msg.Payload = msg.Payload[:msg.Size]
+		return msg.Digest == ig.digest(msg)
+	}
+	if msg.Type == MsgSack {
+		return msg.Checksum == sackCheckSum(msg.ConnID, msg.SeqNum, msg.SackBits, msg.Window)
+	}
 	actualLen := len(msg.Payload)
 	expectedLen := msg.Size
 	if actualLen > expectedLen {
 		msg.Payload = msg.Payload[:expectedLen]
 	}
-	actualChecksum := makeCheckSum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload)
+	actualChecksum := makeCheckSum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload, msg.FragIndex, msg.FragCount, msg.Stream, msg.StreamSeq, int(msg.Mode))
 	expectedChecksum := msg.Checksum
 	return (actualLen >= expectedLen) && (actualChecksum == expectedChecksum)
 
 }
+
+// splitPayload cuts payload into fragments of at most size bytes, a payload
+// that already fits is returned as the only fragment
+func splitPayload(payload []byte, size int) [][]byte {
+	if len(payload) <= size {
+		return [][]byte{payload}
+	}
+	fragments := make([][]byte, 0, (len(payload)+size-1)/size)
+	for start := 0; start < len(payload); start += size {
+		end := min(start+size, len(payload))
+		fragments = append(fragments, payload[start:end])
+	}
+	return fragments
+}
+
+// reassembly puts the fragments of a payload back together in the order they
+// were written. A payload that grows past the limit is dropped, the rest of
+// its fragments are skipped, so a peer can't make it buffer without bound.
+type reassembly struct {
+	payload  []byte
+	tooLarge bool
+}
+
+// add takes the next fragment, returning the payload and true once the last
+// fragment has completed a payload within limit
+func (r *reassembly) add(fragment *Message, limit int) ([]byte, bool) {
+	if fragment.FragIndex == 0 {
+		r.payload, r.tooLarge = nil, false
+	}
+	if !r.tooLarge && len(r.payload)+len(fragment.Payload) > limit {
+		r.payload, r.tooLarge = nil, true
+	}
+	if !r.tooLarge {
+		r.payload = append(r.payload, fragment.Payload...)
+	}
+	if fragment.FragIndex < fragment.FragCount-1 || r.tooLarge {
+		return nil, false
+	}
+	payload := r.payload
+	r.payload = nil
+	return payload, true
+}
+
+// newFragment returns the data message carrying fragment index of a write
+// that was split into count fragments, unfragmented writes leave both
+// fragment fields zero so they look exactly like before
+func newFragment(connID, seqNum int, payload []byte, index, count int) *Message {
+	if count <= 1 {
+		index, count = 0, 0
+	}
+	checksum := makeCheckSum(connID, seqNum, len(payload), payload, index, count)
+	msg := NewData(connID, seqNum, len(payload), payload, checksum)
+	msg.FragIndex = index
+	msg.FragCount = count
+	return msg
+}
 func (c *client) received(seq int) bool {
 	n := len(c.pendingMessages)
 	for i := 0; i < n; i++ {
@@ -227,82 +488,323 @@ func min(x, y int) int {
 	return y
 
 }
-func (c *client) resendRoutine(elem *windowElem) {
-	//wrtie to client, potentially sending message to server's main routine to handle
-	c.clientConn.Write(elem.msg)
-	maxBackOff := c.params.MaxBackOffInterval
-	curBackOff := 0
-	epochPassed := 0
-	timer := time.NewTimer(time.Duration(c.params.EpochMillis) * time.Millisecond)
 
-	for {
-		select {
-		case <-timer.C: //resend
-			if epochPassed >= curBackOff {
-				epochPassed = 0
-				c.clientConn.Write(elem.msg)
-				if curBackOff == 0 { //add one if curBackOff ==1
-					curBackOff = min(curBackOff+1, maxBackOff)
-				} else { //exponential growth if curBackOff > 0
-					curBackOff = min(curBackOff*2, maxBackOff)
-				}
-			} else {
-				epochPassed += 1 //one epoch Passed
-			}
-			timer = time.NewTimer(time.Duration(c.params.EpochMillis) * time.Millisecond)
-		case <-elem.ackChan:
-			return
+// resend sends elem and keeps sending it on the timer wheel, every timeout
+// at first, until it is stopped.
+func (c *client) resend(elem *windowElem, timeout time.Duration) {
+	elem.sentAt = c.wheel.clock.Now()
+	c.send(elem.msg)
+	elem.start(c.wheel, timeout, func() { c.retransmit(elem) })
+}
+
+// retransmit sends elem again once its timeout is up. It runs on the timer
+// wheel.
+func (c *client) retransmit(elem *windowElem) {
+	if elem.backOff(c.params.MaxBackOffInterval) {
+		c.send(elem.msg)
+		elem.retransmitted = true
+		if elem.seqNum != 0 { //not a connect or close message
+			c.stats.retransmissions.Add(1)
+		}
+		elem.timeout = nextTimeout(elem.timeout, c.connParams())
+		if c.params.CongestionControl && elem.seqNum != 0 {
+			c.timeouts.push(elem.seqNum) //let mainRoutine shrink the congestion window
 		}
 	}
+	elem.timer.reset(elem.timeout)
 }
-func (c *client) timeRoutine() {
-	epoch := c.params.EpochMillis
-	epochLimit := c.params.EpochLimit
-	reminderTimer := time.NewTimer(time.Duration(epoch) * time.Millisecond)
-	connDropTimer := time.NewTimer(time.Duration(epoch*epochLimit) * time.Millisecond)
-	ack := NewAck(c.connID, 0) //reminder ack
-	msg, err := marshal(ack)   //message to be sent to client
-	_ = err
-	for {
-		select {
-		case <-reminderTimer.C: //haven't received anything from this client for a epoch
-			c.clientConn.Write(msg)
-			reminderTimer = time.NewTimer(time.Duration(epoch) * time.Millisecond)
-		case <-connDropTimer.C: //connection dropped
-			if c.connID == -1 { //still in NewClient() stage waiting for ack
-				c.connIDChan <- 0 //let NewClient know it failed connecting to server
-				return
-			}
-			
-			c.connDropChan <- 1
 
-		case <-c.gotMessageChan: //got sth, reset timmer
-			reminderTimer = time.NewTimer(time.Duration(epoch) * time.Millisecond)
-			connDropTimer = time.NewTimer(time.Duration(epoch*epochLimit) * time.Millisecond)
-		case <-c.timeCloseChan:
-			return
-		}
+// epochLost runs on the timer wheel once the server hasn't been heard from
+// for EpochLimit epochs.
+func (c *client) epochLost() {
+	if c.agreed.Load() == nil { //still in NewClient() stage waiting for ack
+		notify(c.connectFailedChan)
+		return
 	}
+	notify(c.connDropChan)
 }
 func (c *client) checkAllSent() bool {
 	ifAllNil := true
-	for i := 0; i < c.params.WindowSize; i++ {
+	for i := 0; i < len(c.window); i++ {
 		if c.window[i] != nil {
 			ifAllNil = false
 		}
 	}
 	if ifAllNil {
-		return len(c.writeBuffer) == 0
+		return c.writeBuffer.len() == 0
+	}
+	return false
+}
+func (c *client) stopResending() { //stop the resend routine for each message in the window
+	for i := 0; i < len(c.window); i++ {
+		if c.window[i] != nil {
+			if !c.suspended { //a suspended window has no resend routines
+				c.window[i].stop()
+			}
+			c.window[i] = nil
+		}
+	}
+	c.stopResumeConnect()
+	c.stopClosing()
+	c.suspended = false
+}
+
+// lost gives up on the connection after the epoch limit. It returns true if
+// mainRoutine terminated.
+func (c *client) lost(readReturnChan chan *readReturn) bool {
+	if c.connDropped {
+		return false
+	}
+	c.stopResending()
+	if c.aboutToClose { //server timed out during Close()
+		//ignore the pendingMessages as well
+		c.terminateAll()
+		return true
+	}
+	//regular server time out
+	c.connDropped = true
+	c.endStreams(errors.New("This client disconnected"))
+	//if no messages to push at the moment
+	if readReturnChan == nil && c.unordered.len() == 0 {
+		droppedMsg := &readReturn{
+			connID:  c.connID,
+			seqNum:  -1,
+			payload: nil,
+			err:     errors.New("This client disconnected"),
+		}
+		select {
+		case c.readReturnChan <- droppedMsg: //might block
+		case <-c.cancelChan:
+			c.terminateAll()
+			return true
+		}
 	}
 	return false
 }
 func (c *client) terminateAll() { //terminate all routine
 	c.connDropped = true
-	c.clientConn.Close()
+	close(c.quitChan)
+	c.transport.Close()
 	c.readCloseChan <- 1
-	c.timeCloseChan <- 1
+	c.epochs.stop()
+	c.wheel.close()
 	c.allClosedChan <- 1
 }
+func (c *client) queueData(stream int, payload []byte, fragIndex, fragCount int, mode DeliveryMode) {
+	data := newFragment(c.connID, 0, payload, fragIndex, fragCount)
+	data.Token = c.token
+	data.Mode = mode
+	if st := c.streams[stream]; st != nil {
+		data.Stream = stream
+		data.StreamSeq = st.writeSeqNum
+		st.writeSeqNum += 1
+	}
+	c.writeBuffer.push(newQueuedData(data)) //gets its seqNum once it fits in the window
+	c.fillWindow()
+}
+
+// fillWindow moves messages from the writeBuffer into the window and sends
+// them, as long as they fit in the window and the congestion window allows
+// more messages in flight
+func (c *client) fillWindow() {
+	if c.suspended { //nothing goes out until the session is resumed
+		return
+	}
+	inFlight := 0
+	for _, elem := range c.window {
+		if elem != nil {
+			inFlight += 1
+		}
+	}
+	for c.writeBuffer.len() > 0 && inFlight < sendLimit(c.congestion.size(), c.peerWindow) {
+		if c.curSeqNum >= c.windowStart+len(c.window) {
+			break
+		}
+		elem := c.writeBuffer.pop()
+		elem.seal(c.curSeqNum, c.codec, c.integrity.Load())
+		c.stats.dataSent += 1
+		c.curSeqNum += 1
+		c.window[elem.seqNum-c.windowStart] = elem
+		inFlight += 1
+		c.resend(elem, c.rtt.timeout())
+	}
+}
+
+// takeMessage makes the in-order data message the next one for Read. A
+// fragment is only buffered and the next message is looked up, until the
+// last fragment completes the original payload.
+func (c *client) takeMessage(message *Message) {
+	if message.Stream != 0 || message.Mode == ReliableUnordered { //already delivered
+		c.seqExpected += 1
+		c.takePending()
+		return
+	}
+	if message.FragCount <= 1 {
+		c.messageToPush = &readReturn{
+			connID:  message.ConnID,
+			seqNum:  message.SeqNum,
+			payload: message.Payload,
+			err:     nil,
+		}
+		return
+	}
+	payload, ok := c.fragments.add(message, c.params.maxMessageSize())
+	if !ok {
+		c.seqExpected += 1 //fragments never reach Read on their own
+		c.takePending()
+		return
+	}
+	c.messageToPush = &readReturn{
+		connID:  message.ConnID,
+		seqNum:  message.SeqNum,
+		payload: payload,
+		err:     nil,
+	}
+}
+
+// takePending moves the message with seqExpected out of pendingMessages
+func (c *client) takePending() {
+	for i := 0; i < len(c.pendingMessages); i++ {
+		message := c.pendingMessages[i]
+		if message.SeqNum == c.seqExpected {
+			//cut this message off pendingMessages
+			c.pendingMessages = append(c.pendingMessages[:i], c.pendingMessages[i+1:]...)
+			c.takeMessage(message)
+			break //make sure only push one message to the read()
+		}
+	}
+}
+
+// retire removes the acked message from the window, slides the window and
+// moves buffered messages into it. It returns true if the client terminated
+// because this was the last message pending before Close.
+func (c *client) retire(seqNum int) bool {
+	if seqNum < c.windowStart || seqNum >= c.windowStart+len(c.window) {
+		//got resendSuccess for sth already succeeded
+		//could be that alraedy got message so seqNum < windowStart already
+		return false
+	}
+	index := seqNum - c.windowStart
+	if c.window[index] == nil { //duplicate ack
+		return false
+	}
+	if !c.suspended {
+		c.window[index].stop()
+	}
+	c.rtt.observe(c.window[index])
+	if !c.window[index].retransmitted {
+		c.congestion.onAck()
+	}
+	c.window[index] = nil
+	window := c.window
+	//check if window is all nil and length of writeBuffer is 0, stop the epochs and readRoutine and return
+	if c.aboutToClose && c.checkAllSent() { //check if no other messages left to send out and about to close
+		return c.flushed()
+	}
+
+	if index == 0 {
+		offset := 0
+		for i := 0; i < len(c.window); i++ {
+			if window[i] == nil {
+				offset += 1
+			} else {
+				break
+			}
+		}
+		// for cleaniness and garbage recollection purpose, remake
+		// the window every time we slide the window
+		// never slide past the next message to send
+		offset = min(c.curSeqNum-c.windowStart, offset)
+		windowSize := len(window)
+		newWindow := make([]*windowElem, windowSize)
+		for i := offset; i < windowSize; i++ {
+			newWindow[i-offset] = window[i]
+		}
+		//change windowStart
+		c.windowStart += offset
+		c.window = newWindow
+	}
+	// add elements in the buffer to the window
+	c.fillWindow()
+	return false
+}
+
+// unread returns the number of messages from the server waiting for Read
+func (c *client) unread() int {
+	unread := len(c.pendingMessages) + len(c.unordered.reliable) + streamsUnread(c.streams)
+	if c.messageToPush != nil {
+		unread += 1
+	}
+	return unread
+}
+
+// receiveWindow returns the window to advertise in acks, zero if the server
+// doesn't do flow control
+func (c *client) receiveWindow() int {
+	if c.features&FeatureFlowControl == 0 {
+		return 0
+	}
+	return receiveWindow(c.params, c.unread())
+}
+
+// updatePeerWindow takes the receive window advertised in an ack from the
+// server, a larger window may let buffered messages go out
+func (c *client) updatePeerWindow(ack *Message) {
+	if c.features&FeatureFlowControl == 0 {
+		return
+	}
+	c.peerWindow = ack.Window
+	c.fillWindow()
+}
+
+// ackData acknowledges a data message. Without SACK every data message is
+// acked on its own. With SACK in-order messages are acked every other message
+// or after sackDelay, and anything duplicated or out of order is acked at
+// once so the sender learns about the gap quickly.
+func (c *client) ackData(seqNum int, duplicate bool) {
+	if c.features&FeatureSack == 0 {
+		ack := NewAck(c.connID, seqNum)
+		ack.Window = c.receiveWindow()
+		c.sendAck(ack)
+		return
+	}
+	c.unackedData += 1
+	if duplicate || len(c.pendingMessages) > 0 || c.unackedData >= 2 {
+		c.sendSack()
+	} else if c.sackTimerChan == nil {
+		c.sackTimerChan = c.wheel.clock.NewTimer(sackDelay(c.connParams())).C()
+	}
+}
+
+func (c *client) sendSack() {
+	c.sendAck(makeSack(c.connID, c.ackedThrough(), c.receiveWindow(), c.pendingMessages))
+	c.unackedData = 0
+	c.sackTimerChan = nil
+}
+
+func (c *client) sendAck(ack *Message) {
+	ack.Token = c.token
+	c.integrity.Load().sign(ack)
+	msg, err := encode(ack, c.codec)
+	if err != nil {
+		return
+	}
+	c.send(msg)
+}
+
+// ackedThrough returns the highest seqNum such that every data message up to
+// it has been received
+func (c *client) ackedThrough() int {
+	through := c.seqExpected - 1
+	if c.messageToPush != nil {
+		through = c.seqExpected
+	}
+	for c.received(through + 1) {
+		through += 1
+	}
+	return through
+}
+
 func (c *client) mainRoutine() {
 	for {
 		var readReturnChan chan *readReturn
@@ -310,163 +812,170 @@ func (c *client) mainRoutine() {
 		if c.messageToPush != nil && c.messageToPush.seqNum == c.seqExpected {
 			readReturnChan = c.readReturnChan
 		}
+		var unorderedChan chan *readReturn
+		if c.unordered.len() > 0 {
+			unorderedChan = c.readReturnChan
+		}
+		var closedReturnChan chan *readReturn //Read keeps failing once the server closed
+		if c.drained() && c.closeReturn != nil {
+			closedReturnChan = c.readReturnChan
+		}
 		select {
 		case <-c.statusChan:
-			c.statusReturnChan <- c.connDropped
+			c.statusReturnChan <- c.connDropped || c.closeReturn != nil
 		case <-c.mainCloseChan:
 			c.aboutToClose = true
-			if c.checkAllSent() || c.connDropped {
+			if c.connDropped || c.closeReturn != nil {
 				c.terminateAll()
 				return
 			}
+			if c.checkAllSent() && c.flushed() {
+				return
+			}
 
-		case <-c.connDropChan: //conneciton dropped
-			if c.connDropped == false {
-
-				for i := 0; i < c.params.WindowSize; i++ {
-					if c.window[i] != nil {
-						c.window[i].ackChan <- 1 //stop the resend routine for each message
-					}
-				}
-				if c.aboutToClose { //server timed out during Close()
-
-					//ignore the pendingMessages as well
-					c.terminateAll()
-					return
-				}
-				//regular server time out
-				c.connDropped = true
-				//if no messages to push at the moment
-				
-				if readReturnChan == nil {
-					
-					droppedMsg := &readReturn {
-						connID:  c.connID,
-						seqNum:  -1,
-						payload: nil,
-						err:     errors.New("This client disconnected"),
-					}
-					c.connDropped = true
-					//c.clientConn.Close()
-					//c.readCloseChan <- 1
-					//c.timeCloseChan <- 1
-					c.readReturnChan <- droppedMsg //might block
+		case <-c.cancelChan: //CloseContext gave up waiting for pending messages
+			c.stopResending()
+			c.terminateAll()
+			return
 
-					//return 
-				}
+		case <-c.connDropChan: //conneciton dropped
+			if c.suspended || c.closeReturn != nil { //the grace period decides, or nothing left to lose
+				continue
+			}
+			if !c.connDropped && !c.aboutToClose && c.canResume() {
+				c.suspend() //try to resume the session before giving up
+				continue
+			}
+			if c.lost(readReturnChan) {
+				return
+			}
+		case <-c.graceChan: //server didn't come back in time
+			c.graceChan = nil
+			if c.lost(readReturnChan) {
+				return
+			}
+		case <-c.resumeChan:
+			if c.suspended {
+				c.resume()
+			}
+		case <-c.peerCloseChan:
+			if c.closedByPeer() {
+				return
 			}
+		case <-c.closeAckChan:
+			if c.closeElem != nil { //the server knows we're gone
+				c.stopResending()
+				c.terminateAll()
+				return
+			}
+		case closedReturnChan <- c.closeReturn:
 
 		//write channels called from Write()
-		case payload := <-c.writeChan:
-			if c.connDropped {
-				
+		case request := <-c.writeChan:
+			if c.connDropped || c.closeReturn != nil {
 				c.writeBackChan <- errors.New("Already disconnected")
 				continue
 			} else {
 				c.writeBackChan <- nil //connection not lost yet
 			}
-			checksum := makeCheckSum(c.connID, c.curSeqNum, len(payload), payload)
-			original := NewData(c.connID, c.curSeqNum, len(payload), payload, checksum)
-			msg, err := marshal(original)
-			_ = err
-			elem := &windowElem{
-				seqNum:  c.curSeqNum,
-				ackChan: make(chan int),
-				msg:     msg,
-			}
-			c.curSeqNum += 1
-			//add to window
-			seqNum := elem.seqNum
-			
-			// the below condition is ** key **
-
-			if seqNum < c.windowStart+c.params.WindowSize && c.window[seqNum-c.windowStart] == nil {
-				// can be put into the window
-				c.window[seqNum-c.windowStart] = elem
-				go c.resendRoutine(elem) // NOTE: the first time sending is also done in resendRoutine
-			} else {
-				c.writeBuffer = append(c.writeBuffer, elem)
+			mode := request.mode
+			if c.features&FeatureModes == 0 { //the server reads everything in order
+				mode = ReliableOrdered
 			}
-
-		case seqNum := <-c.resendSuccessChan:
-
-			if seqNum < c.windowStart { //got resendSuccess for sth already succeeded
-				//could be that alraedy got message so seqNum < windowStart already
+			if mode == Unreliable {
+				c.sendDatagram(request.payload)
 				continue
 			}
-			index := seqNum - c.windowStart
-			c.window[index].ackChan <- 1 //let resendRoutine for this message stop
-			c.window[index] = nil
-			window := c.window
-			//check if window is all nil and length of writeBuffer is 0, send 1 to timeRoutine  and readRoutine and return
-			if c.aboutToClose && c.checkAllSent() { //check if no other messages left to send out and about to close
-				c.terminateAll()
+			//large payloads go out as several fragments, each with its own seqNum
+			fragments := splitPayload(request.payload, c.params.maxFragmentSize())
+			for i, fragment := range fragments {
+				c.queueData(request.stream, fragment, i, len(fragments), mode)
+			}
+
+		case <-c.openStreamChan:
+			c.openStreamReturnChan <- c.openStream()
+		case <-c.statsChan:
+			c.statsReturnChan <- c.stats.snapshot(c.window, &c.writeBuffer, c.pendingMessages, c.rtt)
+
+		case ack := <-c.resendSuccessChan:
+			c.updatePeerWindow(ack)
+			if c.retire(ack.SeqNum) {
 				return
 			}
 
-			if index == 0 {
-				offset := 0
-				for i := 0; i < c.params.WindowSize; i++ {
-					if window[i] == nil {
-						offset += 1
-					} else {
-						break
-					}
-				}
-				// for cleaniness and garbage recollection purpose, remake
-				// the window every time we slide the window
-				offset = min(c.curSeqNum-c.windowStart, offset)
-				windowSize := c.params.WindowSize
-				newWindow := make([]*windowElem, windowSize)
-				for i := offset; i < windowSize; i++ {
-					newWindow[i-offset] = window[i]
-				}
-				// add element in the buffer to the window
-				emptyStartIndex := windowSize - offset
-				//compare number of messages in writeBuffer with offset before copying over
-				bufferToCopy := min(len(c.writeBuffer), offset)
-				for i := 0; i < bufferToCopy; i++ {
-					newWindow[i+emptyStartIndex] = c.writeBuffer[i]
-					go c.resendRoutine(c.writeBuffer[i])
+		case sack := <-c.sackChan:
+			seqNums, ok := sack.sackedSeqNums(c.windowStart, c.curSeqNum-1)
+			if !ok {
+				continue
+			}
+			c.updatePeerWindow(sack)
+			terminated := false
+			for _, seqNum := range seqNums {
+				if terminated = c.retire(seqNum); terminated {
+					break
 				}
-				// shrink the buffer
-				newBuffer := c.writeBuffer[bufferToCopy:]
-				//change windowStart
-				c.windowStart += offset
-				//update window, buffer
-				c.window = newWindow
-				c.writeBuffer = newBuffer
-			}
-
-		case seqNum := <-c.writeAckChan:
-			ack := NewAck(c.connID, seqNum)
-			msg, err := marshal(ack)
-			
-			if err != nil {
-				
+			}
+			if terminated {
 				return
 			}
-			c.clientConn.Write(msg)
-			
+
+		case <-c.timeouts.readyChan:
+			for _, seqNum := range c.timeouts.take() {
+				c.congestion.onTimeout(seqNum, c.curSeqNum)
+			}
+		case <-c.sackTimerChan:
+			c.sendSack()
 
 		case <-c.connIDRequestChan:
 			c.connIDReturnChan <- c.connID
 
+		case ack := <-c.connectAckChan:
+			c.connID = ack.ConnID
+			c.codec = ack.Codec
+			c.features = ack.Features
+			c.token = ack.Token
+			c.adopt()
+			heartbeat := NewAck(ack.ConnID, 0)
+			heartbeat.Token = c.token
+			if msg, err := encode(heartbeat, c.codec); err == nil { //remind the server every epoch it doesn't hear from us
+				c.epochs.restart(c.connParams(), func() { c.send(msg) })
+			}
+
 		//Reading channels, same with server implementation
 		case message := <-c.messageChan: // append out of order message
+			if message.Mode == Unreliable { //never acked
+				if !c.connDropped && c.closeReturn == nil {
+					c.stats.received(false)
+					c.unordered.push(message)
+				}
+				continue
+			}
+			duplicate := message.SeqNum < c.seqExpected || c.received(message.SeqNum) ||
+				(message.SeqNum == c.seqExpected && c.messageToPush != nil)
+			if !duplicate && message.SeqNum > c.seqExpected && overLimit(c.params, c.unread()) {
+				continue //no room, the server sends it again later
+			}
+			if !duplicate && message.Mode == ReliableUnordered && overLimit(c.params, len(c.unordered.reliable)) {
+				continue //taken at once, so only held back by the ones Read has yet to take
+			}
+			if !duplicate && streamFull(c.params, c.streams, message) {
+				continue //likewise held back by its stream
+			}
+			c.stats.received(duplicate)
+			if !duplicate && message.Stream != 0 { //streams don't wait for stream 0
+				c.receiveStream(message)
+			}
+			if !duplicate && message.Mode == ReliableUnordered { //read at once, still acked in order
+				c.unordered.push(message)
+			}
 			if message.SeqNum > c.seqExpected {
 				if !c.received(message.SeqNum) {
 					c.pendingMessages = append(c.pendingMessages, message)
 				}
-			} else if message.SeqNum == c.seqExpected {
-				wrapMessage := &readReturn{
-					connID:  message.ConnID,
-					seqNum:  message.SeqNum,
-					payload: message.Payload,
-					err:     nil,
-				}
-				c.messageToPush = wrapMessage
+			} else if message.SeqNum == c.seqExpected && c.messageToPush == nil {
+				c.takeMessage(message)
 			}
+			c.ackData(message.SeqNum, duplicate)
 
 		case readReturnChan <- c.messageToPush:
 			//if entered here, means we just pushed the message with seqNum
@@ -475,79 +984,116 @@ func (c *client) mainRoutine() {
 			c.seqExpected += 1
 			//go through pending messages and check if already received the next
 			//message in order, check againt client.seqExpected
-			
+
 			c.messageToPush = nil
-			for i := 0; i < len(c.pendingMessages); i++ {
-				message := c.pendingMessages[i]
-				if message.SeqNum == c.seqExpected {
-					//make sure sending messages out in order
-					wrapMessage := &readReturn{
-						connID:  message.ConnID,
-						seqNum:  message.SeqNum,
-						payload: message.Payload,
-						err:     nil,
-					}
-					c.messageToPush = wrapMessage
-					//cut this message off pendingMessages
-					c.pendingMessages = append(c.pendingMessages[:i], c.pendingMessages[i+1:]...)
-					break //make sure only push one message to the read()
-				}
+			c.takePending() //make sure sending messages out in order
+			if c.afterRead() {
+				return
 			}
-			if c.messageToPush == nil && c.connDropped { //if connection dropped and no more message to be Read
-				droppedMsg := &readReturn{
-					connID:  c.connID,
-					seqNum:  -1,
-					payload: nil,
-					err:     errors.New("This client disconnected"),
-				}
-				c.readReturnChan <- droppedMsg //might block
-				//return                        
+		case unorderedChan <- c.unordered.next():
+			c.unordered.pop()
+			if c.afterRead() {
+				return
 			}
 		}
 	}
 }
 
+// afterRead lets Read fail once the connection has dropped and every message
+// received has been read. It returns true if mainRoutine terminated.
+func (c *client) afterRead() bool {
+	if !c.drained() || !c.connDropped { //more to read, or the connection is fine
+		return false
+	}
+	droppedMsg := &readReturn{
+		connID:  c.connID,
+		seqNum:  -1,
+		payload: nil,
+		err:     errors.New("This client disconnected"),
+	}
+	select {
+	case c.readReturnChan <- droppedMsg: //might block
+	case <-c.cancelChan:
+		c.stopResending()
+		c.terminateAll()
+		return true
+	}
+	return false
+}
+
 func (c *client) readRoutine() {
 	for {
 		select {
 		case <-c.readCloseChan:
-			
+
 			return
 		default:
-			
-			b := make([]byte, 2000)
-			n, err := c.clientConn.Read(b)
 
-			if err == nil { //deal with error later
+			b := make([]byte, maxPacketSize)
+			n, _, err := c.transport.ReadFrom(b)
+
+			packet := c.open(b[:n])          //nil unless it came from the server in secure mode
+			if err == nil && packet != nil { //deal with error later
 				var message Message
-				unmarshal(b[:n], &message) //unMarshall returns *Message
-				actualLen := len(message.Payload)
-				expectedLen := message.Size
-				if actualLen > expectedLen {
-					message.Payload = message.Payload[:expectedLen]
+				if decode(packet, &message) != nil { //junk, not a sign of life
+					continue
 				}
-				actualChecksum := makeCheckSum(message.ConnID, message.SeqNum, message.Size, message.Payload)
-				expectedChecksum := message.Checksum
-
-				if message.Type == MsgConnect || message.Type == MsgAck || ((actualLen >= expectedLen) && (actualChecksum == expectedChecksum)) {
-					//check integrity here with checksum and size
-					c.gotMessageChan <- 1 //reset timer in timeRoutine, got some message
+				if message.Type == MsgCookie { //not a sign of life, anyone could have sent it
+					c.gotCookie(&message)
+				} else if integrityCheck(&message, c.integrity.Load()) { //check integrity here with checksum and size
+					//every send below gives up once mainRoutine has terminated
+					c.stats.heard(c.wheel.clock.Now()) //the epoch timer looks at it
 					if message.Type == MsgData {
-						c.messageChan <- &message
-						c.writeAckChan <- message.SeqNum //signal to send Ack back
+						select {
+						case c.messageChan <- &message: //mainRoutine also sends the ack back
+						case <-c.quitChan:
+						}
+					} else if message.Type == MsgSack {
+						select {
+						case c.sackChan <- &message:
+						case <-c.quitChan:
+						}
+					} else if message.Type == MsgClose {
+						notify(c.peerCloseChan)
+					} else if message.Type == MsgCloseAck {
+						notify(c.closeAckChan)
 					} else if message.Type == MsgAck {
 						if message.SeqNum == 0 { //ack for connect
 							//possible race condition reading c.connID while changing it in newClient()?
-							c.connIDRequestChan <- 1
+							select {
+							case c.connIDRequestChan <- 1:
+							case <-c.quitChan:
+								continue
+							}
 							connID := <-c.connIDReturnChan
 							if connID == -1 { //race use channel
-								c.connIDChan <- message.ConnID //set up NewClient
+								c.integrity.Store(newIntegrity(message.Features, c.psk, message.ConnID, message.Token))
+								c.agreed.Store(c.params.with(messageConnParams(&message)))
+								select {
+								case c.connectAckChan <- &message: //before NewClient returns
+								case <-c.quitChan:
+									continue
+								}
+								select {
+								case c.connIDChan <- message.ConnID: //set up NewClient
+								case <-c.quitChan:
+								}
+							} else if message.Token != 0 { //connect ack, not a reminder
+								select {
+								case c.resumeChan <- &message:
+								case <-c.quitChan:
+								}
 							}
 						} else {
 							//let main routine know that resend was sucessful
-							c.resendSuccessChan <- message.SeqNum
+							select {
+							case c.resendSuccessChan <- &message:
+							case <-c.quitChan:
+							}
 						}
 					}
+				} else {
+					c.stats.integrityFailures.Add(1)
 				}
 			}
 		}
@@ -0,0 +1,97 @@
+// Contains the table a server looks its clients up in.
+
+package lsp
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// clientTable holds the clients of a server by connID and by address, so
+// that readRoutine and the API calls can look one up without a round trip
+// through mainRoutine, at the same cost however many clients there are.
+// Only mainRoutine adds and removes clients, only readRoutine moves them.
+type clientTable struct {
+	mu     sync.RWMutex
+	byID   map[int]*s_client
+	byAddr map[string]*s_client // by the address each client is at
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{
+		byID:   make(map[int]*s_client),
+		byAddr: make(map[string]*s_client),
+	}
+}
+
+// add puts a client at the address it connected from in the table
+func (t *clientTable) add(sClient *s_client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byID[sClient.connID] = sClient
+	t.byAddr[sClient.remote().String()] = sClient
+}
+
+// remove takes a client out of the table, returning how many are left
+func (t *clientTable) remove(connID int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sClient := t.byID[connID]; sClient != nil {
+		delete(t.byID, connID)
+		t.unlinkAddr(sClient)
+	}
+	return len(t.byID)
+}
+
+// unlinkAddr drops the client's address, unless another client moved there
+// since. Must be called with t.mu held.
+func (t *clientTable) unlinkAddr(sClient *s_client) {
+	addr := sClient.remote().String()
+	if t.byAddr[addr] == sClient {
+		delete(t.byAddr, addr)
+	}
+}
+
+// get returns the client with the given connID, nil if there is none
+func (t *clientTable) get(connID int) *s_client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.byID[connID]
+}
+
+// at returns the client at addr, nil if there is none
+func (t *clientTable) at(addr net.Addr) *s_client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.byAddr[addr.String()]
+}
+
+// move makes addr the address the client is at
+func (t *clientTable) move(sClient *s_client, addr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unlinkAddr(sClient)
+	sClient.moveTo(addr)
+	if t.byID[sClient.connID] == sClient { //not removed in the meantime
+		t.byAddr[addr.String()] = sClient
+	}
+}
+
+func (t *clientTable) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.byID)
+}
+
+// all returns the clients in the order they connected
+func (t *clientTable) all() []*s_client {
+	t.mu.RLock()
+	clients := make([]*s_client, 0, len(t.byID))
+	for _, sClient := range t.byID {
+		clients = append(clients, sClient)
+	}
+	t.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].connID < clients[j].connID })
+	return clients
+}
@@ -0,0 +1,202 @@
+// Contains the clocks that endpoints keep time by.
+
+package lsp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where an endpoint takes the time from for its epochs,
+// retransmissions and timeouts. Read deadlines of the net.Conn adapters are
+// points in wall-clock time and don't go by it.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer returns a timer that sends the time on its channel once d
+	// has passed, like time.NewTimer.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc returns a timer that calls f in its own goroutine once d
+	// has passed, like time.AfterFunc. Its channel is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock. Stop and Reset work like those of a
+// time.Timer: after either returns, no time sent before is received.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// systemClock is the Clock used when Params has none.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time        { return t.timer.C }
+func (t systemTimer) Stop() bool                 { return t.timer.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+// FakeClock is a Clock that only moves when Advance is called, so that tests
+// can run epoch limits and backoff without waiting for them. Pass the same
+// one to every endpoint that is to share the time.
+type FakeClock struct {
+	mu          sync.Mutex
+	now         time.Time
+	timers      []*fakeTimer // pending, not in any order
+	changedChan chan int     // closed when a timer is added or taken off, and replaced
+}
+
+// NewFakeClock returns a FakeClock that reads start until it is advanced.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, changedChan: make(chan int)}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time // nil for AfterFunc
+	fn    func()
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: fc, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (fc *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: fc, fn: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers that come due on
+// the way in the order they do. Each fires with the clock at its due time.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	end := fc.now.Add(d)
+	for {
+		sort.Slice(fc.timers, func(i, j int) bool { return fc.timers[i].when.Before(fc.timers[j].when) })
+		if len(fc.timers) == 0 || fc.timers[0].when.After(end) {
+			break
+		}
+		t := fc.timers[0]
+		fc.timers = fc.timers[1:]
+		fc.changed()
+		if t.when.After(fc.now) {
+			fc.now = t.when
+		}
+		t.fire(fc.now)
+	}
+	fc.now = end
+	fc.mu.Unlock()
+}
+
+// BlockUntil waits until at least n timers are pending. Endpoints start
+// their timers from their own goroutines, so a test can call it after
+// Advance to know they have done what came due before advancing again.
+// Any pending timer counts, so one left over from before, or one started
+// by an endpoint that isn't done yet, can let it return early. Where that
+// matters, a test has to wait until exactly as many timers are pending as
+// there are once every endpoint is done.
+func (fc *FakeClock) BlockUntil(n int) {
+	for {
+		fc.mu.Lock()
+		pending, changedChan := len(fc.timers), fc.changedChan
+		fc.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changedChan
+	}
+}
+
+// fire sends the time or calls fn. Must be called with the clock's mu held.
+func (t *fakeTimer) fire(now time.Time) {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default: //like a time.Timer, one time at most waits to be received
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	fc := t.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return t.remove()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	fc := t.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	pending := t.remove()
+	t.when = fc.now.Add(d)
+	if d <= 0 {
+		t.fire(fc.now)
+		return pending
+	}
+	fc.timers = append(fc.timers, t)
+	fc.changed()
+	return pending
+}
+
+// changed wakes whoever waits for the pending timers to change. Must be
+// called with the clock's mu held.
+func (fc *FakeClock) changed() {
+	close(fc.changedChan)
+	fc.changedChan = make(chan int)
+}
+
+// remove takes the timer off the clock and drops a time it sent that wasn't
+// received yet, telling whether it was pending. Must be called with the
+// clock's mu held.
+func (t *fakeTimer) remove() bool {
+	if t.c != nil {
+		select {
+		case <-t.c:
+		default:
+		}
+	}
+	fc := t.clock
+	for i, pending := range fc.timers {
+		if pending == t {
+			fc.timers = append(fc.timers[:i], fc.timers[i+1:]...)
+			fc.changed()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Contains the handshake that closes a connection without waiting for the
+// peer to time out.
+
+package lsp
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrClosedByPeer is returned by Read once the other end closed the
+// connection and every message it sent before has been read.
+var ErrClosedByPeer = errors.New("lsp: connection closed by peer")
+
+// NewClose returns a new close message with the specified connection ID.
+func NewClose(connID int) *Message {
+	return &Message{
+		Type:   MsgClose,
+		ConnID: connID,
+	}
+}
+
+// NewCloseAck returns a new acknowledgement for a close message with the
+// specified connection ID.
+func NewCloseAck(connID int) *Message {
+	return &Message{
+		Type:   MsgCloseAck,
+		ConnID: connID,
+	}
+}
+
+// newCloseElem returns the close message for a connection, resent by
+// the timer wheel until the peer acks it. It uses seqNum 0 like the connect
+// message, so its timeouts never shrink the congestion window.
+func newCloseElem(connID int, token uint64, codec Codec) *windowElem {
+	msg := NewClose(connID)
+	msg.Token = token
+	byteMsg, _ := encode(msg, codec)
+	return &windowElem{
+		seqNum: 0,
+		msg:    byteMsg,
+	}
+}
+
+// flushed is called once everything written during Close has been acked. A
+// server that understands close messages is told the client is going away
+// and mainRoutine waits for the close ack, otherwise the client terminates
+// right away. It returns true if the client terminated.
+func (c *client) flushed() bool {
+	if c.features&FeatureClose == 0 {
+		c.terminateAll()
+		return true
+	}
+	if c.closeElem == nil {
+		c.closeElem = newCloseElem(c.connID, c.token, c.codec)
+		c.resend(c.closeElem, c.rtt.timeout())
+	}
+	return false
+}
+
+func (c *client) stopClosing() {
+	if c.closeElem != nil {
+		c.closeElem.stop()
+		c.closeElem = nil
+	}
+}
+
+// closedByPeer handles a close message from the server, which only sends one
+// once all of its messages have been acked. Messages the client wrote that
+// are still unacked are abandoned, and Read returns ErrClosedByPeer once the
+// messages already received have been read. It returns true if the client
+// terminated because it was closing as well.
+func (c *client) closedByPeer() bool {
+	c.sendAck(NewCloseAck(c.connID)) //every copy is acked, the last ack may be lost
+	if c.connDropped || c.closeReturn != nil {
+		return false
+	}
+	c.stopResending()
+	c.writeBuffer = sendQueue{}
+	c.graceChan = nil
+	if c.aboutToClose { //both sides closed at once
+		c.terminateAll()
+		return true
+	}
+	c.closeReturn = &readReturn{
+		connID:  c.connID,
+		seqNum:  -1,
+		payload: nil,
+		err:     ErrClosedByPeer,
+	}
+	c.endStreams(ErrClosedByPeer)
+	return false
+}
+
+// flushed is called once everything written to the client has been acked
+// after CloseConn or Close, the same way as for the client. It returns true
+// if clientMain terminated.
+func (sClient *s_client) flushed(s *server) bool {
+	if sClient.features&FeatureClose == 0 {
+		sClient.clientTerminateAll(s)
+		return true
+	}
+	if sClient.closeElem == nil {
+		sClient.closeElem = newCloseElem(sClient.connID, 0, sClient.codec)
+		sClient.resend(sClient.closeElem, sClient.rtt.timeout(), s)
+	}
+	return false
+}
+
+func (sClient *s_client) stopClosing() {
+	if sClient.closeElem != nil {
+		sClient.closeElem.stop()
+		sClient.closeElem = nil
+	}
+}
+
+// closedByPeer handles a close message from the client. The client goes away
+// at once so Write fails, messages written to it that are still unacked are
+// abandoned, and Read returns ErrClosedByPeer with its connID once the
+// messages already received have been read. It returns true if clientMain
+// terminated.
+func (sClient *s_client) closedByPeer(s *server) bool {
+	if sClient.peerClosed { //a copy of a close that was handled already
+		return false
+	}
+	sClient.stopResending(s)
+	sClient.ended(ConnClosedByPeer, s)
+	sClient.writeBuffer = sendQueue{}
+	sClient.graceChan = nil
+	if sClient.aboutToClose { //CloseConn or Close was called as well
+		sClient.clientTerminateAll(s)
+		return true
+	}
+	sClient.aboutToClose = true
+	sClient.peerClosed = true
+	sClient.clientTerminateAll(s)
+	if sClient.drained() { //nothing left for Read
+		sClient.countReady(s)
+		select {
+		case s.closedReturnChan <- sClient.droppedMessage():
+		case <-s.cancelChan:
+		case <-s.quitChan: //the server closed, nobody reads it any more
+		}
+		return true
+	}
+	return false
+}
+
+// droppedChan returns the channel Read gets the error for a client that is
+// gone from. A close by the client waits on closedReturnChan until nothing
+// else is left to read.
+func (sClient *s_client) droppedChan(s *server) chan *readReturn {
+	if sClient.peerClosed {
+		return s.closedReturnChan
+	}
+	return s.readReturnChan
+}
+
+// countReady keeps readyClients in step with whether the client has a
+// message waiting for Read that it isn't holding back.
+func (sClient *s_client) countReady(s *server) {
+	ready := !sClient.drained() && !sClient.held.Load()
+	if ready == sClient.counted {
+		return
+	}
+	sClient.counted = ready
+	if ready {
+		s.readyClients.Add(1)
+	} else if s.readyClients.Add(-1) == 0 {
+		notify(s.idleChan)
+	}
+}
+
+// droppedMessage returns what Read gets once the client is gone and every
+// message from it has been read.
+func (sClient *s_client) droppedMessage() *readReturn {
+	err := errors.New("This client disconnected")
+	if sClient.peerClosed {
+		err = ErrClosedByPeer
+	}
+	return &readReturn{
+		connID:  sClient.connID,
+		seqNum:  -1,
+		payload: nil,
+		err:     err,
+	}
+}
+
+// sendCloseAck acks a close message read from addr straight away. The client
+// may be gone already if an earlier ack was lost, in which case the ack uses
+// JSON, which the client can always decode. In secure mode its keys are gone
+// with it, and a client drops anything that isn't sealed, so no ack is sent
+// and the client gives up on the close after EpochLimit epochs.
+func (s *server) sendCloseAck(message *Message, sClient *s_client, addr net.Addr) {
+	if sClient != nil {
+		byteMessage, _ := encode(NewCloseAck(message.ConnID), sClient.codec)
+		sClient.writeTo(byteMessage, s)
+		return
+	}
+	if s.psk != nil {
+		return
+	}
+	byteMessage, _ := encode(NewCloseAck(message.ConnID), CodecJSON)
+	s.transport.WriteTo(byteMessage, addr)
+}
+
+// notify hands a signal to a routine over a channel with a buffer of one
+// without blocking, a signal that is already pending covers this one
+func notify(ch chan int) {
+	select {
+	case ch <- 1:
+	default:
+	}
+}
@@ -0,0 +1,256 @@
+// Contains the wire formats used to put an LSP message on the network.
+
+package lsp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Codec identifies the wire format used to encode LSP messages.
+type Codec int
+
+const (
+	CodecJSON   Codec = iota // Messages are encoded with encoding/json.
+	CodecBinary              // Messages are encoded with the compact binary format.
+)
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecJSON:
+		return "JSON"
+	case CodecBinary:
+		return "Binary"
+	}
+	return "Unknown"
+}
+
+// The binary format is a short fixed header followed by the fields that are
+// set, in the order of their bits in the fields mask:
+//
+//	magic(1) version(1) type(1) fields(4) connID(4) seqNum(4)
+//	[codec(1)] [size(4)] [checksum(2)] [fragIndex(4)] [fragCount(4)]
+//	[features(4)] [sackBits(8)] [window(4)] [token(8)] [stream(4)]
+//	[streamSeq(4)] [mode(1)] [digest(8)] [epochLimit(4)] [epochMillis(4)]
+//	[windowSize(4)] [payloadLen(4) payload(payloadLen)]
+//
+// so a plain ack is 15 bytes and a data message 25 bytes plus its payload.
+// All integers are big-endian. The magic byte can never start a JSON
+// document, so a receiver can always tell the two formats apart. The version
+// must be bumped whenever the layout changes, and a message of any other
+// version is dropped.
+const (
+	binaryMagic      = 0xd4
+	binaryVersion    = 2
+	binaryHeaderSize = 15
+)
+
+// The bits of the fields mask, one for each field that is only sent when set.
+const (
+	fieldCodec uint32 = 1 << iota
+	fieldSize
+	fieldChecksum
+	fieldFragIndex
+	fieldFragCount
+	fieldFeatures
+	fieldSackBits
+	fieldWindow
+	fieldToken
+	fieldStream
+	fieldStreamSeq
+	fieldMode
+	fieldDigest
+	fieldEpochLimit
+	fieldEpochMillis
+	fieldWindowSize
+	fieldPayload
+
+	allFields = fieldPayload<<1 - 1
+)
+
+// negotiateCodec returns the codec a connection should use given the codec
+// proposed by the client and the one preferred locally. Binary is only used
+// when both sides ask for it, so peers that only speak JSON keep working.
+func negotiateCodec(proposed, preferred Codec) Codec {
+	if proposed == CodecBinary && preferred == CodecBinary {
+		return CodecBinary
+	}
+	return CodecJSON
+}
+
+// encode marshals msg with the given codec.
+func encode(msg *Message, codec Codec) ([]byte, error) {
+	if codec == CodecBinary {
+		return marshalBinary(msg), nil
+	}
+	return marshal(msg)
+}
+
+// decode unmarshals data into v, detecting the codec it was encoded with.
+func decode(data []byte, v *Message) error {
+	if len(data) > 0 && data[0] == binaryMagic {
+		return unmarshalBinary(data, v)
+	}
+	return unmarshal(data, v)
+}
+
+func marshalBinary(msg *Message) []byte {
+	b := make([]byte, binaryHeaderSize, binaryHeaderSize+64+len(msg.Payload))
+	b[0] = binaryMagic
+	b[1] = binaryVersion
+	b[2] = byte(msg.Type)
+	binary.BigEndian.PutUint32(b[7:11], uint32(int32(msg.ConnID)))
+	binary.BigEndian.PutUint32(b[11:15], uint32(int32(msg.SeqNum)))
+
+	var fields uint32
+	put8 := func(field uint32, v int) {
+		if v != 0 {
+			fields |= field
+			b = append(b, byte(v))
+		}
+	}
+	put16 := func(field uint32, v uint16) {
+		if v != 0 {
+			fields |= field
+			b = binary.BigEndian.AppendUint16(b, v)
+		}
+	}
+	put32 := func(field uint32, v int) {
+		if v != 0 {
+			fields |= field
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(v)))
+		}
+	}
+	put64 := func(field uint32, v uint64) {
+		if v != 0 {
+			fields |= field
+			b = binary.BigEndian.AppendUint64(b, v)
+		}
+	}
+	put8(fieldCodec, int(msg.Codec))
+	put32(fieldSize, msg.Size)
+	put16(fieldChecksum, msg.Checksum)
+	put32(fieldFragIndex, msg.FragIndex)
+	put32(fieldFragCount, msg.FragCount)
+	put32(fieldFeatures, int(msg.Features))
+	put64(fieldSackBits, msg.SackBits)
+	put32(fieldWindow, msg.Window)
+	put64(fieldToken, msg.Token)
+	put32(fieldStream, msg.Stream)
+	put32(fieldStreamSeq, msg.StreamSeq)
+	put8(fieldMode, int(msg.Mode))
+	put64(fieldDigest, msg.Digest)
+	put32(fieldEpochLimit, msg.EpochLimit)
+	put32(fieldEpochMillis, msg.EpochMillis)
+	put32(fieldWindowSize, msg.WindowSize)
+	if len(msg.Payload) > 0 {
+		put32(fieldPayload, len(msg.Payload))
+		b = append(b, msg.Payload...)
+	}
+	binary.BigEndian.PutUint32(b[3:7], fields)
+	return b
+}
+
+// binaryReader reads the optional fields of a binary message in order,
+// remembering whether it ran out of bytes.
+type binaryReader struct {
+	data      []byte
+	fields    uint32
+	truncated bool
+}
+
+// next returns the n bytes of field, nil if the field isn't set
+func (r *binaryReader) next(field uint32, n int) []byte {
+	if r.fields&field == 0 || r.truncated {
+		return nil
+	}
+	if len(r.data) < n {
+		r.truncated = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) get8(field uint32) int {
+	if b := r.next(field, 1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *binaryReader) get16(field uint32) uint16 {
+	if b := r.next(field, 2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) get32(field uint32) int {
+	if b := r.next(field, 4); b != nil {
+		return int(int32(binary.BigEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (r *binaryReader) get64(field uint32) uint64 {
+	if b := r.next(field, 8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func unmarshalBinary(data []byte, v *Message) error {
+	if len(data) < 2 || data[0] != binaryMagic {
+		return errors.New("lsp: malformed binary message")
+	}
+	if data[1] != binaryVersion {
+		return errors.New("lsp: unsupported binary message version")
+	}
+	if len(data) < binaryHeaderSize {
+		return errors.New("lsp: truncated binary message")
+	}
+	r := &binaryReader{data: data[binaryHeaderSize:], fields: binary.BigEndian.Uint32(data[3:7])}
+	if r.fields&^allFields != 0 {
+		return errors.New("lsp: malformed binary message")
+	}
+	v.Type = MsgType(data[2])
+	v.ConnID = int(int32(binary.BigEndian.Uint32(data[7:11])))
+	v.SeqNum = int(int32(binary.BigEndian.Uint32(data[11:15])))
+	v.Codec = Codec(r.get8(fieldCodec))
+	v.Size = r.get32(fieldSize)
+	v.Checksum = r.get16(fieldChecksum)
+	v.FragIndex = r.get32(fieldFragIndex)
+	v.FragCount = r.get32(fieldFragCount)
+	v.Features = Feature(r.get32(fieldFeatures))
+	v.SackBits = r.get64(fieldSackBits)
+	v.Window = r.get32(fieldWindow)
+	v.Token = r.get64(fieldToken)
+	v.Stream = r.get32(fieldStream)
+	v.StreamSeq = r.get32(fieldStreamSeq)
+	v.Mode = DeliveryMode(r.get8(fieldMode))
+	v.Digest = r.get64(fieldDigest)
+	v.EpochLimit = r.get32(fieldEpochLimit)
+	v.EpochMillis = r.get32(fieldEpochMillis)
+	v.WindowSize = r.get32(fieldWindowSize)
+	v.Payload = nil
+	if payloadLen := r.get32(fieldPayload); payloadLen > 0 {
+		if len(r.data) < payloadLen {
+			return errors.New("lsp: truncated binary message")
+		}
+		v.Payload = make([]byte, payloadLen)
+		copy(v.Payload, r.data)
+		r.data = r.data[payloadLen:]
+	} else if payloadLen < 0 {
+		return errors.New("lsp: malformed binary message")
+	}
+	if r.truncated {
+		return errors.New("lsp: truncated binary message")
+	}
+	if len(r.data) != 0 {
+		return errors.New("lsp: malformed binary message")
+	}
+	return nil
+}
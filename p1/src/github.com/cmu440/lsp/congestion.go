@@ -0,0 +1,115 @@
+// Contains the congestion window that limits how many messages are in flight.
+
+package lsp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// congestionWindow implements AIMD congestion control under the sliding
+// window. It starts with a single message in flight, doubles every round
+// trip during slow start, then grows by one message per window of acks and
+// halves whenever a message times out. WindowSize is always the ceiling.
+// Without Params.CongestionControl it stays at WindowSize, so the window
+// behaves exactly as before.
+//
+// It is only updated by the routine that owns the window, effective is the
+// one field other goroutines may read.
+type congestionWindow struct {
+	enabled   bool
+	ceiling   int
+	cwnd      int
+	ssthresh  int
+	acked     int          // acks counted towards the next additive increase
+	recover   int          // timeouts of messages before this seqNum were already handled
+	lost      int          // seqNum of the message behind the last decrease
+	effective atomic.Int32 // copy of cwnd for observers
+}
+
+func newCongestionWindow(params *Params) *congestionWindow {
+	cw := &congestionWindow{}
+	cw.reset(params)
+	return cw
+}
+
+// reset starts over with the WindowSize of params as the ceiling, for a
+// window whose size was only agreed on after it was made.
+func (cw *congestionWindow) reset(params *Params) {
+	cw.enabled = params.CongestionControl
+	cw.ceiling = params.WindowSize
+	cw.cwnd = params.WindowSize
+	cw.ssthresh = params.WindowSize
+	cw.acked, cw.recover, cw.lost = 0, 0, 0
+	if cw.enabled {
+		cw.cwnd = 1
+	}
+	cw.effective.Store(int32(cw.cwnd))
+}
+
+// size returns how many messages may be in flight right now.
+func (cw *congestionWindow) size() int {
+	return cw.cwnd
+}
+
+// onAck grows the window for a message acked without timing out.
+func (cw *congestionWindow) onAck() {
+	if !cw.enabled || cw.cwnd >= cw.ceiling {
+		return
+	}
+	if cw.cwnd < cw.ssthresh { //slow start
+		cw.cwnd += 1
+	} else { //congestion avoidance
+		cw.acked += 1
+		if cw.acked >= cw.cwnd {
+			cw.acked = 0
+			cw.cwnd += 1
+		}
+	}
+	cw.effective.Store(int32(cw.cwnd))
+}
+
+// onTimeout shrinks the window when message seqNum had to be sent again.
+// Every message that was in flight at the time of a decrease is likely to
+// time out too, so only the first of them counts, unless that same message
+// times out again. nextSeqNum is the seqNum the next new message will get.
+func (cw *congestionWindow) onTimeout(seqNum, nextSeqNum int) {
+	if !cw.enabled || (seqNum < cw.recover && seqNum != cw.lost) {
+		return
+	}
+	cw.ssthresh = max(cw.cwnd/2, 1)
+	cw.cwnd = cw.ssthresh
+	cw.acked = 0
+	cw.recover = nextSeqNum
+	cw.lost = seqNum
+	cw.effective.Store(int32(cw.cwnd))
+}
+
+// timeoutQueue hands the seqNums of messages that timed out from the timer
+// wheel to the routine that owns the congestion window, without the wheel
+// ever waiting for it.
+type timeoutQueue struct {
+	mu        sync.Mutex
+	seqNums   []int
+	readyChan chan int // something was pushed since the last take
+}
+
+func newTimeoutQueue() *timeoutQueue {
+	return &timeoutQueue{readyChan: make(chan int, 1)}
+}
+
+func (q *timeoutQueue) push(seqNum int) {
+	q.mu.Lock()
+	q.seqNums = append(q.seqNums, seqNum)
+	q.mu.Unlock()
+	notify(q.readyChan)
+}
+
+// take returns every seqNum pushed since the last take, oldest first
+func (q *timeoutQueue) take() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seqNums := q.seqNums
+	q.seqNums = nil
+	return seqNums
+}
@@ -0,0 +1,236 @@
+// Contains the net.Conn adapter for a LSP client.
+
+package lsp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewConn wraps a client as a net.Conn, so code written against a byte
+// stream like bufio, encoding/gob or io.Copy runs over LSP. Each Write sends
+// its bytes as one message, split into several if they are longer than
+// MaxMessageSize, and Read returns the bytes of the messages it reads in
+// order, keeping what doesn't fit in b for the next Read. Read returns
+// io.EOF once the server closed the connection.
+//
+// Closing the conn closes the client, after which the client must not be
+// used on its own. LocalAddr and RemoteAddr are the addresses of the client's
+// transport, LocalAddr with the port the system picked for it.
+func NewConn(c Client) net.Conn {
+	nc := &clientConn{
+		client:        c,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closedChan:    make(chan int),
+	}
+	if impl, ok := c.(*client); ok {
+		nc.local = impl.transport.LocalAddr()
+		nc.remote = impl.serverAddr
+		nc.maxMessageSize = impl.params.maxMessageSize()
+	} else { //not one of ours, name it after its connection
+		nc.local = namedAddr{"lsp", "client " + strconv.Itoa(c.ConnID())}
+		nc.remote = namedAddr{"lsp", "server"}
+	}
+	return nc
+}
+
+// namedAddr is an address known only by its name, like one a server
+// reported a connection from or one of a Client from another package.
+type namedAddr struct {
+	network, name string
+}
+
+func (a namedAddr) Network() string { return a.network }
+func (a namedAddr) String() string  { return a.name }
+
+type clientConn struct {
+	client         Client
+	local, remote  net.Addr
+	maxMessageSize int // zero if messages don't have to be split
+
+	readMu        sync.Mutex // one Read at a time, they share unread
+	unread        []byte     // what is left of the last message read
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closeOnce  sync.Once
+	closeErr   error
+	closedChan chan int // closed once Close has been called
+}
+
+func (nc *clientConn) Read(b []byte) (int, error) {
+	nc.readMu.Lock()
+	defer nc.readMu.Unlock()
+	for len(nc.unread) == 0 { //empty messages carry no bytes, skip them
+		payload, err := nc.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		nc.unread = payload
+	}
+	n := copy(b, nc.unread)
+	nc.unread = nc.unread[n:]
+	return n, nil
+}
+
+func (nc *clientConn) readMessage() ([]byte, error) {
+	ctx, cancel, err := deadlineContext(nc.readDeadline, nc.closedChan)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	payload, err := nc.client.ReadContext(ctx)
+	if err == nil {
+		return payload, nil
+	} else if err == ErrClosedByPeer {
+		return nil, io.EOF
+	}
+	return nil, deadlineErr(err, nc.closedChan)
+}
+
+func (nc *clientConn) Write(b []byte) (int, error) {
+	return writeMessages(b, nc.maxMessageSize, nc.writeDeadline, nc.closedChan, nc.client.WriteContext)
+}
+
+// writeMessages sends b with write as one message, or as several of at most
+// maxMessageSize bytes if it is longer and maxMessageSize isn't zero, giving
+// up once d passes or closedChan is closed.
+func writeMessages(b []byte, maxMessageSize int, d *deadline, closedChan chan int,
+	write func(ctx context.Context, payload []byte) error) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if maxMessageSize > 0 && len(chunk) > maxMessageSize {
+			chunk = chunk[:maxMessageSize]
+		}
+		ctx, cancel, err := deadlineContext(d, closedChan)
+		if err != nil {
+			return written, err
+		}
+		//LSP keeps the payload until it is acked, b is the caller's again
+		err = write(ctx, append([]byte(nil), chunk...))
+		cancel()
+		if err != nil {
+			return written, deadlineErr(err, closedChan)
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// deadlineContext returns a context that is cancelled once d passes or
+// closedChan is closed, or the error to fail with right away if either
+// happened already.
+func deadlineContext(d *deadline, closedChan chan int) (context.Context, context.CancelFunc, error) {
+	select {
+	case <-closedChan:
+		return nil, nil, net.ErrClosed
+	case <-d.expired():
+		return nil, nil, os.ErrDeadlineExceeded
+	default:
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.expired():
+		case <-closedChan:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel, nil
+}
+
+// deadlineErr returns the error to fail with after LSP returned err for a
+// context from deadlineContext.
+func deadlineErr(err error, closedChan chan int) error {
+	if err != context.Canceled {
+		return err
+	}
+	select {
+	case <-closedChan:
+		return net.ErrClosed
+	default:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (nc *clientConn) Close() error {
+	nc.closeOnce.Do(func() {
+		close(nc.closedChan) //unblocks pending reads and writes
+		nc.closeErr = nc.client.Close()
+	})
+	return nc.closeErr
+}
+
+func (nc *clientConn) LocalAddr() net.Addr {
+	return nc.local
+}
+
+func (nc *clientConn) RemoteAddr() net.Addr {
+	return nc.remote
+}
+
+func (nc *clientConn) SetDeadline(t time.Time) error {
+	nc.readDeadline.set(t)
+	nc.writeDeadline.set(t)
+	return nil
+}
+
+func (nc *clientConn) SetReadDeadline(t time.Time) error {
+	nc.readDeadline.set(t)
+	return nil
+}
+
+func (nc *clientConn) SetWriteDeadline(t time.Time) error {
+	nc.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a point in time that pending and future calls wait for. Its
+// channel is closed once it passes, and replaced when it is moved after that.
+type deadline struct {
+	mu         sync.Mutex
+	timer      *time.Timer
+	passedChan chan int
+}
+
+func newDeadline() *deadline {
+	return &deadline{passedChan: make(chan int)}
+}
+
+// set moves the deadline to t, the zero time meaning none at all
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.passedChan //the timer fired, wait until it has closed the channel
+	}
+	d.timer = nil
+	select {
+	case <-d.passedChan:
+		d.passedChan = make(chan int)
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		passedChan := d.passedChan
+		d.timer = time.AfterFunc(wait, func() { close(passedChan) })
+	} else {
+		close(d.passedChan)
+	}
+}
+
+func (d *deadline) expired() chan int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passedChan
+}
@@ -0,0 +1,100 @@
+// Contains the connect cookies a server uses to make sure a client can be
+// reached at its address before setting anything up for it.
+
+package lsp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// With ConnectCookies on, the server answers the first connect message from
+// an address with a cookie, and only sets up a client once a connect message
+// echoing it comes back. A cookie is the time it was made and a MAC over
+// that time and the address it was sent to, keyed with a secret only the
+// server knows:
+//
+//	issued(8) mac(16)
+//
+// so the server checks a cookie without remembering the ones it handed out,
+// and one read off the wire is no good from any other address. A cookie is
+// good for as long as a client keeps trying to connect.
+const (
+	cookieSecretSize = 32
+	cookieMACSize    = 16
+	cookieSize       = 8 + cookieMACSize
+)
+
+// NewCookie returns a new cookie message carrying the specified cookie.
+func NewCookie(cookie []byte) *Message {
+	return &Message{
+		Type:   MsgCookie,
+		Cookie: cookie,
+	}
+}
+
+func newCookieSecret() []byte {
+	secret := make([]byte, cookieSecretSize)
+	rand.Read(secret)
+	return secret
+}
+
+func (s *server) cookieMAC(addr net.Addr, issued int64) []byte {
+	return keyedHash(s.cookieSecret, "lsp cookie", []byte(addr.String()), uint64Bytes(uint64(issued)))[:cookieMACSize]
+}
+
+// makeCookie returns a cookie for addr issued at now.
+func (s *server) makeCookie(addr net.Addr, now time.Time) []byte {
+	cookie := make([]byte, 8, cookieSize)
+	binary.BigEndian.PutUint64(cookie, uint64(now.UnixMilli()))
+	return append(cookie, s.cookieMAC(addr, now.UnixMilli())...)
+}
+
+// validCookie tells whether cookie was made by this server for addr and is
+// still good at now.
+func (s *server) validCookie(cookie []byte, addr net.Addr, now time.Time) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+	issued := int64(binary.BigEndian.Uint64(cookie[:8]))
+	age := now.UnixMilli() - issued
+	if age < 0 || age > int64(s.params.EpochLimit*s.params.EpochMillis) {
+		return false
+	}
+	return hmac.Equal(cookie[8:], s.cookieMAC(addr, issued))
+}
+
+// admit tells whether the first connect message from addr may set up a
+// client. With cookies on, one without a valid cookie is answered with a
+// fresh cookie instead, which costs the server nothing but the reply.
+func (s *server) admit(message *Message, addr net.Addr) bool {
+	if !s.params.ConnectCookies {
+		return true
+	}
+	now := s.wheel.clock.Now()
+	if s.validCookie(message.Cookie, addr, now) {
+		return true
+	}
+	if b, err := marshal(NewCookie(s.makeCookie(addr, now))); err == nil {
+		s.transport.WriteTo(b, addr)
+	}
+	return false
+}
+
+// full tells whether the server already has as many clients as it may keep
+func (s *server) full() bool {
+	return s.params.MaxConnections > 0 && s.clients.len() >= s.params.MaxConnections
+}
+
+// gotCookie hands a cookie from the server to NewClient, which is the only
+// one that has a use for it. Cookies arriving once it has moved on are
+// dropped.
+func (c *client) gotCookie(message *Message) {
+	select {
+	case c.cookieChan <- message.Cookie:
+	default:
+	}
+}
@@ -0,0 +1,143 @@
+// Contains the delivery modes data messages may be written with.
+
+package lsp
+
+import "errors"
+
+// DeliveryMode says how a message written with WriteMode gets to the other
+// end. Messages written in different modes share the connection, its
+// heartbeats and its close handshake.
+type DeliveryMode int
+
+const (
+	ReliableOrdered   DeliveryMode = iota // Resent until acked and read in the order written, like Write.
+	ReliableUnordered                     // Resent until acked, but read as soon as it arrives.
+	Unreliable                            // Sent once and never acked, lost if dropped or read too late.
+)
+
+// String returns the name of the delivery mode.
+func (m DeliveryMode) String() string {
+	switch m {
+	case ReliableOrdered:
+		return "ReliableOrdered"
+	case ReliableUnordered:
+		return "ReliableUnordered"
+	case Unreliable:
+		return "Unreliable"
+	}
+	return "Unknown"
+}
+
+// maxQueuedDatagrams is how many unreliable messages wait for Read. Once it
+// is reached the oldest one is dropped, a stale update is worth less than a
+// fresh one.
+const maxQueuedDatagrams = 64
+
+// checkMode returns an error if payload can't be written in mode. Only a
+// reliable ordered payload may be split into fragments.
+func checkMode(params *Params, mode DeliveryMode, payload []byte) error {
+	if mode < ReliableOrdered || mode > Unreliable {
+		return errors.New("Unknown delivery mode")
+	}
+	if mode != ReliableOrdered && len(payload) > params.maxFragmentSize() {
+		return errors.New("Payload exceeds MaxFragmentSize")
+	}
+	return nil
+}
+
+// unorderedQueue holds the messages that are read ahead of the in-order
+// ones: reliable unordered messages, which are acked and have to be read,
+// and datagrams, which may be dropped while they wait.
+type unorderedQueue struct {
+	reliable  []*readReturn
+	datagrams []*readReturn
+}
+
+func (q *unorderedQueue) len() int {
+	return len(q.reliable) + len(q.datagrams)
+}
+
+// next returns the message Read gets next, nil if there is none
+func (q *unorderedQueue) next() *readReturn {
+	if len(q.reliable) > 0 {
+		return q.reliable[0]
+	} else if len(q.datagrams) > 0 {
+		return q.datagrams[0]
+	}
+	return nil
+}
+
+// pop removes the message returned by next
+func (q *unorderedQueue) pop() {
+	if len(q.reliable) > 0 {
+		q.reliable = q.reliable[1:]
+	} else {
+		q.datagrams = q.datagrams[1:]
+	}
+}
+
+func (q *unorderedQueue) push(message *Message) {
+	ret := &readReturn{
+		connID:  message.ConnID,
+		seqNum:  message.SeqNum,
+		payload: message.Payload,
+		err:     nil,
+	}
+	if message.Mode == ReliableUnordered {
+		q.reliable = append(q.reliable, ret)
+		return
+	}
+	if len(q.datagrams) >= maxQueuedDatagrams {
+		q.datagrams = q.datagrams[1:] //drop the stalest
+	}
+	q.datagrams = append(q.datagrams, ret)
+}
+
+// newDatagram returns the encoded unreliable data message for payload, or
+// nil if it can't be encoded.
+func newDatagram(connID int, token uint64, payload []byte, codec Codec, ig *integrity) []byte {
+	data := newFragment(connID, 0, payload, 0, 1)
+	data.Token = token
+	data.Mode = Unreliable
+	data.Checksum = makeCheckSum(connID, 0, data.Size, payload, 0, 0, 0, 0, int(Unreliable))
+	ig.sign(data)
+	msg, err := encode(data, codec)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// sendDatagram writes an unreliable message straight to the server, it isn't
+// worth holding on to while the session is suspended.
+func (c *client) sendDatagram(payload []byte) {
+	if c.suspended {
+		return
+	}
+	if msg := newDatagram(c.connID, c.token, payload, c.codec, c.integrity.Load()); msg != nil {
+		c.stats.dataSent += 1
+		c.send(msg)
+	}
+}
+
+// sendDatagram writes an unreliable message straight to the client, the same
+// way as the client does.
+func (sClient *s_client) sendDatagram(payload []byte, s *server) {
+	if sClient.suspended {
+		return
+	}
+	if msg := newDatagram(sClient.connID, 0, payload, sClient.codec, sClient.integrity); msg != nil {
+		sClient.stats.dataSent += 1
+		sClient.writeTo(msg, s)
+	}
+}
+
+// drained tells whether nothing received from the server is waiting for Read
+func (c *client) drained() bool {
+	return c.messageToPush == nil && c.unordered.len() == 0
+}
+
+// drained tells whether nothing received from the client is waiting for Read
+func (sClient *s_client) drained() bool {
+	return sClient.messageToPush == nil && sClient.unordered.len() == 0
+}
@@ -0,0 +1,84 @@
+// Contains the connection lifecycle events a server reports through Events.
+
+package lsp
+
+// ConnEventType says what happened to a connection.
+type ConnEventType int
+
+const (
+	ConnOpened        ConnEventType = iota // A client connected.
+	ConnLost                               // The client stopped answering, or didn't resume in time.
+	ConnClosedByPeer                       // The client closed the connection.
+	ConnClosedLocally                      // CloseConn or Close closed the connection.
+)
+
+// String returns the name of the event type.
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnOpened:
+		return "Opened"
+	case ConnLost:
+		return "Lost"
+	case ConnClosedByPeer:
+		return "ClosedByPeer"
+	case ConnClosedLocally:
+		return "ClosedLocally"
+	}
+	return "Unknown"
+}
+
+// ConnEvent is a change in the lifecycle of one connection. Every connection
+// gets a ConnOpened event, and at most one of the others once it ends.
+type ConnEvent struct {
+	Type   ConnEventType
+	ConnID int
+	Addr   string // address of the client when the event happened
+}
+
+// maxQueuedEvents is how many events wait for the application. Once it is
+// reached the oldest one is dropped, so a server nobody takes events from
+// doesn't keep every one of them.
+const maxQueuedEvents = 1024
+
+// report queues an event in the events channel, which has room for
+// maxQueuedEvents of them, so that reporting one never waits for the
+// application. Once the server has shut down it does nothing.
+func (s *server) report(eventType ConnEventType, connID int, addr string) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if s.eventsClosed {
+		return
+	}
+	event := ConnEvent{Type: eventType, ConnID: connID, Addr: addr}
+	select {
+	case s.eventChan <- event:
+	default:
+		select {
+		case <-s.eventChan: //drop the oldest
+		default: //the application just took it
+		}
+		s.eventChan <- event //nobody else sends, so there is room now
+	}
+}
+
+// closeEvents closes the events channel once the server has shut down. The
+// events still in it can be taken after that.
+func (s *server) closeEvents() {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	s.eventsClosed = true
+	close(s.eventChan)
+}
+
+// ended reports how the connection ended, only the first time it is called
+func (sClient *s_client) ended(eventType ConnEventType, s *server) {
+	if sClient.endReported {
+		return
+	}
+	sClient.endReported = true
+	s.report(eventType, sClient.connID, sClient.remote().String())
+}
+
+func (s *server) Events() <-chan ConnEvent {
+	return s.eventChan
+}
@@ -0,0 +1,46 @@
+// Contains the optional protocol features negotiated during connect.
+
+package lsp
+
+// Feature is a bit set of optional protocol features. A client proposes the
+// features it would like in its connect message and the server answers with
+// the ones both sides want in the connect ack, so peers that know nothing
+// about a feature simply never turn it on.
+type Feature uint32
+
+const (
+	FeatureSack        Feature = 1 << iota // Receivers send cumulative plus selective acks.
+	FeatureFlowControl                     // Receivers advertise a receive window in acks.
+	FeatureMigration                       // Clients may move to a new address, proving who they are with a token.
+	FeatureResume                          // Lost connections may be resumed within a grace period.
+	FeatureClose                           // Closing a connection tells the peer with a close message.
+	FeatureStreams                         // Clients may open streams besides stream 0.
+	FeatureModes                           // Data messages may be written unordered or unreliably.
+	FeatureSecure                          // Messages are sealed with keys derived from a pre-shared key.
+	FeatureCRC32C                          // Data messages and SACKs carry a CRC-32C digest.
+	FeatureKeyedHash                       // Data messages and SACKs carry a keyed hash digest.
+)
+
+// features returns the optional features asked for by these params. Flow
+// control, migration, the close handshake, streams and delivery modes are
+// always asked for, flow control costs nothing when MaxUnreadMessages is left
+// unset.
+func (p *Params) features() Feature {
+	features := FeatureFlowControl | FeatureMigration | FeatureClose | FeatureStreams | FeatureModes
+	if p.SelectiveAck {
+		features |= FeatureSack
+	}
+	if p.ResumeGraceMillis > 0 {
+		features |= FeatureResume
+	}
+	if len(p.PreSharedKey) > 0 || p.KeyFile != "" {
+		features |= FeatureSecure
+	}
+	return features | integrityFeatures(p.Integrity)
+}
+
+// negotiateFeatures returns the features a connection should use given the
+// ones proposed by the client and the ones wanted locally.
+func negotiateFeatures(proposed, wanted Feature) Feature {
+	return proposed & wanted
+}
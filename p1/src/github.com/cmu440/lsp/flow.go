@@ -0,0 +1,33 @@
+// Contains the receive window used for flow control.
+
+package lsp
+
+import "math"
+
+// unlimitedWindow is advertised by receivers without a MaxUnreadMessages
+// limit, so their peers are only held back by the congestion window.
+const unlimitedWindow = math.MaxInt32
+
+// receiveWindow returns how many more out-of-order messages a receiver
+// holding unread messages can take.
+func receiveWindow(params *Params, unread int) int {
+	if params.MaxUnreadMessages <= 0 {
+		return unlimitedWindow
+	}
+	return max(params.MaxUnreadMessages-unread, 0)
+}
+
+// overLimit tells whether a receiver holding unread messages has to drop a
+// data message that arrived out of order, without acking it. The next
+// message in order is always taken since nothing can be read without it,
+// so a sender probing a full receiver still makes progress.
+func overLimit(params *Params, unread int) bool {
+	return params.MaxUnreadMessages > 0 && unread >= params.MaxUnreadMessages
+}
+
+// sendLimit returns how many messages a sender may have in flight given its
+// congestion window and the receive window last advertised by its peer. One
+// message is always allowed, it probes a full receiver until it drains.
+func sendLimit(congestion, peerWindow int) int {
+	return max(min(congestion, peerWindow), 1)
+}
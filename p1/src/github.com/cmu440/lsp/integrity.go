@@ -0,0 +1,114 @@
+// Contains the integrity algorithms that protect data messages and SACKs
+// against corruption.
+
+package lsp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Integrity selects how data messages and SACKs are checked for corruption.
+// The 16-bit Checksum is a ones' complement sum: it can't tell reordered
+// words or fields apart, and misses any two errors that cancel out. The
+// other algorithms put a stronger code over the whole message in Digest.
+type Integrity int
+
+const (
+	IntegrityChecksum  Integrity = iota // Only the 16-bit ones' complement sum in Checksum.
+	IntegrityCRC32C                     // A CRC-32C of the whole message.
+	IntegrityKeyedHash                  // An HMAC-SHA256 of the whole message, truncated to 64 bits, keyed with the connection's token.
+)
+
+// String returns the name of the integrity algorithm.
+func (ig Integrity) String() string {
+	switch ig {
+	case IntegrityChecksum:
+		return "Checksum"
+	case IntegrityCRC32C:
+		return "CRC32C"
+	case IntegrityKeyedHash:
+		return "KeyedHash"
+	}
+	return "Unknown"
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// integrityFeatures returns the feature bits for every algorithm up to ig,
+// so that negotiation settles on the strongest one both ends allow.
+func integrityFeatures(ig Integrity) Feature {
+	switch ig {
+	case IntegrityCRC32C:
+		return FeatureCRC32C
+	case IntegrityKeyedHash:
+		return FeatureCRC32C | FeatureKeyedHash
+	}
+	return 0
+}
+
+// negotiatedIntegrity returns the strongest algorithm in features.
+func negotiatedIntegrity(features Feature) Integrity {
+	if features&FeatureKeyedHash != 0 {
+		return IntegrityKeyedHash
+	} else if features&FeatureCRC32C != 0 {
+		return IntegrityCRC32C
+	}
+	return IntegrityChecksum
+}
+
+// integrity is the algorithm a connection agreed on. A nil *integrity is the
+// plain checksum, which is all there is before the connect ack.
+type integrity struct {
+	kind Integrity
+	key  []byte // only for the keyed hash
+}
+
+// newIntegrity returns the algorithm for a connection with the given
+// features. The keyed hash is keyed with the connection's token, and the
+// pre-shared key in secure mode. Without a pre-shared key the token is all
+// there is, and it travels in the clear in the connect ack: the keyed hash
+// then catches corruption and blind spoofing, but not a forger who saw the
+// ack. Only secure mode keeps anyone from making up a message that passes.
+func newIntegrity(features Feature, psk []byte, connID int, token uint64) *integrity {
+	ig := &integrity{kind: negotiatedIntegrity(features)}
+	if ig.kind == IntegrityKeyedHash {
+		ig.key = keyedHash(psk, "lsp integrity", uint64Bytes(uint64(connID)), uint64Bytes(token))
+	}
+	return ig
+}
+
+// usesDigest tells whether messages carry a Digest that has to be checked.
+func (ig *integrity) usesDigest() bool {
+	return ig != nil && ig.kind != IntegrityChecksum
+}
+
+// digest returns the code over every field of msg that matters to the
+// receiver, each at its own offset so that nothing can be swapped around.
+func (ig *integrity) digest(msg *Message) uint64 {
+	b := make([]byte, 12*8, 12*8+len(msg.Payload))
+	for i, field := range []uint64{
+		uint64(msg.Type), uint64(msg.ConnID), uint64(msg.SeqNum), uint64(msg.Size),
+		uint64(msg.FragIndex), uint64(msg.FragCount), uint64(msg.Stream), uint64(msg.StreamSeq),
+		uint64(msg.Mode), msg.SackBits, uint64(msg.Window), msg.Token,
+	} {
+		binary.BigEndian.PutUint64(b[i*8:], field)
+	}
+	b = append(b, msg.Payload...)
+	if ig.kind == IntegrityCRC32C {
+		return uint64(crc32.Checksum(b, castagnoli))
+	}
+	mac := hmac.New(sha256.New, ig.key)
+	mac.Write(b)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// sign sets the Digest of a data message or SACK about to be encoded, after
+// everything else in it has been filled in.
+func (ig *integrity) sign(msg *Message) {
+	if ig.usesDigest() && (msg.Type == MsgData || msg.Type == MsgSack) {
+		msg.Digest = ig.digest(msg)
+	}
+}
@@ -0,0 +1,368 @@
+// Contains the net.Listener adapter for a LSP server.
+
+package lsp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewListener wraps a server as a net.Listener whose Accept returns a
+// net.Conn for each connection, so each client can be served by a goroutine
+// of its own. The conns are byte streams like the ones of NewConn. The
+// listener takes over the server's Read and Events, which must not be used
+// on their own anymore, and hands every message to the conn it belongs to
+// right away, so a conn that isn't read from holds on to its messages
+// without keeping the others waiting. Once a conn holds maxConnMessages
+// messages the server stops handing the listener messages from its client
+// until the conn is read from. They wait with the server instead, where
+// MaxUnreadMessages slows down that client alone as it does without a
+// listener, while the other conns keep getting theirs. A Server from another
+// package can't be asked to, so its conns keep every message.
+//
+// Closing a conn closes its connection like CloseConn, and closing the
+// listener closes the server.
+func NewListener(s Server) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &listener{
+		server:          s,
+		conns:           make(map[int]*listenerConn),
+		endedEarly:      make(map[int]bool),
+		acceptReadyChan: make(chan int, 1),
+		closedChan:      make(chan int),
+		cancelRead:      cancel,
+		readDoneChan:    make(chan int),
+	}
+	if impl, ok := s.(*server); ok {
+		l.addr = impl.transport.LocalAddr()
+		l.maxMessageSize = impl.params.maxMessageSize()
+	} else {
+		l.addr = namedAddr{"lsp", "server"}
+	}
+	go l.readRoutine(ctx)
+	go l.eventRoutine()
+	return l
+}
+
+// maxConnMessages is how many messages a conn of a listener holds before
+// the server stops handing the listener messages from its client.
+const maxConnMessages = 64
+
+type listener struct {
+	server         Server
+	addr           net.Addr
+	maxMessageSize int // zero if messages don't have to be split
+
+	mu              sync.Mutex
+	conns           map[int]*listenerConn // connections the server hasn't ended yet
+	endedEarly      map[int]bool          // connections that ended before their ConnOpened event came
+	lastOpened      int                   // connID of the last ConnOpened event
+	backlog         []*listenerConn       // conns waiting for Accept
+	acceptReadyChan chan int              // something was added to the backlog
+
+	closeOnce    sync.Once
+	closeErr     error
+	closedChan   chan int // closed once Close has been called
+	cancelRead   context.CancelFunc
+	readDoneChan chan int // readRoutine stopped reading from the server
+}
+
+// listenerConn is a single connection accepted from a listener.
+type listenerConn struct {
+	l      *listener
+	connID int
+	remote net.Addr
+
+	mu        sync.Mutex
+	messages  [][]byte // read from the server, not from the conn yet
+	err       error    // why the server ended the connection, once it has
+	full      bool     // holds maxConnMessages, the server holds back the rest
+	readyChan chan int // a message or err came in
+
+	readMu        sync.Mutex // one Read at a time, they share unread
+	unread        []byte     // what is left of the last message read
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closeOnce  sync.Once
+	closedChan chan int // closed once Close has been called
+}
+
+// add puts a new conn for connID in the backlog. Must be called with l.mu
+// held.
+func (l *listener) add(connID int) *listenerConn {
+	lc := &listenerConn{
+		l:             l,
+		connID:        connID,
+		remote:        namedAddr{l.addr.Network(), ""},
+		readyChan:     make(chan int, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closedChan:    make(chan int),
+	}
+	if impl, ok := l.server.(*server); ok {
+		if sClient := impl.clients.get(connID); sClient != nil {
+			lc.remote = sClient.remote()
+		}
+	}
+	l.conns[connID] = lc
+	l.backlog = append(l.backlog, lc)
+	notify(l.acceptReadyChan)
+	return lc
+}
+
+// readRoutine hands what the server reads to the conns. A connection is
+// accepted the first time anything is read from it, so that Accept doesn't
+// depend on an event that may have been dropped.
+func (l *listener) readRoutine(ctx context.Context) {
+	defer close(l.readDoneChan)
+	for {
+		connID, payload, err := l.server.ReadContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		l.mu.Lock()
+		lc := l.conns[connID]
+		if lc == nil {
+			lc = l.add(connID)
+		}
+		if err != nil {
+			delete(l.conns, connID)
+			if connID > l.lastOpened { //its event mustn't add it again
+				l.endedEarly[connID] = true
+			}
+		}
+		l.mu.Unlock()
+		lc.hold(payload, err)
+	}
+}
+
+// hold keeps a message for Read, or the error that ended the connection. A
+// conn that was closed drops its messages.
+func (lc *listenerConn) hold(payload []byte, err error) {
+	lc.mu.Lock()
+	select {
+	case <-lc.closedChan:
+		lc.mu.Unlock()
+		return
+	default:
+	}
+	if err != nil {
+		lc.err = err
+	} else {
+		lc.messages = append(lc.messages, payload)
+	}
+	if !lc.full && len(lc.messages) >= maxConnMessages {
+		lc.full = true
+		lc.l.holdReads(lc.connID, true)
+	}
+	lc.mu.Unlock()
+	notify(lc.readyChan)
+}
+
+// holdReads asks the server to stop handing Read messages from the client
+// with connID, or to start again. Servers from another package are never
+// asked.
+func (l *listener) holdReads(connID int, held bool) {
+	if impl, ok := l.server.(*server); ok {
+		impl.holdReads(connID, held)
+	}
+}
+
+// holdReads makes Read skip the client with connID while held is set. Its
+// messages wait with the client, counted against MaxUnreadMessages, and the
+// error Read returns once it is gone waits for them.
+func (s *server) holdReads(connID int, held bool) {
+	if sClient := s.clients.get(connID); sClient != nil && sClient.held.Swap(held) != held {
+		notify(sClient.heldChan)
+	}
+}
+
+// eventRoutine accepts the connections the server opens that nothing has
+// been read from yet, and tells every conn the address its client connected
+// from. Events come in the order of their connIDs.
+func (l *listener) eventRoutine() {
+	network := l.addr.Network()
+	for event := range l.server.Events() {
+		if event.Type != ConnOpened {
+			continue //readRoutine finds out from Read
+		}
+		l.mu.Lock()
+		ended := l.endedEarly[event.ConnID]
+		l.lastOpened = event.ConnID
+		for connID := range l.endedEarly {
+			if connID <= event.ConnID { //its event came, or was dropped
+				delete(l.endedEarly, connID)
+			}
+		}
+		lc := l.conns[event.ConnID]
+		if lc == nil && !ended {
+			lc = l.add(event.ConnID)
+		}
+		if lc != nil {
+			lc.remote = namedAddr{network, event.Addr}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-l.closedChan:
+			return nil, net.ErrClosed
+		default:
+		}
+		l.mu.Lock()
+		if len(l.backlog) > 0 {
+			lc := l.backlog[0]
+			l.backlog = l.backlog[1:]
+			if len(l.backlog) > 0 {
+				notify(l.acceptReadyChan) //for the next Accept
+			}
+			l.mu.Unlock()
+			return lc, nil
+		}
+		l.mu.Unlock()
+		select {
+		case <-l.acceptReadyChan:
+		case <-l.closedChan:
+		}
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closedChan)
+		l.cancelRead() //the server must not be read from once it is closed
+		<-l.readDoneChan
+		l.closeErr = l.server.Close()
+	})
+	return l.closeErr
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+func (lc *listenerConn) Read(b []byte) (int, error) {
+	lc.readMu.Lock()
+	defer lc.readMu.Unlock()
+	for len(lc.unread) == 0 { //empty messages carry no bytes, skip them
+		payload, err := lc.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		lc.unread = payload
+	}
+	n := copy(b, lc.unread)
+	lc.unread = lc.unread[n:]
+	return n, nil
+}
+
+// readMessage returns the next message of the connection, once every
+// message has been read the reason it ended
+func (lc *listenerConn) readMessage() ([]byte, error) {
+	for {
+		select {
+		case <-lc.closedChan:
+			return nil, net.ErrClosed
+		case <-lc.l.closedChan:
+			return nil, net.ErrClosed
+		case <-lc.readDeadline.expired():
+			return nil, os.ErrDeadlineExceeded
+		default:
+		}
+		lc.mu.Lock()
+		if len(lc.messages) > 0 {
+			payload := lc.messages[0]
+			lc.messages = lc.messages[1:]
+			if lc.full && len(lc.messages) < maxConnMessages {
+				lc.full = false
+				lc.l.holdReads(lc.connID, false)
+			}
+			lc.mu.Unlock()
+			return payload, nil
+		} else if lc.err != nil {
+			err := lc.err
+			lc.mu.Unlock()
+			if err == ErrClosedByPeer {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		lc.mu.Unlock()
+		select {
+		case <-lc.readyChan:
+		case <-lc.closedChan:
+		case <-lc.l.closedChan:
+		case <-lc.readDeadline.expired():
+		}
+	}
+}
+
+func (lc *listenerConn) Write(b []byte) (int, error) {
+	select {
+	case <-lc.l.closedChan:
+		return 0, net.ErrClosed
+	default:
+	}
+	return writeMessages(b, lc.l.maxMessageSize, lc.writeDeadline, lc.closedChan,
+		func(ctx context.Context, payload []byte) error {
+			return lc.l.server.WriteContext(ctx, lc.connID, payload)
+		})
+}
+
+// Close closes the connection unless the server ended it already. Like
+// CloseConn, it doesn't wait for pending messages to be acked.
+func (lc *listenerConn) Close() error {
+	var err error
+	lc.closeOnce.Do(func() {
+		close(lc.closedChan) //unblocks pending reads and writes
+		lc.mu.Lock()
+		ended := lc.err != nil
+		if lc.full { //let the rest come in to be dropped
+			lc.full = false
+			lc.l.holdReads(lc.connID, false)
+		}
+		lc.mu.Unlock()
+		select {
+		case <-lc.l.closedChan: //the server is closing them all
+		default:
+			if !ended {
+				err = lc.l.server.CloseConn(lc.connID)
+			}
+		}
+	})
+	return err
+}
+
+func (lc *listenerConn) LocalAddr() net.Addr {
+	return lc.l.addr
+}
+
+func (lc *listenerConn) RemoteAddr() net.Addr {
+	lc.l.mu.Lock()
+	defer lc.l.mu.Unlock()
+	return lc.remote
+}
+
+func (lc *listenerConn) SetDeadline(t time.Time) error {
+	lc.readDeadline.set(t)
+	lc.writeDeadline.set(t)
+	return nil
+}
+
+func (lc *listenerConn) SetReadDeadline(t time.Time) error {
+	lc.readDeadline.set(t)
+	return nil
+}
+
+func (lc *listenerConn) SetWriteDeadline(t time.Time) error {
+	lc.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,89 @@
+// LSP retransmission timeout tests.
+
+// These tests check that the retransmission timeout follows the measured
+// round trip times within the bounds set in Params, that messages sent more
+// than once are never sampled, and that a connection with short round trips
+// recovers lost messages long before an epoch is over.
+
+package lsp
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	params := makeParams(5, 2000, 1)
+	params.MinRTOMillis = 10
+	params.MaxRTOMillis = 1000
+	rtt := newRTTEstimator(params)
+	if rto := rtt.timeout(); rto != time.Second {
+		t.Fatalf("Timeout before any sample is %s, expected %s", rto, time.Second)
+	}
+	rtt.sample(40 * time.Millisecond)
+	if rto := rtt.timeout(); rto != 120*time.Millisecond { // 40ms + 4 * 20ms
+		t.Fatalf("Timeout after the first sample is %s, expected %s", rto, 120*time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		rtt.sample(time.Millisecond)
+	}
+	if rto := rtt.timeout(); rto != 10*time.Millisecond {
+		t.Fatalf("Timeout for a fast path is %s, expected the lower bound %s", rto, 10*time.Millisecond)
+	}
+	rtt.sample(10 * time.Second)
+	if rto := rtt.timeout(); rto != time.Second {
+		t.Fatalf("Timeout after a slow sample is %s, expected the upper bound %s", rto, time.Second)
+	}
+}
+
+func TestRTTEstimatorKarn(t *testing.T) {
+	rtt := newRTTEstimator(&Params{EpochMillis: 2000, MinRTOMillis: 10})
+	rtt.observe(&windowElem{sentAt: time.Now().Add(-time.Second), retransmitted: true})
+	if rtt.sampled {
+		t.Fatalf("Sampled the round trip of a retransmitted message")
+	}
+	rtt.observe(&windowElem{sentAt: time.Now().Add(-50 * time.Millisecond)})
+	if !rtt.sampled || rtt.timeout() < 50*time.Millisecond || rtt.timeout() > time.Second {
+		t.Fatalf("Timeout after a 50ms sample is %s", rtt.timeout())
+	}
+}
+
+func TestRTODefaults(t *testing.T) {
+	params := makeParams(5, 300, 1)
+	if params.minRTO() != 300*time.Millisecond || params.maxRTO() != 300*time.Millisecond {
+		t.Fatalf("Default bounds are [%s, %s], expected one epoch", params.minRTO(), params.maxRTO())
+	}
+	params.MinRTOMillis = 500
+	if params.minRTO() != params.maxRTO() {
+		t.Fatalf("Lower bound %s is above the upper bound %s", params.minRTO(), params.maxRTO())
+	}
+	if timeout := nextTimeout(200*time.Millisecond, params); timeout != 300*time.Millisecond {
+		t.Fatalf("Backed off timeout is %s, expected %s", timeout, 300*time.Millisecond)
+	}
+}
+
+func TestAdaptiveRTO(t *testing.T) {
+	fmt.Printf("=== TestAdaptiveRTO: 2s epochs, 20ms minimum timeout, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(10, 2000, 4)
+	params.MinRTOMillis = 20
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+
+	// warm the estimate up on a clean path
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip([][]byte{[]byte("warm"), []byte("up")}, 5*time.Second)
+
+	lspnet.SetWriteDropPercent(20)
+	payloads := make([][]byte, 30)
+	for i := range payloads {
+		payloads[i] = []byte("message " + strconv.Itoa(i))
+	}
+	// a fixed timeout would wait a whole 2s epoch for every lost message
+	fts.roundTrip(payloads, 4*time.Second)
+}
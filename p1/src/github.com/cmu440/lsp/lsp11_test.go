@@ -0,0 +1,144 @@
+// LSP congestion control tests.
+
+// These tests check that the congestion window goes through slow start,
+// additive increase and multiplicative decrease while never exceeding
+// WindowSize, that it leaves the window alone unless it is turned on, and
+// that the effective window reported by the client and the server follows
+// the losses on the path.
+
+package lsp
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestCongestionWindowAIMD(t *testing.T) {
+	cw := newCongestionWindow(&Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 8, CongestionControl: true})
+	if cw.size() != 1 {
+		t.Fatalf("Initial window is %d, expected 1", cw.size())
+	}
+	for i := 0; i < 3; i++ { // slow start grows by one per ack
+		cw.onAck()
+	}
+	if cw.size() != 4 {
+		t.Fatalf("Window after 3 acks in slow start is %d, expected 4", cw.size())
+	}
+	cw.onTimeout(10, 20)
+	if cw.size() != 2 || cw.ssthresh != 2 {
+		t.Fatalf("Window after a timeout is %d with threshold %d, expected 2 and 2", cw.size(), cw.ssthresh)
+	}
+	cw.onTimeout(15, 20) // in flight during the last decrease
+	if cw.size() != 2 {
+		t.Fatalf("Window shrank twice for the same loss, now %d", cw.size())
+	}
+	cw.onTimeout(10, 20) // the same message timed out again
+	if cw.size() != 1 {
+		t.Fatalf("Window after a repeated timeout is %d, expected 1", cw.size())
+	}
+	cw.onAck() // at the threshold of 1, so straight to additive increase
+	cw.onAck()
+	if cw.size() != 2 {
+		t.Fatalf("Window grew to %d after one ack in congestion avoidance", cw.size())
+	}
+	cw.onAck()
+	if cw.size() != 3 {
+		t.Fatalf("Window is %d after a full window of acks, expected 3", cw.size())
+	}
+	for i := 0; i < 100; i++ {
+		cw.onAck()
+	}
+	if cw.size() != 8 || cw.effective.Load() != 8 {
+		t.Fatalf("Window grew to %d past WindowSize 8", cw.size())
+	}
+	cw.onTimeout(20, 30)
+	if cw.size() != 4 {
+		t.Fatalf("Window after a new loss is %d, expected 4", cw.size())
+	}
+}
+
+func TestCongestionWindowDisabled(t *testing.T) {
+	cw := newCongestionWindow(makeParams(5, 100, 6))
+	cw.onTimeout(1, 2)
+	cw.onAck()
+	if cw.size() != 6 || cw.effective.Load() != 6 {
+		t.Fatalf("Window without congestion control is %d, expected WindowSize 6", cw.size())
+	}
+}
+
+func TestCongestionControl1(t *testing.T) {
+	fmt.Printf("=== TestCongestionControl1: window opens up to WindowSize on a clean path\n")
+	ts := newSackTestSystem(t, &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 8, CongestionControl: true}, &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 8, CongestionControl: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	if window := ts.client.CongestionWindow(); window != 1 {
+		t.Fatalf("Client starts with window %d, expected 1", window)
+	}
+	payloads := make([][]byte, 40)
+	for i := range payloads {
+		payloads[i] = []byte("message " + strconv.Itoa(i))
+	}
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip(payloads, 10*time.Second)
+	if window := ts.client.CongestionWindow(); window != 8 {
+		t.Fatalf("Client window is %d after 40 clean round trips, expected 8", window)
+	}
+	if window, err := ts.server.CongestionWindow(ts.client.ConnID()); err != nil || window != 8 {
+		t.Fatalf("Server window is (%d, %v) after 40 clean round trips, expected 8", window, err)
+	}
+	if _, err := ts.server.CongestionWindow(ts.client.ConnID() + 1); err == nil {
+		t.Fatalf("Server reported a window for an unknown connection")
+	}
+}
+
+func TestCongestionControl2(t *testing.T) {
+	fmt.Printf("=== TestCongestionControl2: window shrinks when acks are lost\n")
+	defer lspnet.ResetDropPercent()
+	ts := newSackTestSystem(t, &Params{EpochLimit: 50, EpochMillis: 100, WindowSize: 8, CongestionControl: true}, &Params{EpochLimit: 50, EpochMillis: 100, WindowSize: 8, CongestionControl: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	payloads := make([][]byte, 20)
+	for i := range payloads {
+		payloads[i] = []byte("message " + strconv.Itoa(i))
+	}
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip(payloads, 10*time.Second)
+
+	lspnet.SetServerWriteDropPercent(100)
+	for _, payload := range payloads {
+		ts.client.Write(payload)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if window := ts.client.CongestionWindow(); window != 1 {
+		t.Fatalf("Client window is %d while every ack is lost, expected 1", window)
+	}
+	lspnet.ResetDropPercent()
+	for range payloads {
+		connID, data, err := ts.server.Read()
+		if err != nil {
+			t.Fatalf("Server Read returned (%d, %s, %v)", connID, data, err)
+		}
+	}
+}
+
+func TestCongestionControl3(t *testing.T) {
+	fmt.Printf("=== TestCongestionControl3: window size 10, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	ts := newSackTestSystem(t, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, CongestionControl: true}, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, CongestionControl: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	lspnet.SetWriteDropPercent(20)
+	payloads := make([][]byte, 40)
+	for i := range payloads {
+		payloads[i] = randPayload(1 + i*10)
+	}
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip(payloads, 30*time.Second)
+	if window := ts.client.CongestionWindow(); window < 1 || window > 10 {
+		t.Fatalf("Client window %d is outside [1, 10]", window)
+	}
+}
@@ -0,0 +1,180 @@
+// LSP flow control tests.
+
+// These tests check that a receiver with MaxUnreadMessages set advertises
+// how much room it has left in its acks, that a sender stops pushing data
+// into a receiver whose application isn't reading, whether the messages are
+// ordered or not, and that a slow reader still gets every message in order
+// once it catches up.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestReceiveWindow(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 10, MaxUnreadMessages: 4}
+	if window := receiveWindow(params, 1); window != 3 {
+		t.Fatalf("Window with 1 of 4 unread is %d, expected 3", window)
+	}
+	if window := receiveWindow(params, 6); window != 0 {
+		t.Fatalf("Window past the limit is %d, expected 0", window)
+	}
+	if !overLimit(params, 4) || overLimit(params, 3) {
+		t.Fatalf("Limit of 4 unread messages is not enforced at 4")
+	}
+	if window := receiveWindow(makeParams(5, 100, 10), 1000); window != unlimitedWindow {
+		t.Fatalf("Window without a limit is %d", window)
+	}
+	if overLimit(makeParams(5, 100, 10), 1000) {
+		t.Fatalf("Dropping messages without a limit")
+	}
+	if limit := sendLimit(8, 0); limit != 1 {
+		t.Fatalf("Sender may have %d messages in flight to a full receiver, expected 1", limit)
+	}
+	if limit := sendLimit(8, 3); limit != 3 {
+		t.Fatalf("Sender may have %d messages in flight, expected the receive window 3", limit)
+	}
+}
+
+func TestReceiveWindowCodec(t *testing.T) {
+	ack := NewAck(4, 9)
+	ack.Window = 17
+	sack := makeSack(4, 9, 5, []*Message{NewData(4, 12, 0, nil, 0)})
+	for _, msg := range []*Message{ack, sack} {
+		for _, codec := range []Codec{CodecJSON, CodecBinary} {
+			b, _ := encode(msg, codec)
+			var got Message
+			if err := decode(b, &got); err != nil {
+				t.Fatalf("decode(%s) with %s returned %v", msg, codec, err)
+			}
+			if got.Window != msg.Window || !integrityCheck(&got, nil) {
+				t.Fatalf("Round trip of %s with %s gave window %d", msg, codec, got.Window)
+			}
+		}
+	}
+	corrupted := *sack
+	corrupted.Window += 100
+	if integrityCheck(&corrupted, nil) {
+		t.Fatalf("SACK with a corrupted window passed the integrity check")
+	}
+}
+
+func TestFlowControlBackpressure(t *testing.T) {
+	fmt.Printf("=== TestFlowControlBackpressure: server that doesn't read holds the client back\n")
+	ts := newSackTestSystem(t, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 20, MaxUnreadMessages: 4}, makeParams(20, 100, 20))
+	defer ts.server.Close()
+	for i := 0; i < 20; i++ {
+		if err := ts.client.Write([]byte("message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	// the server can't take all 20 messages until they are read, so Close
+	// can't get all of them acked
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := ts.client.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Client CloseContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFlowControlUnordered(t *testing.T) {
+	fmt.Printf("=== TestFlowControlUnordered: server that doesn't read takes no more than 4 unordered messages\n")
+	ts := newSackTestSystem(t, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 20, MaxUnreadMessages: 4}, makeParams(20, 100, 20))
+	defer ts.server.Close()
+	defer ts.client.Close()
+	const numMsgs = 20
+	for i := 0; i < numMsgs; i++ {
+		if err := ts.client.WriteMode([]byte("message "+strconv.Itoa(i)), ReliableUnordered); err != nil {
+			t.Fatalf("Client WriteMode returned %v", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	stats, err := ts.server.Stats(ts.client.ConnID())
+	if err != nil {
+		t.Fatalf("Server Stats returned %v", err)
+	}
+	if stats.DataReceived > 4 {
+		t.Fatalf("Server took %d unread messages, expected no more than 4", stats.DataReceived)
+	}
+
+	read := make(map[string]bool)
+	for len(read) < numMsgs {
+		readChan := make(chan []byte, 1)
+		go func() {
+			_, data, _ := ts.server.Read()
+			readChan <- data
+		}()
+		select {
+		case data := <-readChan:
+			read[string(data)] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out after reading %d messages", len(read))
+		}
+	}
+	for i := 0; i < numMsgs; i++ {
+		if !read["message "+strconv.Itoa(i)] {
+			t.Fatalf("Message %d was never read", i)
+		}
+	}
+}
+
+// slowRead writes numMsgs messages from one side and reads them on the
+// other side with a pause before every Read.
+func slowRead(t *testing.T, write func([]byte) error, read func() ([]byte, error), numMsgs int) {
+	go func() {
+		for i := 0; i < numMsgs; i++ {
+			write([]byte("message " + strconv.Itoa(i)))
+		}
+	}()
+	for i := 0; i < numMsgs; i++ {
+		time.Sleep(5 * time.Millisecond)
+		readChan := make(chan []byte, 1)
+		go func() {
+			data, _ := read()
+			readChan <- data
+		}()
+		select {
+		case data := <-readChan:
+			if expected := []byte("message " + strconv.Itoa(i)); !bytes.Equal(data, expected) {
+				t.Fatalf("Read %q, expected %q", data, expected)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestFlowControlSlowServer(t *testing.T) {
+	fmt.Printf("=== TestFlowControlSlowServer: server reads slowly, 2 unread messages, 10%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	ts := newSackTestSystem(t, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, MaxUnreadMessages: 2}, makeParams(20, 100, 10))
+	defer ts.server.Close()
+	defer ts.client.Close()
+	lspnet.SetWriteDropPercent(10)
+	slowRead(t, ts.client.Write, func() ([]byte, error) {
+		_, data, err := ts.server.Read()
+		return data, err
+	}, 40)
+}
+
+func TestFlowControlSlowClient(t *testing.T) {
+	fmt.Printf("=== TestFlowControlSlowClient: client reads slowly, 1 unread message, SACK\n")
+	serverParams := &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, SelectiveAck: true}
+	clientParams := &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, SelectiveAck: true}
+	clientParams.MaxUnreadMessages = 1
+	ts := newSackTestSystem(t, serverParams, clientParams)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	slowRead(t, func(payload []byte) error {
+		return ts.server.Write(connID, payload)
+	}, ts.client.Read, 40)
+}
@@ -0,0 +1,193 @@
+// LSP connection migration tests.
+
+// These tests check that the server tells connections apart by connID and
+// the token it hands out in the connect ack rather than by address: a client
+// that shows up from a new address with its token keeps its connection,
+// while messages from a new address without the right token are dropped.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type migrationTestSystem struct {
+	t      *testing.T
+	server Server
+	client Client
+	port   int
+}
+
+func newMigrationTestSystem(t *testing.T, params *Params) *migrationTestSystem {
+	ts := &migrationTestSystem{t: t}
+	const numTries = 5
+	var err error
+	for i := 0; i < numTries && ts.server == nil; i++ {
+		ts.port = 3000 + rand.Intn(50000)
+		ts.server, err = NewServer(ts.port, params)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", ts.port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	ts.client, err = NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port)), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect to server on port %d: %s.", ts.port, err)
+	}
+	return ts
+}
+
+// dial opens a socket to the server from a new address.
+func (ts *migrationTestSystem) dial() *lspnet.UDPConn {
+	addr, err := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port)))
+	if err != nil {
+		ts.t.Fatalf("Failed to resolve server address: %s", err)
+	}
+	conn, err := lspnet.DialUDP("udp", nil, addr)
+	if err != nil {
+		ts.t.Fatalf("Failed to dial server: %s", err)
+	}
+	return conn
+}
+
+func (ts *migrationTestSystem) send(conn *lspnet.UDPConn, msg *Message) {
+	b, _ := marshal(msg)
+	conn.Write(b)
+}
+
+// expect reads from conn until a message of the given type and seqNum
+// arrives, skipping the server's reminder acks.
+func (ts *migrationTestSystem) expect(conn *lspnet.UDPConn, msgType MsgType, seqNum int) *Message {
+	msgChan := make(chan *Message)
+	go func() {
+		for {
+			b := make([]byte, maxPacketSize)
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			var msg Message
+			if decode(b[:n], &msg) == nil && msg.Type == msgType && msg.SeqNum == seqNum {
+				msgChan <- &msg
+				return
+			}
+		}
+	}()
+	select {
+	case msg := <-msgChan:
+		return msg
+	case <-time.After(2 * time.Second):
+		ts.t.Fatalf("Timed out waiting for message type %d, seqNum %d", msgType, seqNum)
+	}
+	return nil
+}
+
+// expectNoRead fails the test if the server reads anything soon.
+func (ts *migrationTestSystem) expectNoRead() {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if connID, data, err := ts.server.ReadContext(ctx); err != context.DeadlineExceeded {
+		ts.t.Fatalf("Server read (%d, %q, %v), expected nothing", connID, data, err)
+	}
+}
+
+func tokenData(connID, seqNum int, payload []byte, token uint64) *Message {
+	msg := NewData(connID, seqNum, len(payload), payload, makeCheckSum(connID, seqNum, len(payload), payload))
+	msg.Token = token
+	return msg
+}
+
+func TestTokenIssued(t *testing.T) {
+	fmt.Printf("=== TestTokenIssued: every connection gets its own token\n")
+	ts := newMigrationTestSystem(t, makeParams(5, 200, 1))
+	defer ts.server.Close()
+	defer ts.client.Close()
+	other, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port)), makeParams(5, 200, 1))
+	if err != nil {
+		t.Fatalf("Second client failed to connect: %s", err)
+	}
+	defer other.Close()
+	ts.client.ConnID() // a round trip through mainRoutine, which owns the token
+	other.ConnID()
+	token, otherToken := ts.client.(*client).token, other.(*client).token
+	if token == 0 || otherToken == 0 || token == otherToken {
+		t.Fatalf("Clients got tokens %x and %x", token, otherToken)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	fmt.Printf("=== TestMigration: client moves to a new address with its token\n")
+	ts := newMigrationTestSystem(t, makeParams(20, 200, 2))
+	defer ts.server.Close()
+	connID := ts.client.ConnID()
+	token := ts.client.(*client).token
+	// stop the real client from reminding the server of its old address
+	// without letting its close message through, the server only notices
+	// it's gone after the epoch limit
+	lspnet.SetClientWriteDropPercent(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ts.client.CloseContext(ctx)
+	lspnet.ResetDropPercent()
+
+	// the first message the client sent, now coming from a new address
+	conn := ts.dial()
+	defer conn.Close()
+	ts.send(conn, tokenData(connID, 1, []byte("moved"), token))
+	ts.expect(conn, MsgAck, 1)
+	readID, payload, err := ts.server.Read()
+	if err != nil || readID != connID || !bytes.Equal(payload, []byte("moved")) {
+		t.Fatalf("Server read (%d, %q, %v) from the new address", readID, payload, err)
+	}
+
+	// the server now writes to the new address, continuing the sequence
+	if err := ts.server.Write(connID, []byte("reply")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+	reply := ts.expect(conn, MsgData, 1)
+	if !bytes.Equal(reply.Payload, []byte("reply")) {
+		t.Fatalf("Read %q at the new address, expected %q", reply.Payload, "reply")
+	}
+	ack := NewAck(connID, 1)
+	ack.Token = token
+	ts.send(conn, ack)
+
+	ts.send(conn, tokenData(connID, 2, []byte("next"), token))
+	ts.expect(conn, MsgAck, 2)
+	if readID, payload, err := ts.server.Read(); err != nil || readID != connID || !bytes.Equal(payload, []byte("next")) {
+		t.Fatalf("Server read (%d, %q, %v) after the migration", readID, payload, err)
+	}
+}
+
+func TestMigrationBadToken(t *testing.T) {
+	fmt.Printf("=== TestMigrationBadToken: new address without the right token is dropped\n")
+	ts := newMigrationTestSystem(t, makeParams(5, 200, 2))
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	token := ts.client.(*client).token
+
+	conn := ts.dial()
+	defer conn.Close()
+	ts.send(conn, tokenData(connID, 1, []byte("no token"), 0))
+	ts.send(conn, tokenData(connID, 1, []byte("wrong token"), token+1))
+	ts.expectNoRead()
+
+	// the client itself is still connected at its old address
+	if err := ts.client.Write([]byte("still here")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if readID, payload, err := ts.server.Read(); err != nil || readID != connID || !bytes.Equal(payload, []byte("still here")) {
+		t.Fatalf("Server read (%d, %q, %v) from the client", readID, payload, err)
+	}
+}
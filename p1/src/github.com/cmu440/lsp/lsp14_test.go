@@ -0,0 +1,123 @@
+// LSP session resumption tests.
+
+// These tests check that with ResumeGraceMillis set on both sides, a
+// connection that hits the epoch limit is resumed with the same connID once
+// the network comes back within the grace period, delivering every message
+// written before and during the outage, and that it is dropped as before
+// when the grace period runs out or only one side asked for resumption.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// outage drops every packet for the given duration, writing numMsgs
+// messages from both the client and the server while it lasts.
+func outage(t *testing.T, ts *sackTestSystem, duration time.Duration, numMsgs int) {
+	connID := ts.client.ConnID()
+	lspnet.SetWriteDropPercent(100)
+	for i := 0; i < numMsgs; i++ {
+		payload := []byte("message " + strconv.Itoa(i))
+		if err := ts.client.Write(payload); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+		if err := ts.server.Write(connID, payload); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+	}
+	time.Sleep(duration)
+	lspnet.ResetDropPercent()
+}
+
+func TestResume1(t *testing.T) {
+	fmt.Printf("=== TestResume1: connection survives an outage past the epoch limit\n")
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 4, ResumeGraceMillis: 5000}
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	outage(t, ts, time.Second, 6)
+	for i := 0; i < 6; i++ {
+		expected := []byte("message " + strconv.Itoa(i))
+		readID, payload, err := ts.server.Read()
+		if err != nil || readID != connID || !bytes.Equal(payload, expected) {
+			t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, expected)
+		}
+		payload, err = ts.client.Read()
+		if err != nil || !bytes.Equal(payload, expected) {
+			t.Fatalf("Client read (%q, %v), expected (%q, nil)", payload, err, expected)
+		}
+	}
+	if ts.client.ConnID() != connID {
+		t.Fatalf("Client connID changed from %d to %d", connID, ts.client.ConnID())
+	}
+
+	// and the resumed connection keeps working
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip([][]byte{[]byte("after"), []byte("outage")}, 5*time.Second)
+}
+
+// expectLost checks that both sides give up on the connection.
+func expectLost(t *testing.T, ts *sackTestSystem, connID int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		readID, _, err := ts.server.ReadContext(ctx)
+		if err == context.DeadlineExceeded {
+			t.Fatalf("Server never reported the connection as lost")
+		}
+		if err != nil {
+			if readID != connID {
+				t.Fatalf("Server reported connection %d as lost, expected %d", readID, connID)
+			}
+			break
+		}
+	}
+	for {
+		_, err := ts.client.ReadContext(ctx)
+		if err == context.DeadlineExceeded {
+			t.Fatalf("Client never reported the connection as lost")
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+func TestResumeGraceExpired(t *testing.T) {
+	fmt.Printf("=== TestResumeGraceExpired: connection is dropped after the grace period\n")
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 4, ResumeGraceMillis: 300}
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	outage(t, ts, 1500*time.Millisecond, 2)
+	expectLost(t, ts, connID)
+	if err := ts.client.Write([]byte("too late")); err == nil {
+		t.Fatalf("Client Write succeeded on a lost connection")
+	}
+}
+
+func TestResumeNotNegotiated(t *testing.T) {
+	fmt.Printf("=== TestResumeNotNegotiated: only the client asked for resumption\n")
+	defer lspnet.ResetDropPercent()
+	ts := newSackTestSystem(t, makeParams(3, 100, 4), &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 4, ResumeGraceMillis: 5000})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	outage(t, ts, time.Second, 2)
+	expectLost(t, ts, connID)
+}
@@ -0,0 +1,177 @@
+// LSP close handshake tests.
+
+// These tests check that Client.Close, Server.CloseConn and Server.Close tell
+// the other end with a close message instead of leaving it to time out: the
+// peer reads every message sent before the close and then gets
+// ErrClosedByPeer long before the epoch limit, and writing to a closed
+// connection fails.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestCloseMessageCodec(t *testing.T) {
+	for _, msg := range []*Message{NewClose(3), NewCloseAck(3)} {
+		msg.Token = 42
+		for _, codec := range []Codec{CodecJSON, CodecBinary} {
+			b, _ := encode(msg, codec)
+			var got Message
+			if err := decode(b, &got); err != nil {
+				t.Fatalf("decode(%s) with %s returned %v", msg, codec, err)
+			}
+			if got.Type != msg.Type || got.ConnID != 3 || got.Token != 42 || !integrityCheck(&got, nil) {
+				t.Fatalf("Round trip of %s with %s gave %s", msg, codec, &got)
+			}
+		}
+	}
+	if features := makeParams(5, 100, 1).features(); features&FeatureClose == 0 {
+		t.Fatalf("Close handshake not asked for by default")
+	}
+}
+
+// expectClosedByPeer checks that read returns ErrClosedByPeer well before
+// the epoch limit of the close tests runs out.
+func expectClosedByPeer(t *testing.T, read func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := read(ctx); err != ErrClosedByPeer {
+		t.Fatalf("Read returned %v, expected %v", err, ErrClosedByPeer)
+	}
+}
+
+func TestClientCloseHandshake(t *testing.T) {
+	fmt.Printf("=== TestClientCloseHandshake: server learns about client Close at once\n")
+	params := makeParams(5, 2000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	connID := ts.client.ConnID()
+	for i := 0; i < 3; i++ {
+		if err := ts.client.Write([]byte("message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	start := time.Now()
+	if err := ts.client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Client Close took %s", elapsed)
+	}
+
+	for i := 0; i < 3; i++ {
+		readID, payload, err := ts.server.Read()
+		if expected := []byte("message " + strconv.Itoa(i)); err != nil || readID != connID || !bytes.Equal(payload, expected) {
+			t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, expected)
+		}
+	}
+	expectClosedByPeer(t, func(ctx context.Context) error {
+		readID, _, err := ts.server.ReadContext(ctx)
+		if err == ErrClosedByPeer && readID != connID {
+			t.Fatalf("Server reported connection %d as closed, expected %d", readID, connID)
+		}
+		return err
+	})
+	if err := ts.server.Write(connID, []byte("too late")); err == nil {
+		t.Fatalf("Server Write to a closed client succeeded")
+	}
+}
+
+func TestServerCloseConnHandshake(t *testing.T) {
+	fmt.Printf("=== TestServerCloseConnHandshake: client learns about CloseConn at once\n")
+	params := &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, SelectiveAck: true}
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	for i := 0; i < 3; i++ {
+		if err := ts.server.Write(connID, []byte("message "+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+	}
+	if err := ts.server.CloseConn(connID); err != nil {
+		t.Fatalf("Server CloseConn returned %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		payload, err := ts.client.Read()
+		if expected := []byte("message " + strconv.Itoa(i)); err != nil || !bytes.Equal(payload, expected) {
+			t.Fatalf("Client read (%q, %v), expected (%q, nil)", payload, err, expected)
+		}
+	}
+	expectClosedByPeer(t, func(ctx context.Context) error {
+		_, err := ts.client.ReadContext(ctx)
+		return err
+	})
+	expectClosedByPeer(t, func(ctx context.Context) error {
+		_, err := ts.client.ReadContext(ctx) // and it keeps failing
+		return err
+	})
+	if err := ts.client.Write([]byte("too late")); err == nil {
+		t.Fatalf("Client Write to a closed server succeeded")
+	}
+}
+
+func TestServerCloseHandshake(t *testing.T) {
+	fmt.Printf("=== TestServerCloseHandshake: server Close returns once every client acked the close\n")
+	params := makeParams(5, 2000, 4)
+	ts := newMigrationTestSystem(t, params)
+	other, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port)), params)
+	if err != nil {
+		t.Fatalf("Second client failed to connect: %s", err)
+	}
+	clients := []Client{ts.client, other}
+	for _, cli := range clients {
+		defer cli.Close()
+		if err := ts.server.Write(cli.ConnID(), []byte("bye")); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+	}
+	start := time.Now()
+	if err := ts.server.Close(); err != nil {
+		t.Fatalf("Server Close returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Server Close took %s", elapsed)
+	}
+	for _, cli := range clients {
+		if payload, err := cli.Read(); err != nil || !bytes.Equal(payload, []byte("bye")) {
+			t.Fatalf("Client read (%q, %v), expected (%q, nil)", payload, err, "bye")
+		}
+		expectClosedByPeer(t, func(ctx context.Context) error {
+			_, err := cli.ReadContext(ctx)
+			return err
+		})
+	}
+}
+
+func TestCloseHandshakeDrops(t *testing.T) {
+	fmt.Printf("=== TestCloseHandshakeDrops: close messages and acks are resent, 30%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(20, 100, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	connID := ts.client.ConnID()
+	lspnet.SetWriteDropPercent(30)
+	if err := ts.client.Write([]byte("last")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if err := ts.client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if readID, payload, err := ts.server.Read(); err != nil || readID != connID || !bytes.Equal(payload, []byte("last")) {
+		t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, "last")
+	}
+	expectClosedByPeer(t, func(ctx context.Context) error {
+		_, _, err := ts.server.ReadContext(ctx)
+		return err
+	})
+}
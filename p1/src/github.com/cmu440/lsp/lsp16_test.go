@@ -0,0 +1,356 @@
+// LSP stream tests.
+
+// These tests check that streams opened with OpenStream and accepted with
+// AcceptStream each deliver their messages in the order they were written,
+// independently of the connection's own Read and Write and of each other, so
+// a long transfer on one stream doesn't hold back a message on another, that
+// a connection has no more than MaxStreams streams and a server takes no
+// stream IDs a client couldn't have opened, that a stream nobody reads
+// counts against MaxUnreadMessages, and that every stream fails once its
+// connection is closed.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestSendQueueRoundRobin(t *testing.T) {
+	var q sendQueue
+	for _, id := range []int{1, 1, 1, 2, 0} {
+		q.push(newQueuedData(&Message{Stream: id}))
+	}
+	expected := []int{1, 2, 0, 1, 1}
+	for i, id := range expected {
+		if q.len() != len(expected)-i {
+			t.Fatalf("Queue holds %d messages, expected %d", q.len(), len(expected)-i)
+		}
+		if got := q.pop().data.Stream; got != id {
+			t.Fatalf("Message %d popped from stream %d, expected %d", i, got, id)
+		}
+	}
+}
+
+func TestStreamReceiveReorders(t *testing.T) {
+	quitChan := make(chan int)
+	defer close(quitChan)
+	st := newStreamState(1, quitChan, DefaultMaxMessageSize, nil)
+	fragment := func(streamSeq, index, count int, payload string) *Message {
+		msg := NewData(1, 10+streamSeq, len(payload), []byte(payload), 0)
+		msg.Stream, msg.StreamSeq = 1, streamSeq
+		msg.FragIndex, msg.FragCount = index, count
+		return msg
+	}
+	go func() {
+		st.receive(fragment(4, 0, 1, "third"))
+		st.receive(fragment(2, 0, 2, "sec"))
+		st.receive(fragment(1, 0, 1, "first"))
+		st.receive(fragment(3, 1, 2, "ond"))
+		st.end(ErrClosedByPeer)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, expected := range []string{"first", "second", "third"} {
+		payload, err := st.stream.ReadContext(ctx)
+		if err != nil || string(payload) != expected {
+			t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, expected)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := st.stream.ReadContext(ctx); err != ErrClosedByPeer {
+			t.Fatalf("Stream read returned %v, expected %v", err, ErrClosedByPeer)
+		}
+	}
+	select {
+	case <-st.stream.endedChan: //streamRoutine is gone
+	default:
+		t.Fatalf("Stream didn't end once only the error was left")
+	}
+}
+
+func TestStreamMessageCodec(t *testing.T) {
+	msg := NewData(3, 7, 5, []byte("hello"), 0)
+	msg.Stream, msg.StreamSeq = 2, 4
+	msg.Checksum = makeCheckSum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload,
+		msg.FragIndex, msg.FragCount, msg.Stream, msg.StreamSeq)
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		b, _ := encode(msg, codec)
+		var got Message
+		if err := decode(b, &got); err != nil {
+			t.Fatalf("decode(%s) with %s returned %v", msg, codec, err)
+		}
+		if got.Stream != 2 || got.StreamSeq != 4 || !integrityCheck(&got, nil) {
+			t.Fatalf("Round trip of %s with %s gave %s", msg, codec, &got)
+		}
+		got.StreamSeq = 5
+		if integrityCheck(&got, nil) {
+			t.Fatalf("Corrupted StreamSeq passed the integrity check with %s", codec)
+		}
+	}
+	if features := makeParams(5, 100, 1).features(); features&FeatureStreams == 0 {
+		t.Fatalf("Streams not asked for by default")
+	}
+}
+
+// acceptStreams opens n streams on the client, writing a first message on
+// each so the server learns about it, and returns both ends of each stream.
+func acceptStreams(t *testing.T, ts *sackTestSystem, n int) ([]Stream, []Stream) {
+	connID := ts.client.ConnID()
+	clientStreams := make([]Stream, n)
+	serverStreams := make([]Stream, n)
+	for i := range clientStreams {
+		st, err := ts.client.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream returned %v", err)
+		}
+		if err := st.Write([]byte("hello")); err != nil {
+			t.Fatalf("Stream Write returned %v", err)
+		}
+		clientStreams[i] = st
+	}
+	for i := range serverStreams {
+		st, err := ts.server.AcceptStream(connID)
+		if err != nil {
+			t.Fatalf("AcceptStream returned %v", err)
+		}
+		if payload, err := st.Read(); err != nil || !bytes.Equal(payload, []byte("hello")) {
+			t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, "hello")
+		}
+		serverStreams[i] = st
+	}
+	for i, st := range serverStreams {
+		if st.ID() != clientStreams[i].ID() || st.ID() == 0 {
+			t.Fatalf("Stream %d accepted as stream %d", clientStreams[i].ID(), st.ID())
+		}
+	}
+	return clientStreams, serverStreams
+}
+
+func TestStreamsEcho(t *testing.T) {
+	fmt.Printf("=== TestStreamsEcho: two streams and the connection echo independently\n")
+	params := makeParams(5, 2000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	clientStreams, serverStreams := acceptStreams(t, ts, 2)
+
+	for i := 0; i < 5; i++ {
+		for j, st := range clientStreams {
+			if err := st.Write([]byte(fmt.Sprintf("stream %d message %d", j, i))); err != nil {
+				t.Fatalf("Stream Write returned %v", err)
+			}
+		}
+		if err := ts.client.Write([]byte("connection message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	for j, st := range serverStreams {
+		for i := 0; i < 5; i++ {
+			payload, err := st.Read()
+			if expected := []byte(fmt.Sprintf("stream %d message %d", j, i)); err != nil || !bytes.Equal(payload, expected) {
+				t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, expected)
+			}
+			if err := st.Write(payload); err != nil {
+				t.Fatalf("Stream Write returned %v", err)
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		readID, payload, err := ts.server.Read()
+		if expected := []byte("connection message " + strconv.Itoa(i)); err != nil || readID != connID || !bytes.Equal(payload, expected) {
+			t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, expected)
+		}
+	}
+	for j, st := range clientStreams {
+		for i := 0; i < 5; i++ {
+			payload, err := st.Read()
+			if expected := []byte(fmt.Sprintf("stream %d message %d", j, i)); err != nil || !bytes.Equal(payload, expected) {
+				t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, expected)
+			}
+		}
+	}
+}
+
+func TestStreamsHeadOfLine(t *testing.T) {
+	fmt.Printf("=== TestStreamsHeadOfLine: a long transfer doesn't hold back another stream\n")
+	params := makeParams(5, 2000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	clientStreams, serverStreams := acceptStreams(t, ts, 2)
+
+	bulk := bytes.Repeat([]byte("x"), 4*DefaultMaxFragmentSize)
+	for i := 0; i < 50; i++ {
+		if err := clientStreams[0].Write(bulk); err != nil {
+			t.Fatalf("Stream Write returned %v", err)
+		}
+	}
+	if err := clientStreams[1].Write([]byte("urgent")); err != nil {
+		t.Fatalf("Stream Write returned %v", err)
+	}
+	// stream 0 isn't read at all until the urgent message is in
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if payload, err := serverStreams[1].ReadContext(ctx); err != nil || !bytes.Equal(payload, []byte("urgent")) {
+		t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, "urgent")
+	}
+	for i := 0; i < 50; i++ {
+		if payload, err := serverStreams[0].Read(); err != nil || !bytes.Equal(payload, bulk) {
+			t.Fatalf("Stream read message %d of %d bytes with error %v", i, len(payload), err)
+		}
+	}
+}
+
+func TestStreamsDrops(t *testing.T) {
+	fmt.Printf("=== TestStreamsDrops: every stream stays in order, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(20, 100, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	clientStreams, serverStreams := acceptStreams(t, ts, 3)
+
+	lspnet.SetWriteDropPercent(20)
+	for i := 0; i < 20; i++ {
+		for j, st := range clientStreams {
+			if err := st.Write([]byte(fmt.Sprintf("stream %d message %d", j, i))); err != nil {
+				t.Fatalf("Stream Write returned %v", err)
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for j := len(serverStreams) - 1; j >= 0; j-- {
+		for i := 0; i < 20; i++ {
+			payload, err := serverStreams[j].ReadContext(ctx)
+			if expected := []byte(fmt.Sprintf("stream %d message %d", j, i)); err != nil || !bytes.Equal(payload, expected) {
+				t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, expected)
+			}
+		}
+	}
+}
+
+func TestStreamsClosedByPeer(t *testing.T) {
+	fmt.Printf("=== TestStreamsClosedByPeer: streams fail once the client closes\n")
+	params := makeParams(5, 2000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	clientStreams, serverStreams := acceptStreams(t, ts, 2)
+
+	if err := clientStreams[1].Write([]byte("last")); err != nil {
+		t.Fatalf("Stream Write returned %v", err)
+	}
+	if err := ts.client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if payload, err := serverStreams[1].Read(); err != nil || !bytes.Equal(payload, []byte("last")) {
+		t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, "last")
+	}
+	for _, st := range serverStreams {
+		expectClosedByPeer(t, func(ctx context.Context) error {
+			_, err := st.ReadContext(ctx)
+			return err
+		})
+	}
+	if err := clientStreams[0].Write([]byte("too late")); err == nil {
+		t.Fatalf("Stream Write on a closed client succeeded")
+	}
+	if _, err := ts.client.OpenStream(); err == nil {
+		t.Fatalf("OpenStream on a closed client succeeded")
+	}
+}
+
+func TestStreamsLimit(t *testing.T) {
+	fmt.Printf("=== TestStreamsLimit: streams past MaxStreams are refused\n")
+	serverParams := makeParams(5, 2000, 4)
+	serverParams.MaxStreams = 2
+	clientParams := makeParams(5, 2000, 4)
+	clientParams.MaxStreams = 3
+	ts := newSackTestSystem(t, serverParams, clientParams)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	clientStreams, serverStreams := acceptStreams(t, ts, 2)
+
+	extra, err := ts.client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream returned %v", err)
+	}
+	if _, err := ts.client.OpenStream(); err == nil {
+		t.Fatalf("OpenStream succeeded past MaxStreams")
+	}
+	extra.Write([]byte("dropped"))
+	clientStreams[1].Write([]byte("delivered"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if payload, err := serverStreams[1].ReadContext(ctx); err != nil || !bytes.Equal(payload, []byte("delivered")) {
+		t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, "delivered")
+	}
+	acceptChan := make(chan Stream, 1)
+	go func() {
+		st, _ := ts.server.AcceptStream(ts.client.ConnID())
+		acceptChan <- st
+	}()
+	select {
+	case st := <-acceptChan:
+		if st != nil {
+			t.Fatalf("Server accepted stream %d past MaxStreams", st.ID())
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestStreamIDs(t *testing.T) {
+	s := &server{params: makeParams(5, 2000, 4)}
+	s.params.MaxStreams = 2
+	sClient := &s_client{
+		connID:         1,
+		features:       FeatureStreams,
+		streams:        make(map[int]*streamState),
+		clientDoneChan: make(chan int),
+	}
+	defer close(sClient.clientDoneChan)
+	for _, id := range []int{-1, 0, 3, 2} {
+		msg := NewData(1, 1, 2, []byte("hi"), 0)
+		msg.Stream, msg.StreamSeq = id, 1
+		sClient.receiveStream(msg, s)
+	}
+	if len(sClient.streams) != 1 || sClient.streams[2] == nil || len(sClient.accepted) != 1 {
+		t.Fatalf("Server opened %d streams, expected stream 2 only", len(sClient.streams))
+	}
+}
+
+func TestStreamsUnreadLimit(t *testing.T) {
+	fmt.Printf("=== TestStreamsUnreadLimit: a stream nobody reads holds no more than MaxUnreadMessages\n")
+	serverParams := makeParams(20, 100, 4)
+	serverParams.MaxUnreadMessages = 2
+	ts := newSackTestSystem(t, serverParams, makeParams(20, 100, 4))
+	defer ts.server.Close()
+	defer ts.client.Close()
+	clientStreams, serverStreams := acceptStreams(t, ts, 1)
+
+	for i := 0; i < 20; i++ {
+		if err := clientStreams[0].Write([]byte("message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Stream Write returned %v", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	if queued := serverStreams[0].(*stream).queued.Load(); queued > 2 {
+		t.Fatalf("Stream holds %d unread messages, expected no more than 2", queued)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		payload, err := serverStreams[0].ReadContext(ctx)
+		if expected := []byte("message " + strconv.Itoa(i)); err != nil || !bytes.Equal(payload, expected) {
+			t.Fatalf("Stream read (%q, %v), expected (%q, nil)", payload, err, expected)
+		}
+	}
+}
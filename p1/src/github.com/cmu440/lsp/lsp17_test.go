@@ -0,0 +1,206 @@
+// LSP delivery mode tests.
+
+// These tests check that messages written with WriteMode coexist with the
+// connection's reliable ordered messages: reliable unordered messages are
+// read as soon as they arrive without waiting for a gap to be filled, and
+// unreliable messages are never resent and only the freshest of them wait
+// for a slow reader.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestDeliveryModeCodec(t *testing.T) {
+	msg := newFragment(3, 7, []byte("hello"), 0, 1)
+	msg.Mode = ReliableUnordered
+	msg.Checksum = makeCheckSum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload, 0, 0, 0, 0, int(msg.Mode))
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		b, _ := encode(msg, codec)
+		var got Message
+		if err := decode(b, &got); err != nil {
+			t.Fatalf("decode(%s) with %s returned %v", msg, codec, err)
+		}
+		if got.Mode != ReliableUnordered || !integrityCheck(&got, nil) {
+			t.Fatalf("Round trip of %s with %s gave %s", msg, codec, &got)
+		}
+		got.Mode = Unreliable
+		if integrityCheck(&got, nil) {
+			t.Fatalf("Corrupted Mode passed the integrity check with %s", codec)
+		}
+
+		var datagram Message
+		if err := decode(newDatagram(3, 42, []byte("hello"), codec, nil), &datagram); err != nil {
+			t.Fatalf("decode of a datagram with %s returned %v", codec, err)
+		}
+		if datagram.Mode != Unreliable || datagram.SeqNum != 0 || datagram.Token != 42 || !integrityCheck(&datagram, nil) {
+			t.Fatalf("Datagram with %s decoded as %s", codec, &datagram)
+		}
+	}
+
+	params := makeParams(5, 100, 1)
+	if features := params.features(); features&FeatureModes == 0 {
+		t.Fatalf("Delivery modes not asked for by default")
+	}
+	large := make([]byte, params.maxFragmentSize()+1)
+	if err := checkMode(params, ReliableOrdered, large); err != nil {
+		t.Fatalf("checkMode rejected a large reliable ordered payload: %v", err)
+	}
+	if err := checkMode(params, Unreliable, large); err == nil {
+		t.Fatalf("checkMode accepted an unreliable payload larger than a fragment")
+	}
+	if err := checkMode(params, DeliveryMode(7), nil); err == nil {
+		t.Fatalf("checkMode accepted an unknown delivery mode")
+	}
+}
+
+func TestUnorderedQueue(t *testing.T) {
+	var q unorderedQueue
+	for i := 0; i < maxQueuedDatagrams+10; i++ {
+		datagram := newFragment(1, 0, []byte("datagram "+strconv.Itoa(i)), 0, 1)
+		datagram.Mode = Unreliable
+		q.push(datagram)
+	}
+	reliable := newFragment(1, 5, []byte("reliable"), 0, 1)
+	reliable.Mode = ReliableUnordered
+	q.push(reliable)
+	if q.len() != maxQueuedDatagrams+1 {
+		t.Fatalf("Queue holds %d messages, expected %d", q.len(), maxQueuedDatagrams+1)
+	}
+	if next := q.next(); !bytes.Equal(next.payload, []byte("reliable")) {
+		t.Fatalf("Queue returned %q first, expected the reliable message", next.payload)
+	}
+	q.pop()
+	if next := q.next(); !bytes.Equal(next.payload, []byte("datagram 10")) {
+		t.Fatalf("Queue returned %q, expected the oldest datagram not dropped", next.payload)
+	}
+}
+
+func TestReliableUnordered(t *testing.T) {
+	fmt.Printf("=== TestReliableUnordered: an unordered message overtakes a lost ordered one\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(5, 1000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	lspnet.SetClientWriteDropPercent(100)
+	if err := ts.client.Write([]byte("ordered")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	time.Sleep(100 * time.Millisecond) //the first copy is gone, the next one waits for the RTO
+	lspnet.ResetDropPercent()
+	if err := ts.client.WriteMode([]byte("unordered"), ReliableUnordered); err != nil {
+		t.Fatalf("Client WriteMode returned %v", err)
+	}
+	for _, expected := range []string{"unordered", "ordered"} {
+		readID, payload, err := ts.server.Read()
+		if err != nil || readID != connID || string(payload) != expected {
+			t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, expected)
+		}
+	}
+}
+
+func TestReliableUnorderedDrops(t *testing.T) {
+	fmt.Printf("=== TestReliableUnorderedDrops: every message arrives once in every mode, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(20, 100, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	lspnet.SetWriteDropPercent(20)
+	for i := 0; i < 20; i++ {
+		if err := ts.server.Write(connID, []byte("ordered "+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+		if err := ts.server.WriteMode(connID, []byte("unordered "+strconv.Itoa(i)), ReliableUnordered); err != nil {
+			t.Fatalf("Server WriteMode returned %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	nextOrdered := 0
+	unordered := make(map[string]bool)
+	for nextOrdered < 20 || len(unordered) < 20 {
+		payload, err := ts.client.ReadContext(ctx)
+		if err != nil {
+			t.Fatalf("Client Read returned %v with %d ordered and %d unordered messages read", err, nextOrdered, len(unordered))
+		}
+		if bytes.HasPrefix(payload, []byte("ordered ")) {
+			if expected := "ordered " + strconv.Itoa(nextOrdered); string(payload) != expected {
+				t.Fatalf("Client read %q, expected %q", payload, expected)
+			}
+			nextOrdered++
+		} else if unordered[string(payload)] {
+			t.Fatalf("Client read %q twice", payload)
+		} else {
+			unordered[string(payload)] = true
+		}
+	}
+}
+
+func TestUnreliable(t *testing.T) {
+	fmt.Printf("=== TestUnreliable: datagrams are never resent and a slow reader gets the freshest\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(5, 100, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	lspnet.SetServerWriteDropPercent(100)
+	if err := ts.server.WriteMode(connID, []byte("lost"), Unreliable); err != nil {
+		t.Fatalf("Server WriteMode returned %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lspnet.ResetDropPercent()
+	if err := ts.server.Write(connID, []byte("reliable")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+	if payload, err := ts.client.Read(); err != nil || !bytes.Equal(payload, []byte("reliable")) {
+		t.Fatalf("Client read (%q, %v), expected (%q, nil)", payload, err, "reliable")
+	}
+
+	// nobody reads while far more datagrams arrive than wait for Read
+	numMsgs := 3 * maxQueuedDatagrams
+	for i := 0; i < numMsgs; i++ {
+		if err := ts.server.WriteMode(connID, []byte("update "+strconv.Itoa(i)), Unreliable); err != nil {
+			t.Fatalf("Server WriteMode returned %v", err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var last []byte
+	read := 0
+	for {
+		payload, err := ts.client.ReadContext(ctx)
+		if err == context.DeadlineExceeded {
+			break
+		} else if err != nil {
+			t.Fatalf("Client Read returned %v", err)
+		}
+		if bytes.Equal(payload, []byte("lost")) {
+			t.Fatalf("Client read a datagram that was dropped")
+		}
+		last = payload
+		read++
+	}
+	if read == 0 || read > maxQueuedDatagrams {
+		t.Fatalf("Client read %d datagrams, expected between 1 and %d", read, maxQueuedDatagrams)
+	}
+	if expected := []byte("update " + strconv.Itoa(numMsgs-1)); !bytes.Equal(last, expected) {
+		t.Fatalf("Client read %q last, expected %q", last, expected)
+	}
+}
@@ -0,0 +1,213 @@
+// LSP secure mode tests.
+
+// These tests check that with a pre-shared key on both sides, only a peer
+// holding the key can connect, every message is sealed so tampered, spoofed
+// and replayed packets are dropped before the server reads them, and the
+// connection otherwise works as before.
+
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// startSecureServer starts a server on a random port.
+func startSecureServer(t *testing.T, params *Params) (Server, int) {
+	for i := 0; i < 5; i++ {
+		port := 3000 + rand.Intn(50000)
+		if server, err := NewServer(port, params); err == nil {
+			return server, port
+		}
+	}
+	t.Fatalf("Failed to start server.")
+	return nil, 0
+}
+
+func TestSecureSealOpen(t *testing.T) {
+	clientNonce, serverNonce := newNonce(), newNonce()
+	client := newSecureSession(testKey, clientNonce, serverNonce, 7, true)
+	server := newSecureSession(testKey, clientNonce, serverNonce, 7, false)
+	plain := []byte(`{"Type":1,"ConnID":7,"SeqNum":1}`)
+
+	packet := client.seal(plain)
+	if bytes.Contains(packet, plain) {
+		t.Fatalf("Sealed packet contains the message in the clear")
+	}
+	if b, ok := server.open(packet); !ok || !bytes.Equal(b, plain) {
+		t.Fatalf("Server opened (%q, %t), expected (%q, true)", b, ok, plain)
+	}
+	if _, ok := server.open(packet); ok {
+		t.Fatalf("Replayed packet was opened")
+	}
+	if _, ok := client.open(client.seal(plain)); ok {
+		t.Fatalf("Client opened a packet it sealed itself")
+	}
+
+	// every byte of the header and the ciphertext is covered
+	packet = client.seal(plain)
+	for i := range packet {
+		tampered := append([]byte(nil), packet...)
+		tampered[i] ^= 0x01
+		if _, ok := server.open(tampered); ok {
+			t.Fatalf("Packet tampered at byte %d was opened", i)
+		}
+	}
+	if _, ok := server.open(packet); !ok {
+		t.Fatalf("Untampered packet wasn't opened after the tampered copies")
+	}
+
+	// packets may arrive out of order within the replay window
+	packets := make([][]byte, replayWindow+2)
+	for i := range packets {
+		packets[i] = client.seal(plain)
+	}
+	for i := len(packets) - 1; i >= 2; i-- {
+		if _, ok := server.open(packets[i]); !ok {
+			t.Fatalf("Packet %d within the replay window wasn't opened", i)
+		}
+	}
+	if _, ok := server.open(packets[0]); ok {
+		t.Fatalf("Packet behind the replay window was opened")
+	}
+
+	other := newSecureSession([]byte("another key that is long enough"), clientNonce, serverNonce, 7, false)
+	if _, ok := other.open(client.seal(plain)); ok {
+		t.Fatalf("Packet opened with the wrong key")
+	}
+}
+
+func TestSecureHandshakeMAC(t *testing.T) {
+	connect := NewConnect()
+	connect.Nonce = newNonce()
+	connect.Features = FeatureSecure
+	mac := connectMAC(testKey, connect)
+	connect.Features |= FeatureSack
+	if bytes.Equal(mac, connectMAC(testKey, connect)) {
+		t.Fatalf("Connect MAC doesn't cover the features")
+	}
+
+	ack := NewAck(3, 0)
+	ack.Nonce = newNonce()
+	ack.Token = 42
+	mac = ackMAC(testKey, connect.Nonce, ack)
+	for _, change := range []func(*Message){
+		func(m *Message) { m.ConnID = 4 },
+		func(m *Message) { m.Token = 43 },
+		func(m *Message) { m.Codec = CodecBinary },
+		func(m *Message) { m.Nonce = newNonce() },
+	} {
+		changed := *ack
+		change(&changed)
+		if bytes.Equal(mac, ackMAC(testKey, connect.Nonce, &changed)) {
+			t.Fatalf("Ack MAC doesn't cover %s", &changed)
+		}
+	}
+
+	params := makeParams(5, 100, 1)
+	if _, err := params.preSharedKey(); err != nil {
+		t.Fatalf("preSharedKey without a key returned %v", err)
+	}
+	params.PreSharedKey = []byte("short")
+	if _, err := params.preSharedKey(); err == nil {
+		t.Fatalf("preSharedKey accepted a short key")
+	}
+}
+
+func TestSecureEcho(t *testing.T) {
+	fmt.Printf("=== TestSecureEcho: sealed connection echoes messages, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 4, PreSharedKey: testKey}
+	params.Codec = CodecBinary
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	if ts.client.(*client).session.Load() == nil {
+		t.Fatalf("Client connected without session keys")
+	}
+
+	lspnet.SetWriteDropPercent(20)
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	payloads := [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 3*DefaultMaxFragmentSize)}
+	for i := 0; i < 10; i++ {
+		payloads = append(payloads, []byte("message "+strconv.Itoa(i)))
+	}
+	fts.roundTrip(payloads, 20*time.Second)
+}
+
+func TestSecureRejectsSpoofedData(t *testing.T) {
+	fmt.Printf("=== TestSecureRejectsSpoofedData: forged and unsealed data never reaches Read\n")
+	params := &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, PreSharedKey: testKey}
+	ts := newMigrationTestSystem(t, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	token := ts.client.(*client).token // sent in the clear in the connect ack
+
+	spoofer := ts.dial()
+	defer spoofer.Close()
+	ts.send(spoofer, tokenData(connID, 1, []byte("spoofed"), token))
+	forged := append([]byte{sealedMagic}, make([]byte, sealedHeaderSize+40)...)
+	forged[4] = byte(connID)
+	forged[12] = 1
+	spoofer.Write(forged)
+	ts.expectNoRead()
+
+	if err := ts.client.Write([]byte("genuine")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if readID, payload, err := ts.server.Read(); err != nil || readID != connID || !bytes.Equal(payload, []byte("genuine")) {
+		t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, "genuine")
+	}
+}
+
+func TestSecureKeyMismatch(t *testing.T) {
+	fmt.Printf("=== TestSecureKeyMismatch: peers without the same key never connect\n")
+	cases := []struct {
+		name                 string
+		serverKey, clientKey []byte
+	}{
+		{"different keys", testKey, []byte("fedcba9876543210fedcba9876543210")},
+		{"insecure client", testKey, nil},
+		{"insecure server", nil, testKey},
+	}
+	for _, c := range cases {
+		server, port := startSecureServer(t, &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 1, PreSharedKey: c.serverKey})
+		cli, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 1, PreSharedKey: c.clientKey})
+		if err == nil {
+			cli.Close()
+			t.Fatalf("%s: client connected", c.name)
+		}
+		server.Close()
+	}
+}
+
+func TestSecureKeyFile(t *testing.T) {
+	fmt.Printf("=== TestSecureKeyFile: a key file works like the same pre-shared key\n")
+	keyFile := filepath.Join(t.TempDir(), "lsp.key")
+	if err := os.WriteFile(keyFile, append(testKey, '\n'), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %s", err)
+	}
+	clientParams := makeParams(5, 2000, 4)
+	clientParams.KeyFile = keyFile
+	ts := newSackTestSystem(t, &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, PreSharedKey: testKey}, clientParams)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip([][]byte{[]byte("keyed"), []byte("from a file")}, 5*time.Second)
+
+	clientParams.KeyFile = filepath.Join(t.TempDir(), "missing.key")
+	if _, err := NewClient("127.0.0.1:1", clientParams); err == nil {
+		t.Fatalf("NewClient succeeded with a missing key file")
+	}
+}
@@ -0,0 +1,174 @@
+// LSP connect cookie and connection limit tests.
+
+// These tests check that a server with ConnectCookies on sets nothing up for
+// a connect message until it comes back with a cookie made for its address,
+// so a flood of connect messages without one costs the server no clients,
+// that clients echo cookies on their own, in secure mode too, and that a
+// server keeps no more than MaxConnections clients at once.
+
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// expectNoConnectAck fails the test if the server acks a connect message on
+// conn soon.
+func expectNoConnectAck(t *testing.T, conn *lspnet.UDPConn) {
+	ackChan := make(chan *Message, 1)
+	go func() {
+		for {
+			b := make([]byte, maxPacketSize)
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			var msg Message
+			if decode(b[:n], &msg) == nil && msg.Type == MsgAck && msg.SeqNum == 0 {
+				ackChan <- &msg
+				return
+			}
+		}
+	}()
+	select {
+	case msg := <-ackChan:
+		t.Fatalf("Server acked a connect message with connection %d", msg.ConnID)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestConnectCookie(t *testing.T) {
+	s := &server{params: makeParams(5, 100, 1), cookieSecret: newCookieSecret()}
+	resolved, _ := lspnet.ResolveUDPAddr("udp", "127.0.0.1:4000")
+	addr := udpAddr{resolved}
+	resolved, _ = lspnet.ResolveUDPAddr("udp", "127.0.0.1:4001")
+	other := udpAddr{resolved}
+	now := time.Now()
+	cookie := s.makeCookie(addr, now)
+
+	if !s.validCookie(cookie, addr, now.Add(400*time.Millisecond)) {
+		t.Fatalf("Cookie rejected at the address it was made for")
+	}
+	if s.validCookie(cookie, other, now) {
+		t.Fatalf("Cookie accepted from another address")
+	}
+	if s.validCookie(cookie, addr, now.Add(time.Second)) {
+		t.Fatalf("Cookie accepted after the client would have given up")
+	}
+	if s.validCookie(cookie, addr, now.Add(-time.Second)) {
+		t.Fatalf("Cookie accepted before it was made")
+	}
+	for i := range cookie {
+		tampered := append([]byte(nil), cookie...)
+		tampered[i] ^= 0x01
+		if s.validCookie(tampered, addr, now) {
+			t.Fatalf("Cookie tampered at byte %d accepted", i)
+		}
+	}
+	if s.validCookie(cookie[:cookieSize-1], addr, now) || s.validCookie(nil, addr, now) {
+		t.Fatalf("Short cookie accepted")
+	}
+	restarted := &server{params: s.params, cookieSecret: newCookieSecret()}
+	if restarted.validCookie(cookie, addr, now) {
+		t.Fatalf("Cookie accepted by a server with another secret")
+	}
+}
+
+func TestCookieEcho(t *testing.T) {
+	fmt.Printf("=== TestCookieEcho: clients echo the cookie and connect, with and without secure mode\n")
+	for _, params := range []*Params{&Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, ConnectCookies: true}, &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, PreSharedKey: testKey}} {
+		params.ConnectCookies = true
+		ts := newSackTestSystem(t, params, params)
+		fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+		fts.roundTrip([][]byte{[]byte("hello"), []byte("cookie")}, 5*time.Second)
+		ts.client.Close()
+		ts.server.Close()
+	}
+}
+
+func TestCookieFlood(t *testing.T) {
+	fmt.Printf("=== TestCookieFlood: connect messages without a valid cookie set up no clients\n")
+	ts := newMigrationTestSystem(t, &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, ConnectCookies: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	if connID := ts.client.ConnID(); connID != 1 {
+		t.Fatalf("First client got connection %d, expected 1", connID)
+	}
+
+	flooder := ts.dial()
+	defer flooder.Close()
+	for i := 0; i < 200; i++ {
+		connect := NewConnect()
+		if i%2 == 1 {
+			connect.Cookie = bytes.Repeat([]byte{byte(i)}, cookieSize) //forged
+		}
+		ts.send(flooder, connect)
+	}
+	cookie := ts.expect(flooder, MsgCookie, 0).Cookie
+	expectNoConnectAck(t, flooder)
+
+	// a cookie read off the wire is no good from another address
+	thief := ts.dial()
+	defer thief.Close()
+	connect := NewConnect()
+	connect.Cookie = cookie
+	ts.send(thief, connect)
+	expectNoConnectAck(t, thief)
+
+	// none of it used up a connection ID
+	cli, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port)), makeParams(5, 2000, 4))
+	if err != nil {
+		t.Fatalf("Client failed to connect after the flood: %s", err)
+	}
+	defer cli.Close()
+	if connID := cli.ConnID(); connID != 2 {
+		t.Fatalf("Client after the flood got connection %d, expected 2", connID)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	fmt.Printf("=== TestMaxConnections: clients past the limit wait for a connection to go away\n")
+	serverParams := makeParams(5, 200, 4)
+	serverParams.MaxConnections = 2
+	server, port := startSecureServer(t, serverParams)
+	defer server.Close()
+	hostport := lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	clients := make([]Client, 2)
+	for i := range clients {
+		cli, err := NewClient(hostport, makeParams(5, 200, 4))
+		if err != nil {
+			t.Fatalf("Client %d failed to connect: %s", i, err)
+		}
+		clients[i] = cli
+	}
+	defer clients[1].Close()
+	if cli, err := NewClient(hostport, makeParams(3, 100, 4)); err == nil {
+		cli.Close()
+		t.Fatalf("Client past the limit connected")
+	}
+
+	if err := clients[0].Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if _, _, err := server.Read(); err == nil {
+		t.Fatalf("Server Read returned no error for the closed client")
+	}
+	cli, err := NewClient(hostport, makeParams(5, 200, 4))
+	if err != nil {
+		t.Fatalf("Client failed to connect once a connection went away: %s", err)
+	}
+	defer cli.Close()
+	if err := cli.Write([]byte("made it")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if readID, payload, err := server.Read(); err != nil || readID != cli.ConnID() || string(payload) != "made it" {
+		t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, cli.ConnID(), "made it")
+	}
+}
@@ -0,0 +1,163 @@
+// LSP integrity tests.
+
+// These tests check that the integrity algorithms negotiated through
+// Params.Integrity catch corruptions the 16-bit checksum misses, such as
+// reordered words and errors that cancel each other out, that a connection
+// settles on the strongest algorithm both ends allow, and that a connection
+// using one works as before while dropping messages that only pass the
+// checksum.
+
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func signedData(ig *integrity, payload []byte) *Message {
+	msg := NewData(3, 7, len(payload), payload, makeCheckSum(3, 7, len(payload), payload))
+	ig.sign(msg)
+	return msg
+}
+
+func TestIntegrityCatchesWhatChecksumMisses(t *testing.T) {
+	corruptions := []struct {
+		name    string
+		corrupt func(*Message)
+	}{
+		{"swapped payload words", func(m *Message) {
+			m.Payload[0], m.Payload[1], m.Payload[2], m.Payload[3] = m.Payload[2], m.Payload[3], m.Payload[0], m.Payload[1]
+		}},
+		{"swapped payload bytes", func(m *Message) { m.Payload[0], m.Payload[2] = m.Payload[2], m.Payload[0] }},
+		{"errors that cancel out", func(m *Message) { m.Payload[0]++; m.Payload[2]-- }},
+		{"swapped header fields", func(m *Message) { m.ConnID, m.SeqNum = m.SeqNum, m.ConnID }},
+		{"word flipped between 0x0000 and 0xffff", func(m *Message) { m.Payload[4], m.Payload[5] = 0xff, 0xff }},
+	}
+	algorithms := []*integrity{
+		newIntegrity(FeatureCRC32C, nil, 3, 42),
+		newIntegrity(FeatureCRC32C|FeatureKeyedHash, nil, 3, 42),
+	}
+	payload := []byte("lsp\x01\x00\x00 payload")
+	for _, c := range corruptions {
+		msg := signedData(nil, append([]byte(nil), payload...))
+		c.corrupt(msg)
+		if !integrityCheck(msg, nil) {
+			t.Fatalf("%s: checksum caught it, pick a corruption it misses", c.name)
+		}
+		for _, ig := range algorithms {
+			msg := signedData(ig, append([]byte(nil), payload...))
+			if !integrityCheck(msg, ig) {
+				t.Fatalf("%s: intact message failed the %s check", c.name, ig.kind)
+			}
+			c.corrupt(msg)
+			if integrityCheck(msg, ig) {
+				t.Fatalf("%s: %s missed it", c.name, ig.kind)
+			}
+		}
+	}
+
+	// a digest made without the connection's key doesn't pass
+	keyed := newIntegrity(FeatureKeyedHash, nil, 3, 42)
+	if integrityCheck(signedData(newIntegrity(FeatureKeyedHash, nil, 3, 43), payload), keyed) {
+		t.Fatalf("Keyed hash passed with another connection's token")
+	}
+	if integrityCheck(signedData(newIntegrity(FeatureKeyedHash, testKey, 3, 42), payload), keyed) {
+		t.Fatalf("Keyed hash passed with a pre-shared key the connection doesn't use")
+	}
+	// a message without a digest doesn't pass either
+	if integrityCheck(signedData(nil, payload), keyed) {
+		t.Fatalf("Message without a digest passed the keyed hash check")
+	}
+}
+
+func TestIntegrityNegotiation(t *testing.T) {
+	cases := []struct {
+		client, server, expected Integrity
+	}{
+		{IntegrityChecksum, IntegrityChecksum, IntegrityChecksum},
+		{IntegrityCRC32C, IntegrityChecksum, IntegrityChecksum},
+		{IntegrityChecksum, IntegrityKeyedHash, IntegrityChecksum},
+		{IntegrityCRC32C, IntegrityCRC32C, IntegrityCRC32C},
+		{IntegrityKeyedHash, IntegrityCRC32C, IntegrityCRC32C},
+		{IntegrityKeyedHash, IntegrityKeyedHash, IntegrityKeyedHash},
+	}
+	for _, c := range cases {
+		client := (&Params{Integrity: c.client}).features()
+		server := (&Params{Integrity: c.server}).features()
+		if got := negotiatedIntegrity(negotiateFeatures(client, server)); got != c.expected {
+			t.Fatalf("Client %s and server %s agreed on %s, expected %s", c.client, c.server, got, c.expected)
+		}
+	}
+
+	ig := newIntegrity(FeatureCRC32C|FeatureKeyedHash, nil, 3, 42)
+	sack := makeSack(3, 10, 4, []*Message{NewData(3, 12, 0, nil, 0)})
+	ig.sign(sack)
+	msg := signedData(ig, []byte("hello"))
+	for _, m := range []*Message{msg, sack} {
+		for _, codec := range []Codec{CodecJSON, CodecBinary} {
+			b, _ := encode(m, codec)
+			var got Message
+			if err := decode(b, &got); err != nil {
+				t.Fatalf("decode(%s) with %s returned %v", m, codec, err)
+			}
+			if got.Digest != m.Digest || !integrityCheck(&got, ig) {
+				t.Fatalf("Round trip of %s with %s lost its digest", m, codec)
+			}
+		}
+	}
+}
+
+func TestIntegrityEcho(t *testing.T) {
+	fmt.Printf("=== TestIntegrityEcho: connections with a digest echo messages, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	for _, ig := range []Integrity{IntegrityCRC32C, IntegrityKeyedHash} {
+		for _, codec := range []Codec{CodecJSON, CodecBinary} {
+			params := &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 4, Integrity: ig}
+			params.Codec = codec
+			params.SelectiveAck = true
+			ts := newSackTestSystem(t, params, params)
+			if got := ts.client.(*client).integrity.Load().kind; got != ig {
+				t.Fatalf("Client uses %s, expected %s", got, ig)
+			}
+			lspnet.SetWriteDropPercent(20)
+			fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+			fts.roundTrip([][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 3*DefaultMaxFragmentSize)}, 20*time.Second)
+			lspnet.ResetDropPercent()
+			ts.client.Close()
+			ts.server.Close()
+		}
+	}
+}
+
+func TestIntegrityRejectsChecksumOnly(t *testing.T) {
+	fmt.Printf("=== TestIntegrityRejectsChecksumOnly: data that only passes the checksum is dropped\n")
+	params := &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 4, Integrity: IntegrityCRC32C}
+	ts := newMigrationTestSystem(t, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+	token := ts.client.(*client).token
+
+	// from another address, it would move the client if it were accepted
+	conn := ts.dial()
+	defer conn.Close()
+	ts.send(conn, tokenData(connID, 1, []byte("no digest"), token))
+	ts.expectNoRead()
+
+	if err := ts.client.Write([]byte("genuine")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if readID, payload, err := ts.server.Read(); err != nil || readID != connID || !bytes.Equal(payload, []byte("genuine")) {
+		t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, nil)", readID, payload, err, connID, "genuine")
+	}
+	if err := ts.server.Write(connID, []byte("reply")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+	if payload, err := ts.client.Read(); err != nil || !bytes.Equal(payload, []byte("reply")) {
+		t.Fatalf("Client read (%q, %v), expected (%q, nil)", payload, err, "reply")
+	}
+}
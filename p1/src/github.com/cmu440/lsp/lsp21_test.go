@@ -0,0 +1,178 @@
+// LSP statistics tests.
+
+// These tests check that Client.Stats and Server.Stats count the data
+// messages sent and received, retransmissions, duplicates and messages that
+// failed the integrity check, and report how full the window, the write
+// buffer and the out-of-order buffer are, along with the round trip time.
+
+package lsp
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// waitForStats polls stats until done returns true for them, failing the
+// test if that takes more than a few seconds.
+func waitForStats(t *testing.T, stats func() (ConnStats, error), done func(ConnStats) bool) ConnStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := stats()
+		if err != nil {
+			t.Fatalf("Stats returned %v", err)
+		}
+		if done(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats never got there, last was %+v", s)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	var cc connCounters
+	if s := cc.snapshot(nil, &sendQueue{}, nil, newRTTEstimator(makeParams(5, 100, 1))); !s.LastHeard.IsZero() || s.RTT != 0 {
+		t.Fatalf("Fresh counters gave %+v, expected nothing heard and no RTT", s)
+	}
+	cc.dataSent = 3
+	cc.received(false)
+	cc.received(true)
+	cc.received(true)
+	cc.retransmissions.Add(2)
+	cc.integrityFailures.Add(1)
+	cc.heard(time.Now())
+	var buffer sendQueue
+	buffer.push(newQueuedData(&Message{}))
+	rtt := newRTTEstimator(makeParams(5, 100, 1))
+	rtt.sample(30 * time.Millisecond)
+	window := []*windowElem{{seqNum: 1}, nil, {seqNum: 3}}
+	s := cc.snapshot(window, &buffer, []*Message{{SeqNum: 5}}, rtt)
+	expected := ConnStats{
+		DataSent: 3, DataReceived: 1, Retransmissions: 2, Duplicates: 2, IntegrityFailures: 1,
+		WindowInUse: 2, WriteBuffered: 1, OutOfOrder: 1, LastHeard: s.LastHeard,
+		RTT: 30 * time.Millisecond, RTO: rtt.timeout(),
+	}
+	if s != expected {
+		t.Fatalf("Snapshot was %+v, expected %+v", s, expected)
+	}
+	if time.Since(s.LastHeard) > time.Second {
+		t.Fatalf("LastHeard is %s, expected just now", s.LastHeard)
+	}
+}
+
+func TestStatsEcho(t *testing.T) {
+	fmt.Printf("=== TestStatsEcho: both ends count the messages of an echo\n")
+	params := makeParams(5, 2000, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	connID := ts.client.ConnID()
+
+	const numMsgs = 10
+	for i := 0; i < numMsgs; i++ {
+		if err := ts.client.Write([]byte("message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	for i := 0; i < numMsgs; i++ {
+		_, payload, err := ts.server.Read()
+		if err != nil {
+			t.Fatalf("Server Read returned %v", err)
+		}
+		if err := ts.server.Write(connID, payload); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+	}
+	for i := 0; i < numMsgs; i++ {
+		if _, err := ts.client.Read(); err != nil {
+			t.Fatalf("Client Read returned %v", err)
+		}
+	}
+
+	serverStats := func() (ConnStats, error) { return ts.server.Stats(connID) }
+	for _, stats := range []func() (ConnStats, error){ts.client.Stats, serverStats} {
+		s := waitForStats(t, stats, func(s ConnStats) bool { return s.WindowInUse == 0 })
+		if s.DataSent != numMsgs || s.DataReceived != numMsgs || s.Retransmissions != 0 || s.Duplicates != 0 {
+			t.Fatalf("Stats were %+v, expected %d messages each way and nothing resent", s, numMsgs)
+		}
+		if s.WriteBuffered != 0 || s.OutOfOrder != 0 || s.IntegrityFailures != 0 {
+			t.Fatalf("Stats were %+v, expected empty buffers and no failures", s)
+		}
+		if s.RTT <= 0 || s.RTT > time.Second || time.Since(s.LastHeard) > time.Second {
+			t.Fatalf("Stats were %+v, expected a measured RTT and a peer heard from just now", s)
+		}
+	}
+
+	if _, err := ts.server.Stats(connID + 1); err == nil {
+		t.Fatalf("Stats of a connection that doesn't exist returned no error")
+	}
+	if err := ts.client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if _, err := ts.client.Stats(); err == nil {
+		t.Fatalf("Stats of a closed client returned no error")
+	}
+}
+
+func TestStatsLosses(t *testing.T) {
+	fmt.Printf("=== TestStatsLosses: lost acks show up as retransmissions and duplicates\n")
+	defer lspnet.ResetDropPercent()
+	params := makeParams(20, 100, 1)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	lspnet.SetServerWriteDropPercent(100) //the server gets everything, the client never hears back
+	for i := 0; i < 3; i++ {
+		if err := ts.client.Write([]byte("message " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	waitForStats(t, ts.client.Stats, func(s ConnStats) bool {
+		return s.Retransmissions >= 2 && s.WindowInUse == 1 && s.WriteBuffered == 2
+	})
+	waitForStats(t, func() (ConnStats, error) { return ts.server.Stats(connID) }, func(s ConnStats) bool {
+		return s.DataReceived == 1 && s.Duplicates >= 1
+	})
+
+	lspnet.ResetDropPercent()
+	waitForStats(t, ts.client.Stats, func(s ConnStats) bool {
+		return s.DataSent == 3 && s.WindowInUse == 0 && s.WriteBuffered == 0
+	})
+}
+
+func TestStatsIntegrityFailures(t *testing.T) {
+	fmt.Printf("=== TestStatsIntegrityFailures: corrupted messages are counted and dropped\n")
+	params := makeParams(20, 100, 4)
+	ts := newSackTestSystem(t, params, params)
+	defer ts.server.Close()
+	defer ts.client.Close()
+	connID := ts.client.ConnID()
+
+	lspnet.SetMsgCorrupted(true)
+	defer lspnet.SetMsgCorrupted(false)
+	if err := ts.client.Write([]byte("corrupted")); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	if err := ts.server.Write(connID, []byte("corrupted")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+	waitForStats(t, ts.client.Stats, func(s ConnStats) bool { return s.IntegrityFailures > 0 })
+	waitForStats(t, func() (ConnStats, error) { return ts.server.Stats(connID) }, func(s ConnStats) bool {
+		return s.IntegrityFailures > 0 && s.DataReceived == 0
+	})
+	lspnet.SetMsgCorrupted(false)
+
+	if _, payload, err := ts.server.Read(); err != nil || string(payload) != "corrupted" {
+		t.Fatalf("Server read (%q, %v), expected the message once it got through", payload, err)
+	}
+	if payload, err := ts.client.Read(); err != nil || string(payload) != "corrupted" {
+		t.Fatalf("Client read (%q, %v), expected the message once it got through", payload, err)
+	}
+}
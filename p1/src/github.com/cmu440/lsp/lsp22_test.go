@@ -0,0 +1,120 @@
+// LSP connection event tests.
+
+// These tests check that Server.Events reports every new connection with the
+// address it came from, and tells a connection that was lost apart from one
+// the client closed and one closed by CloseConn or Close, that events wait
+// for the application up to a limit, and that the channel is closed once the
+// server has shut down.
+
+package lsp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectEvent fails the test unless the next event is of the given type for
+// connID.
+func expectEvent(t *testing.T, events <-chan ConnEvent, eventType ConnEventType, connID int) ConnEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("Events closed, expected %s for connection %d", eventType, connID)
+		}
+		if event.Type != eventType || event.ConnID != connID {
+			t.Fatalf("Got event %s for connection %d, expected %s for connection %d", event.Type, event.ConnID, eventType, connID)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event, expected %s for connection %d", eventType, connID)
+	}
+	return ConnEvent{}
+}
+
+func TestEventQueue(t *testing.T) {
+	s := &server{eventChan: make(chan ConnEvent, maxQueuedEvents)}
+	const extra = 10
+	for i := 1; i <= maxQueuedEvents+extra; i++ {
+		s.report(ConnOpened, i, "127.0.0.1:"+strconv.Itoa(i))
+	}
+	s.closeEvents()
+	// the oldest were dropped, the rest come out in order even after the
+	// server quit
+	for i := extra + 1; i <= maxQueuedEvents+extra; i++ {
+		event := expectEvent(t, s.Events(), ConnOpened, i)
+		if event.Addr != "127.0.0.1:"+strconv.Itoa(i) {
+			t.Fatalf("Event for connection %d has address %q", i, event.Addr)
+		}
+	}
+	if _, ok := <-s.Events(); ok {
+		t.Fatalf("Events not closed once the server quit")
+	}
+	s.report(ConnLost, 1, "") //doesn't block or panic after the server quit
+}
+
+func TestEventsLifecycle(t *testing.T) {
+	fmt.Printf("=== TestEventsLifecycle: each way a connection ends gets its own event\n")
+	ts := newMigrationTestSystem(t, makeParams(3, 100, 4))
+	events := ts.server.Events()
+	first := ts.client.ConnID()
+	opened := expectEvent(t, events, ConnOpened, first)
+	if !strings.HasPrefix(opened.Addr, "127.0.0.1:") {
+		t.Fatalf("Connection opened from %q, expected an address on 127.0.0.1", opened.Addr)
+	}
+
+	// the client closes
+	if err := ts.client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	expectEvent(t, events, ConnClosedByPeer, first)
+
+	// the server closes
+	closed, err := NewClient("127.0.0.1:"+strconv.Itoa(ts.port), makeParams(3, 100, 4))
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer closed.Close()
+	closedID := closed.ConnID()
+	expectEvent(t, events, ConnOpened, closedID)
+	if err := ts.server.CloseConn(closedID); err != nil {
+		t.Fatalf("CloseConn returned %v", err)
+	}
+	expectEvent(t, events, ConnClosedLocally, closedID)
+
+	// a client that connects and is never heard from again
+	conn := ts.dial()
+	defer conn.Close()
+	ts.send(conn, NewConnect())
+	connID := ts.expect(conn, MsgAck, 0).ConnID
+	opened = expectEvent(t, events, ConnOpened, connID)
+	lost := expectEvent(t, events, ConnLost, connID)
+	if lost.Addr != opened.Addr {
+		t.Fatalf("Connection lost at %q, expected %q", lost.Addr, opened.Addr)
+	}
+
+	// Close ends the rest, then Events is closed
+	last, err := NewClient("127.0.0.1:"+strconv.Itoa(ts.port), makeParams(3, 100, 4))
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer last.Close()
+	lastID := last.ConnID()
+	expectEvent(t, events, ConnOpened, lastID)
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- ts.server.Close() }()
+	expectEvent(t, events, ConnClosedLocally, lastID)
+	if err := <-closeDone; err != nil {
+		t.Fatalf("Server Close returned %v", err)
+	}
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Fatalf("Got event %s for connection %d after Close", event.Type, event.ConnID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Events not closed after Close")
+	}
+}
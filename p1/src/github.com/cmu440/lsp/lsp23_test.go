@@ -0,0 +1,195 @@
+// LSP connection parameter negotiation tests.
+
+// These tests check that a client proposes its EpochLimit, EpochMillis and
+// WindowSize in its connect message, that the server runs the connection
+// with its own settings or the ones its ConnectPolicy picks, refusing the
+// client if the policy says so or proposes negative settings, that no
+// connection runs past the built-in maximums, and that the client adopts
+// whatever the connect ack says, so that an idle connection isn't dropped
+// because the two ends count epochs differently.
+
+package lsp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestConnParamsCodec(t *testing.T) {
+	connect := NewConnect()
+	ConnParams{EpochLimit: 4, EpochMillis: 150, WindowSize: 8}.put(connect)
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		b, _ := encode(connect, codec)
+		var got Message
+		if err := decode(b, &got); err != nil {
+			t.Fatalf("decode with %s returned %v", codec, err)
+		}
+		if cp := messageConnParams(&got); cp != messageConnParams(connect) {
+			t.Fatalf("Round trip with %s gave %+v, expected %+v", codec, cp, messageConnParams(connect))
+		}
+	}
+
+	params := makeParams(5, 100, 2)
+	if got := params.with(ConnParams{EpochMillis: 300}).connParams(); got != (ConnParams{5, 300, 2}) {
+		t.Fatalf("with kept %+v, expected only EpochMillis to change", got)
+	}
+	if params.EpochMillis != 100 {
+		t.Fatalf("with changed the params it was called on")
+	}
+
+	clamp := ClampPolicy(ConnParams{EpochMillis: 50, WindowSize: 2}, ConnParams{EpochLimit: 4, WindowSize: 16})
+	if got, _ := clamp("", ConnParams{10, 20, 8}); got != (ConnParams{4, 50, 8}) {
+		t.Fatalf("ClampPolicy gave %+v, expected {4 50 8}", got)
+	}
+	if got, _ := ClampPolicy(ConnParams{}, ConnParams{})("", ConnParams{10, 20, 1}); got != (ConnParams{10, 20, 1}) {
+		t.Fatalf("ClampPolicy without bounds gave %+v, expected what was proposed", got)
+	}
+	unbounded := ClampPolicy(ConnParams{}, ConnParams{})
+	if got, _ := unbounded("", ConnParams{10, 20, 1 << 30}); got != (ConnParams{10, 20, maxWindowSize}) {
+		t.Fatalf("ClampPolicy without bounds gave %+v, expected the window clamped to %d", got, maxWindowSize)
+	}
+	for _, proposed := range []ConnParams{{0, 20, 1}, {10, -1, 1}, {10, 20, -5}} {
+		if _, err := unbounded("", proposed); err != ErrConnRefused {
+			t.Fatalf("ClampPolicy accepted %+v", proposed)
+		}
+	}
+	if got := params.with(ConnParams{1 << 30, 1 << 30, 1 << 30}).connParams(); got != (ConnParams{maxEpochLimit, maxEpochMillis, maxWindowSize}) {
+		t.Fatalf("with kept %+v, expected the built-in maximums", got)
+	}
+
+	// in secure mode the agreed settings can't be changed on the way
+	ack := NewAck(3, 0)
+	ConnParams{EpochLimit: 4, EpochMillis: 150, WindowSize: 8}.put(ack)
+	mac := ackMAC(testKey, []byte("nonce"), ack)
+	ack.WindowSize = 9
+	if bytes.Equal(mac, ackMAC(testKey, []byte("nonce"), ack)) {
+		t.Fatalf("Connect ack MAC doesn't cover WindowSize")
+	}
+}
+
+// policyServer starts a server with the given policy, recording every
+// proposal it sees.
+type policyServer struct {
+	server   Server
+	hostport string
+	mu       sync.Mutex
+	proposed []ConnParams
+	addrs    []string
+}
+
+func newPolicyServer(t *testing.T, params *Params, policy ConnectPolicy) *policyServer {
+	ps := &policyServer{}
+	params.ConnectPolicy = func(addr string, proposed ConnParams) (ConnParams, error) {
+		ps.mu.Lock()
+		ps.proposed = append(ps.proposed, proposed)
+		ps.addrs = append(ps.addrs, addr)
+		ps.mu.Unlock()
+		return policy(addr, proposed)
+	}
+	server, port := startSecureServer(t, params)
+	ps.server = server
+	ps.hostport = lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return ps
+}
+
+func TestConnectPolicyClamp(t *testing.T) {
+	fmt.Printf("=== TestConnectPolicyClamp: the client runs with what the policy made of its proposal\n")
+	policy := ClampPolicy(ConnParams{EpochMillis: 50}, ConnParams{EpochLimit: 4, WindowSize: 2})
+	ps := newPolicyServer(t, makeParams(5, 100, 4), policy)
+	defer ps.server.Close()
+
+	cli, err := NewClient(ps.hostport, makeParams(10, 20, 8))
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer cli.Close()
+	if got := cli.(*client).connParams().connParams(); got != (ConnParams{4, 50, 2}) {
+		t.Fatalf("Client runs with %+v, expected {4 50 2}", got)
+	}
+	ps.mu.Lock()
+	if len(ps.proposed) != 1 || ps.proposed[0] != (ConnParams{10, 20, 8}) {
+		t.Fatalf("Policy saw %+v, expected one proposal of {10 20 8}", ps.proposed)
+	}
+	if !strings.HasPrefix(ps.addrs[0], "127.0.0.1:") {
+		t.Fatalf("Policy saw address %q, expected one on 127.0.0.1", ps.addrs[0])
+	}
+	ps.mu.Unlock()
+
+	fts := &fragmentTestSystem{t: t, server: ps.server, client: cli}
+	fts.roundTrip([][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four")}, 5*time.Second)
+}
+
+func TestConnectPolicyRefuse(t *testing.T) {
+	fmt.Printf("=== TestConnectPolicyRefuse: a client the policy refuses doesn't connect\n")
+	ps := newPolicyServer(t, makeParams(5, 100, 4), func(addr string, proposed ConnParams) (ConnParams, error) {
+		if proposed.WindowSize > 4 {
+			return ConnParams{}, ErrConnRefused
+		}
+		return proposed, nil
+	})
+	defer ps.server.Close()
+
+	if cli, err := NewClient(ps.hostport, makeParams(3, 100, 8)); err == nil {
+		cli.Close()
+		t.Fatalf("Client the policy refused connected")
+	}
+	cli, err := NewClient(ps.hostport, makeParams(3, 100, 4))
+	if err != nil {
+		t.Fatalf("Client the policy accepts failed to connect: %s", err)
+	}
+	defer cli.Close()
+	if connID := cli.ConnID(); connID != 1 {
+		t.Fatalf("Client got connection %d, expected 1 since the refused one got none", connID)
+	}
+}
+
+func TestNegotiatedEpochsKeepIdleConnection(t *testing.T) {
+	fmt.Printf("=== TestNegotiatedEpochsKeepIdleConnection: a client with short epochs adopts the server's\n")
+	server, port := startSecureServer(t, makeParams(5, 300, 2))
+	defer server.Close()
+	// on its own, this client would give up after 100ms without hearing
+	// from a server that only sends a heartbeat every 300ms
+	cli, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), makeParams(2, 50, 8))
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer cli.Close()
+	if got := cli.(*client).connParams().connParams(); got != (ConnParams{5, 300, 2}) {
+		t.Fatalf("Client runs with %+v, expected the server's {5 300 2}", got)
+	}
+
+	time.Sleep(time.Second)
+	if err := cli.Write([]byte("still here")); err != nil {
+		t.Fatalf("Client Write after idling returned %v", err)
+	}
+	if _, payload, err := server.Read(); err != nil || string(payload) != "still here" {
+		t.Fatalf("Server read (%q, %v), expected the message from the idle client", payload, err)
+	}
+}
+
+func TestConnectPolicyError(t *testing.T) {
+	refused := errors.New("not today")
+	s := &server{params: makeParams(5, 100, 4)}
+	s.params.ConnectPolicy = func(string, ConnParams) (ConnParams, error) { return ConnParams{}, refused }
+	if _, err := s.negotiateParams(NewConnect(), "127.0.0.1:4000"); err != refused {
+		t.Fatalf("negotiateParams returned %v, expected the policy's error", err)
+	}
+	s.params.ConnectPolicy = func(string, ConnParams) (ConnParams, error) { return ConnParams{WindowSize: 3}, nil }
+	params, err := s.negotiateParams(NewConnect(), "127.0.0.1:4000")
+	if err != nil || params.connParams() != (ConnParams{5, 100, 3}) {
+		t.Fatalf("negotiateParams returned (%+v, %v), expected {5 100 3}", params.connParams(), err)
+	}
+	connect := NewConnect()
+	connect.WindowSize = -1
+	if _, err := s.negotiateParams(connect, "127.0.0.1:4000"); err != ErrConnRefused {
+		t.Fatalf("negotiateParams returned %v for a negative window, expected %v", err, ErrConnRefused)
+	}
+}
@@ -0,0 +1,148 @@
+// LSP bind address tests.
+
+// These tests check that NewServerAddr listens on the address it is given,
+// the IPv6 loopback, every IPv4 interface or every interface at once, that
+// clients reach it over IPv6, and that a client binds to Params.LocalAddr.
+
+package lsp
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// startServerAddr starts a server listening on host at a random port,
+// skipping the test if the host can't be listened on at all, which is the
+// case for IPv6 on systems without it.
+func startServerAddr(t *testing.T, host string, params *Params) (Server, int) {
+	var err error
+	for i := 0; i < 5; i++ {
+		port := 3000 + rand.Intn(50000)
+		var server Server
+		if server, err = NewServerAddr(lspnet.JoinHostPort(host, strconv.Itoa(port)), params); err == nil {
+			return server, port
+		}
+	}
+	if strings.Contains(host, ":") {
+		t.Skipf("Can't listen on %s: %s", host, err)
+	}
+	t.Fatalf("Failed to start server on %s: %s", host, err)
+	return nil, 0
+}
+
+// openedAddr returns the address the server reports connID connecting
+// from, skipping the events of earlier connections.
+func openedAddr(t *testing.T, server Server, connID int) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-server.Events():
+			if event.Type == ConnOpened && event.ConnID == connID {
+				return event.Addr
+			}
+		case <-timeout:
+			t.Fatalf("Server never reported connection %d opening", connID)
+		}
+	}
+}
+
+// echoFrom connects a client to the server at host and port, checks that a
+// message makes it there and back and closes the client again, returning
+// the address the server saw the client at.
+func echoFrom(t *testing.T, server Server, host string, port int, params *Params) string {
+	cli, err := NewClient(lspnet.JoinHostPort(host, strconv.Itoa(port)), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect to %s: %s", host, err)
+	}
+	connID := cli.ConnID()
+	addr := openedAddr(t, server, connID)
+	fts := &fragmentTestSystem{t: t, server: server, client: cli}
+	fts.roundTrip([][]byte{[]byte("hello from " + host)}, 5*time.Second)
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	if readID, _, err := server.Read(); err == nil || readID != connID {
+		t.Fatalf("Server read (%d, %v), expected connection %d to be closed", readID, err, connID)
+	}
+	return addr
+}
+
+func TestServerAddrIPv6Loopback(t *testing.T) {
+	fmt.Printf("=== TestServerAddrIPv6Loopback: clients connect over the IPv6 loopback\n")
+	params := makeParams(5, 200, 4)
+	server, port := startServerAddr(t, "::1", params)
+	defer server.Close()
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		params.Codec = codec
+		if addr := echoFrom(t, server, "::1", port, params); !strings.HasPrefix(addr, "[::1]:") {
+			t.Fatalf("Client connected from %q, expected an address on [::1]", addr)
+		}
+	}
+	// nothing listens on the IPv4 loopback
+	if cli, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), makeParams(2, 100, 1)); err == nil {
+		cli.Close()
+		t.Fatalf("Client reached an IPv6 only server over IPv4")
+	}
+}
+
+func TestServerAddrAnyIPv4(t *testing.T) {
+	fmt.Printf("=== TestServerAddrAnyIPv4: a server on 0.0.0.0 takes clients on the loopback\n")
+	server, port := startServerAddr(t, "0.0.0.0", makeParams(5, 200, 4))
+	defer server.Close()
+	if addr := echoFrom(t, server, "127.0.0.1", port, makeParams(5, 200, 4)); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("Client connected from %q, expected an address on 127.0.0.1", addr)
+	}
+}
+
+func TestServerAddrDualStack(t *testing.T) {
+	fmt.Printf("=== TestServerAddrDualStack: a server on [::] takes IPv4 and IPv6 clients\n")
+	server, port := startServerAddr(t, "::", makeParams(5, 200, 4))
+	defer server.Close()
+	if addr := echoFrom(t, server, "::1", port, makeParams(5, 200, 4)); !strings.HasPrefix(addr, "[::1]:") {
+		t.Fatalf("IPv6 client connected from %q, expected an address on [::1]", addr)
+	}
+	// an IPv4 client shows up as an IPv4-mapped IPv6 address or as itself
+	if addr := echoFrom(t, server, "127.0.0.1", port, makeParams(5, 200, 4)); !strings.Contains(addr, "127.0.0.1") {
+		t.Fatalf("IPv4 client connected from %q, expected an address on 127.0.0.1", addr)
+	}
+}
+
+func TestClientLocalAddr(t *testing.T) {
+	fmt.Printf("=== TestClientLocalAddr: a client binds to the address in its params\n")
+	server, port := startServerAddr(t, "::1", makeParams(5, 200, 4))
+	defer server.Close()
+	params := makeParams(5, 200, 4)
+	for i := 0; i < 5; i++ {
+		local := lspnet.JoinHostPort("::1", strconv.Itoa(3000+rand.Intn(50000)))
+		params.LocalAddr = local
+		cli, err := NewClient(lspnet.JoinHostPort("::1", strconv.Itoa(port)), params)
+		if err != nil {
+			continue //port taken, try another
+		}
+		defer cli.Close()
+		if addr := openedAddr(t, server, cli.ConnID()); addr != local {
+			t.Fatalf("Client connected from %q, expected %q", addr, local)
+		}
+		return
+	}
+	t.Fatalf("Client failed to bind to a local address")
+}
+
+func TestBadBindAddr(t *testing.T) {
+	if server, err := NewServerAddr("not an address", makeParams(5, 200, 4)); err == nil {
+		server.Close()
+		t.Fatalf("NewServerAddr accepted an address without a port")
+	}
+	params := makeParams(5, 200, 4)
+	params.LocalAddr = "[::1"
+	if cli, err := NewClient("127.0.0.1:9999", params); err == nil {
+		cli.Close()
+		t.Fatalf("NewClient accepted a malformed LocalAddr")
+	}
+}
@@ -0,0 +1,277 @@
+// LSP transport tests.
+
+// These tests check that clients and servers run over any PacketTransport:
+// an in-memory pipe, a Unix datagram socket and a transport that counts and
+// drops packets on the way, that a server tells clients on one transport
+// apart by address, and that a transport is closed along with its client or
+// server.
+
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memAddr is the address of a transport on a memNetwork.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+// memNetwork connects transports in memory. Like UDP, it drops packets to
+// transports that don't exist or can't keep up.
+type memNetwork struct {
+	mu         sync.Mutex
+	transports map[memAddr]*memTransport
+	inboxSize  int // packets each transport holds, 1024 if zero
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{transports: make(map[memAddr]*memTransport)}
+}
+
+func (n *memNetwork) listen(addr string) *memTransport {
+	size := n.inboxSize
+	if size == 0 {
+		size = 1024
+	}
+	t := &memTransport{
+		network: n,
+		addr:    memAddr(addr),
+		inbox:   make(chan memPacket, size),
+		closed:  make(chan int),
+	}
+	n.mu.Lock()
+	n.transports[t.addr] = t
+	n.mu.Unlock()
+	return t
+}
+
+type memTransport struct {
+	network   *memNetwork
+	addr      memAddr
+	inbox     chan memPacket
+	closed    chan int
+	closeOnce sync.Once
+}
+
+func (t *memTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-t.inbox:
+		return copy(b, packet.b), packet.from, nil
+	case <-t.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (t *memTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	t.network.mu.Lock()
+	peer := t.network.transports[memAddr(addr.String())]
+	t.network.mu.Unlock()
+	if peer != nil {
+		select {
+		case peer.inbox <- memPacket{append([]byte(nil), b...), t.addr}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (t *memTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.mu.Lock()
+		delete(t.network.transports, t.addr)
+		t.network.mu.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *memTransport) LocalAddr() net.Addr { return t.addr }
+
+// countingTransport counts the packets going through another transport,
+// dropping every dropEvery-th one it writes unless dropEvery is zero.
+type countingTransport struct {
+	PacketTransport
+	dropEvery int64
+	read      atomic.Int64
+	written   atomic.Int64
+	dropped   atomic.Int64
+	closed    atomic.Bool
+}
+
+func (t *countingTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := t.PacketTransport.ReadFrom(b)
+	if err == nil {
+		t.read.Add(1)
+	}
+	return n, addr, err
+}
+
+func (t *countingTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if written := t.written.Add(1); t.dropEvery > 0 && written%t.dropEvery == 0 {
+		t.dropped.Add(1)
+		return len(b), nil
+	}
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+func (t *countingTransport) Close() error {
+	t.closed.Store(true)
+	return t.PacketTransport.Close()
+}
+
+func TestMemTransportEcho(t *testing.T) {
+	fmt.Printf("=== TestMemTransportEcho: clients and a server talk over an in-memory pipe\n")
+	network := newMemNetwork()
+	params := makeParams(5, 100, 4)
+	server, err := NewServerTransport(network.listen("server"), params)
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	defer server.Close()
+	for _, name := range []string{"alice", "bob"} {
+		cli, err := NewClientTransport(network.listen(name), memAddr("server"), params)
+		if err != nil {
+			t.Fatalf("Client %s failed to connect: %s", name, err)
+		}
+		connID := cli.ConnID()
+		if addr := openedAddr(t, server, connID); addr != name {
+			t.Fatalf("Server saw connection %d from %q, expected %q", connID, addr, name)
+		}
+		fts := &fragmentTestSystem{t: t, server: server, client: cli}
+		fts.roundTrip([][]byte{[]byte("hello from " + name), randPayload(3000), []byte("bye")}, 5*time.Second)
+		if err := cli.Close(); err != nil {
+			t.Fatalf("Client %s Close returned %v", name, err)
+		}
+		if readID, _, err := server.Read(); err == nil || readID != connID {
+			t.Fatalf("Server read (%d, %v), expected connection %d to be closed", readID, err, connID)
+		}
+		network.mu.Lock()
+		_, open := network.transports[memAddr(name)]
+		network.mu.Unlock()
+		if open {
+			t.Fatalf("Client %s didn't close its transport", name)
+		}
+	}
+}
+
+func TestCountingTransport(t *testing.T) {
+	fmt.Printf("=== TestCountingTransport: a transport in between sees every packet and loses some\n")
+	network := newMemNetwork()
+	params := makeParams(5, 100, 4)
+	serverTransport := &countingTransport{PacketTransport: network.listen("server")}
+	server, err := NewServerTransport(serverTransport, params)
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	clientTransport := &countingTransport{PacketTransport: network.listen("client"), dropEvery: 4}
+	cli, err := NewClientTransport(clientTransport, memAddr("server"), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	payloads := make([][]byte, 20)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	fts := &fragmentTestSystem{t: t, server: server, client: cli}
+	fts.roundTrip(payloads, 10*time.Second)
+
+	if clientTransport.dropped.Load() == 0 {
+		t.Fatalf("Client transport dropped nothing")
+	}
+	// whatever the client lost was sent again
+	if got := serverTransport.read.Load(); got > clientTransport.written.Load()-clientTransport.dropped.Load() {
+		t.Fatalf("Server read %d packets, more than the client got through", got)
+	} else if got < int64(len(payloads))+1 {
+		t.Fatalf("Server read %d packets, expected at least the connect and every message", got)
+	}
+	if clientTransport.read.Load() < int64(len(payloads))+1 {
+		t.Fatalf("Client read %d packets, expected at least the connect ack and every echo", clientTransport.read.Load())
+	}
+
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	server.Read() //the close
+	if err := server.Close(); err != nil {
+		t.Fatalf("Server Close returned %v", err)
+	}
+	if !clientTransport.closed.Load() || !serverTransport.closed.Load() {
+		t.Fatalf("Transports not closed along with the client and server")
+	}
+}
+
+func TestUnixgramTransport(t *testing.T) {
+	fmt.Printf("=== TestUnixgramTransport: a client and server talk over Unix datagram sockets\n")
+	dir := t.TempDir()
+	serverAddr := &net.UnixAddr{Name: filepath.Join(dir, "server.sock"), Net: "unixgram"}
+	serverConn, err := net.ListenUnixgram("unixgram", serverAddr)
+	if err != nil {
+		t.Skipf("Can't listen on a Unix datagram socket: %s", err)
+	}
+	server, err := NewServerTransport(serverConn, makeParams(5, 100, 4))
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	defer server.Close()
+	// the client needs a name of its own for the server to answer to
+	clientAddr := &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"}
+	clientConn, err := net.ListenUnixgram("unixgram", clientAddr)
+	if err != nil {
+		t.Fatalf("Client failed to listen: %s", err)
+	}
+	params := makeParams(5, 100, 4)
+	params.Codec = CodecBinary
+	cli, err := NewClientTransport(clientConn, serverAddr, params)
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer cli.Close()
+	if addr := openedAddr(t, server, cli.ConnID()); addr != clientAddr.Name {
+		t.Fatalf("Server saw the client at %q, expected %q", addr, clientAddr.Name)
+	}
+	fts := &fragmentTestSystem{t: t, server: server, client: cli}
+	fts.roundTrip([][]byte{[]byte("over a socket file"), randPayload(3000)}, 5*time.Second)
+}
+
+func TestTransportClosedOnError(t *testing.T) {
+	params := makeParams(5, 100, 4)
+	params.PreSharedKey = []byte("short")
+	transport := &countingTransport{PacketTransport: newMemNetwork().listen("server")}
+	if server, err := NewServerTransport(transport, params); err == nil {
+		server.Close()
+		t.Fatalf("NewServerTransport accepted a key that is too short")
+	}
+	if !transport.closed.Load() {
+		t.Fatalf("NewServerTransport didn't close the transport it failed to use")
+	}
+	transport = &countingTransport{PacketTransport: newMemNetwork().listen("client")}
+	if cli, err := NewClientTransport(transport, memAddr("server"), params); err == nil {
+		cli.Close()
+		t.Fatalf("NewClientTransport accepted a key that is too short")
+	}
+	if !transport.closed.Load() {
+		t.Fatalf("NewClientTransport didn't close the transport it failed to use")
+	}
+	if _, _, err := transport.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("ReadFrom on a closed transport returned %v", err)
+	}
+}
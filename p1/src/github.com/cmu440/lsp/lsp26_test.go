@@ -0,0 +1,241 @@
+// LSP net.Conn adapter tests.
+
+// These tests check that NewConn turns a client into a byte stream that
+// bufio, encoding/gob and io.ReadFull work over, splitting writes longer than
+// MaxMessageSize into several messages, that read deadlines time out pending
+// and future reads and can be moved, that Close unblocks a pending read, and
+// that the server closing the connection reads as io.EOF.
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// startConn connects a client to a new server and wraps it with NewConn.
+func startConn(t *testing.T, params *Params) (Server, net.Conn, int) {
+	server, port := startSecureServer(t, params)
+	cli, err := NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), params)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	return server, NewConn(cli), port
+}
+
+// echo has the server send every message back until it stops, recording the
+// size of each message.
+func echo(server Server, sizes chan<- int) {
+	for {
+		connID, payload, err := server.Read()
+		if err != nil {
+			if connID == 0 { //the server closed
+				return
+			}
+			continue
+		}
+		if sizes != nil {
+			sizes <- len(payload)
+		}
+		server.Write(connID, payload)
+	}
+}
+
+func TestConnByteStream(t *testing.T) {
+	fmt.Printf("=== TestConnByteStream: bufio reads lines back from a conn over LSP\n")
+	params := makeParams(5, 100, 4)
+	params.MaxMessageSize = 100
+	server, conn, port := startConn(t, params)
+	defer server.Close()
+	defer conn.Close()
+	sizes := make(chan int, 100)
+	go echo(server, sizes)
+
+	if addr := conn.RemoteAddr().String(); addr != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Fatalf("RemoteAddr is %q, expected the server's address", addr)
+	}
+	if network := conn.LocalAddr().Network(); network != "udp" {
+		t.Fatalf("LocalAddr is on %q, expected udp", network)
+	}
+	if _, localPort, err := net.SplitHostPort(conn.LocalAddr().String()); err != nil || localPort == "0" {
+		t.Fatalf("LocalAddr is %q, expected the port the socket got", conn.LocalAddr())
+	}
+
+	w := bufio.NewWriter(conn)
+	r := bufio.NewReader(conn)
+	long := strings.Repeat("x", 950)
+	lines := []string{"first", long, "", "last"}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush returned %v", err)
+	}
+	for _, expected := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString returned %v", err)
+		}
+		if line != expected+"\n" {
+			t.Fatalf("Read back %d bytes, expected %d", len(line), len(expected)+1)
+		}
+	}
+	// one Write of 966 bytes, sent as 10 messages
+	for i := 0; i < 10; i++ {
+		if size := <-sizes; size > params.MaxMessageSize {
+			t.Fatalf("Server read a message of %d bytes, more than MaxMessageSize", size)
+		}
+	}
+}
+
+func TestConnGob(t *testing.T) {
+	fmt.Printf("=== TestConnGob: values survive a round trip through gob over a conn\n")
+	server, conn, _ := startConn(t, makeParams(5, 100, 4))
+	defer server.Close()
+	defer conn.Close()
+	go echo(server, nil)
+
+	type job struct {
+		Name  string
+		Nonce uint64
+		Data  []byte
+	}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	for i := 0; i < 5; i++ {
+		sent := job{Name: "job " + strconv.Itoa(i), Nonce: uint64(i) << 40, Data: randPayload(500 * i)}
+		if err := enc.Encode(sent); err != nil {
+			t.Fatalf("Encode returned %v", err)
+		}
+		var got job
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decode returned %v", err)
+		}
+		if got.Name != sent.Name || got.Nonce != sent.Nonce || !bytes.Equal(got.Data, sent.Data) {
+			t.Fatalf("Decoded %q, expected %q", got.Name, sent.Name)
+		}
+	}
+}
+
+// isTimeout tells whether err is a net.Error that timed out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	fmt.Printf("=== TestConnReadDeadline: reads time out at the deadline and not before\n")
+	server, conn, _ := startConn(t, makeParams(5, 100, 4))
+	defer server.Close()
+	defer conn.Close()
+	b := make([]byte, 16)
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(200 * time.Millisecond))
+	if _, err := conn.Read(b); !isTimeout(err) {
+		t.Fatalf("Read returned %v, expected a timeout", err)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Fatalf("Read timed out after %s, before the deadline", waited)
+	}
+	if _, err := conn.Read(b); !isTimeout(err) {
+		t.Fatalf("Read after the deadline returned %v, expected a timeout", err)
+	}
+
+	// moving the deadline applies to a pending Read
+	conn.SetReadDeadline(time.Now().Add(time.Hour))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(b)
+		readErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn.SetReadDeadline(time.Now())
+	select {
+	case err := <-readErr:
+		if !isTimeout(err) {
+			t.Fatalf("Pending Read returned %v, expected a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Pending Read didn't time out after the deadline was moved up")
+	}
+
+	// without a deadline, a message that shows up later is read
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write returned %v", err)
+	}
+	connID, payload, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server Read returned %v", err)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.Write(connID, append(payload, "-pong"...))
+	}()
+	if _, err := io.ReadFull(conn, b[:9]); err != nil || string(b[:9]) != "ping-pong" {
+		t.Fatalf("Read (%q, %v), expected ping-pong", b[:9], err)
+	}
+}
+
+func TestConnCloseAndEOF(t *testing.T) {
+	fmt.Printf("=== TestConnCloseAndEOF: Close unblocks a pending Read, the server closing reads as EOF\n")
+	server, conn, _ := startConn(t, makeParams(5, 100, 4))
+	defer server.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		readErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close returned %v", err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Pending Read returned %v, expected net.ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close didn't unblock a pending Read")
+	}
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after Close returned %v, expected net.ErrClosed", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Second Close returned %v", err)
+	}
+	server.Read() //the close
+
+	cli, err := NewClient(conn.RemoteAddr().String(), makeParams(5, 100, 4))
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	conn = NewConn(cli)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatalf("Write returned %v", err)
+	}
+	connID, _, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server Read returned %v", err)
+	}
+	server.Write(connID, []byte("last words"))
+	server.CloseConn(connID)
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "last words" {
+		t.Fatalf("ReadAll returned (%q, %v), expected the last words and EOF", got, err)
+	}
+}
@@ -0,0 +1,290 @@
+// LSP net.Listener adapter tests.
+
+// These tests check that NewListener accepts a conn for every client, in the
+// order they connected and with the address they connected from, that each
+// conn only reads its own client's messages, that a conn nobody reads from
+// doesn't hold up the others, even once it is full and the server holds
+// back the rest of its client's messages, that a client is accepted
+// even if its ConnOpened event never comes, and that closing either end of a
+// conn reads as io.EOF on the other while closing the listener unblocks
+// Accept.
+
+package lsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// startListener starts a server wrapped by NewListener, returning the
+// address clients connect to.
+func startListener(t *testing.T, params *Params) (net.Listener, string) {
+	server, port := startSecureServer(t, params)
+	return NewListener(server), lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// dialConn connects a new client to hostport as a conn.
+func dialConn(t *testing.T, hostport string, params *Params) net.Conn {
+	cli, err := NewClient(hostport, params)
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	return NewConn(cli)
+}
+
+// accept fails the test unless Accept returns a conn in time.
+func accept(t *testing.T, l net.Listener) net.Conn {
+	connChan := make(chan net.Conn, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		connChan <- conn
+	}()
+	select {
+	case conn := <-connChan:
+		return conn
+	case err := <-errChan:
+		t.Fatalf("Accept returned %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Accept returned nothing")
+	}
+	return nil
+}
+
+func TestListenerEcho(t *testing.T) {
+	fmt.Printf("=== TestListenerEcho: a goroutine per accepted conn echoes its client\n")
+	params := makeParams(5, 100, 4)
+	l, hostport := startListener(t, params)
+	defer l.Close()
+	if !strings.HasSuffix(l.Addr().String(), hostport[strings.LastIndex(hostport, ":"):]) {
+		t.Fatalf("Listener is at %q, expected the port of %q", l.Addr(), hostport)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	const numClients = 4
+	clients := make([]net.Conn, numClients)
+	for i := range clients {
+		clients[i] = dialConn(t, hostport, params)
+		defer clients[i].Close()
+	}
+	errChan := make(chan error, numClients)
+	for i, conn := range clients {
+		go func(i int, conn net.Conn) {
+			r := bufio.NewReader(conn)
+			for j := 0; j < 20; j++ {
+				line := fmt.Sprintf("client %d line %d\n", i, j)
+				if _, err := io.WriteString(conn, line); err != nil {
+					errChan <- err
+					return
+				}
+				if got, err := r.ReadString('\n'); err != nil || got != line {
+					errChan <- fmt.Errorf("client %d read (%q, %v), expected %q", i, got, err, line)
+					return
+				}
+			}
+			errChan <- nil
+		}(i, conn)
+	}
+	for range clients {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Fatalf("Echo failed: %s", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Echo timed out")
+		}
+	}
+}
+
+func TestListenerSlowConsumer(t *testing.T) {
+	fmt.Printf("=== TestListenerSlowConsumer: a conn nobody reads doesn't hold up the others\n")
+	params := makeParams(5, 100, 4)
+	params.MaxUnreadMessages = 2
+	l, hostport := startListener(t, params)
+	defer l.Close()
+
+	slowClient := dialConn(t, hostport, params)
+	defer slowClient.Close()
+	slow := accept(t, l)
+	if addr := slow.RemoteAddr().String(); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("Conn is from %q, expected an address on 127.0.0.1", addr)
+	}
+	fastClient := dialConn(t, hostport, params)
+	defer fastClient.Close()
+	fast := accept(t, l)
+
+	const numMsgs = 30
+	for i := 0; i < numMsgs; i++ {
+		if _, err := slowClient.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Slow client Write returned %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	fastClient.Write([]byte("me first"))
+	fast.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 16)
+	if n, err := fast.Read(b); err != nil || string(b[:n]) != "me first" {
+		t.Fatalf("Fast conn read (%q, %v), expected its own message", b[:n], err)
+	}
+
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, numMsgs)
+	if _, err := io.ReadFull(slow, got); err != nil {
+		t.Fatalf("Slow conn read returned %v", err)
+	}
+	for i, b := range got {
+		if int(b) != i {
+			t.Fatalf("Slow conn read %d at %d, expected the messages in order", b, i)
+		}
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	fmt.Printf("=== TestListenerClose: closing a conn or the listener ends what waits on it\n")
+	params := makeParams(5, 100, 4)
+	l, hostport := startListener(t, params)
+
+	// the server closes a conn
+	client := dialConn(t, hostport, params)
+	defer client.Close()
+	conn := accept(t, l)
+	conn.Write([]byte("bye"))
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Conn Close returned %v", err)
+	}
+	if got, err := io.ReadAll(client); err != nil || string(got) != "bye" {
+		t.Fatalf("Client ReadAll returned (%q, %v), expected bye and EOF", got, err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read after Close returned %v, expected net.ErrClosed", err)
+	}
+
+	// the client closes a conn
+	client = dialConn(t, hostport, params)
+	conn = accept(t, l)
+	client.Write([]byte("see you"))
+	if err := client.Close(); err != nil {
+		t.Fatalf("Client Close returned %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "see you" {
+		t.Fatalf("Conn ReadAll returned (%q, %v), expected see you and EOF", got, err)
+	}
+	conn.Close()
+
+	// closing the listener unblocks Accept
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		acceptErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Listener Close returned %v", err)
+	}
+	select {
+	case err := <-acceptErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Accept returned %v, expected net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close didn't unblock Accept")
+	}
+}
+
+func TestListenerConnFull(t *testing.T) {
+	fmt.Printf("=== TestListenerConnFull: a full conn holds back its own client, not the others\n")
+	params := &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 8, MaxUnreadMessages: 8}
+	l, hostport := startListener(t, params)
+	defer l.Close()
+	client := dialConn(t, hostport, params)
+	defer client.Close()
+	conn := accept(t, l).(*listenerConn)
+	other := dialConn(t, hostport, params)
+	defer other.Close()
+	otherConn := accept(t, l)
+
+	numMsgs := 2 * maxConnMessages
+	for i := 0; i < numMsgs; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	conn.mu.Lock()
+	held := len(conn.messages)
+	conn.mu.Unlock()
+	if held > maxConnMessages+1 { //one may have been on its way already
+		t.Fatalf("Conn holds %d messages, expected no more than %d", held, maxConnMessages+1)
+	}
+
+	other.Write([]byte("hello"))
+	otherConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	if n, err := otherConn.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Other conn read (%q, %v) while the first was full, expected its message", b[:n], err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, numMsgs)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Conn read returned %v", err)
+	}
+	for i, b := range got {
+		if int(b) != i {
+			t.Fatalf("Conn read %d at %d, expected the messages in order", b, i)
+		}
+	}
+}
+
+// eventlessServer is a server whose events never come.
+type eventlessServer struct {
+	Server
+}
+
+func (eventlessServer) Events() <-chan ConnEvent {
+	return make(chan ConnEvent)
+}
+
+func TestListenerWithoutEvents(t *testing.T) {
+	fmt.Printf("=== TestListenerWithoutEvents: a client is accepted once it sends, events or not\n")
+	params := makeParams(5, 100, 4)
+	server, port := startSecureServer(t, params)
+	l := NewListener(eventlessServer{server})
+	defer l.Close()
+	client := dialConn(t, lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), params)
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	conn := accept(t, l)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Conn read (%q, %v), expected the client's message", b[:n], err)
+	}
+}
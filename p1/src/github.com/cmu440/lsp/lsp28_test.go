@@ -0,0 +1,103 @@
+// LSP timer benchmarks.
+
+// These benchmarks measure what keeping time costs an endpoint: how many
+// goroutines a server and its clients run and how much CPU they use per epoch
+// while every connection is idle, and while every window is full of messages
+// that are never acked and so are retransmitted until the end. Run them with
+// a fixed number of epochs, like -bench Timers -benchtime 50x.
+
+package lsp
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// deafTransport stops reading packets once deaf is set, dropping whatever
+// comes in, so that nothing sent to it is acked any more.
+type deafTransport struct {
+	PacketTransport
+	deaf *atomic.Bool
+}
+
+func (t *deafTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := t.PacketTransport.ReadFrom(b)
+		if err != nil || !t.deaf.Load() {
+			return n, addr, err
+		}
+	}
+}
+
+// cpuTime returns the CPU time used by the process so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatalf("Getrusage returned %v", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkTimers connects numClients clients to a server over an in-memory
+// network and sleeps b.N epochs, reporting the goroutines running and the
+// CPU time used per epoch. With unacked set, both ends stop listening once
+// connected and fill every window with messages first.
+func benchmarkTimers(b *testing.B, numClients int, unacked bool) {
+	const epochMillis = 10
+	params := makeParams(1000000, epochMillis, 8) //never lost
+	deaf := new(atomic.Bool)
+	network := newMemNetwork()
+	before := runtime.NumGoroutine()
+	server, err := NewServerTransport(&deafTransport{network.listen("server"), deaf}, params)
+	if err != nil {
+		b.Fatalf("NewServerTransport returned %v", err)
+	}
+	clients := make([]Client, numClients)
+	for i := range clients {
+		transport := &deafTransport{network.listen("client " + strconv.Itoa(i)), deaf}
+		clients[i], err = NewClientTransport(transport, memAddr("server"), params)
+		if err != nil {
+			b.Fatalf("Client %d failed to connect: %s", i, err)
+		}
+	}
+	if unacked {
+		deaf.Store(true)
+		for _, cli := range clients {
+			for i := 0; i < params.WindowSize; i++ {
+				cli.Write([]byte("unacked"))
+				server.Write(cli.ConnID(), []byte("unacked"))
+			}
+		}
+	}
+	time.Sleep(2 * epochMillis * time.Millisecond) //let the writes settle
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(epochMillis * time.Millisecond)
+	}
+	used := cpuTime(b) - start
+	b.StopTimer()
+	b.ReportMetric(float64(runtime.NumGoroutine()-before), "goroutines")
+	b.ReportMetric(float64(used.Microseconds())/float64(b.N), "cpu-µs/epoch")
+	abandon, cancel := context.WithCancel(context.Background())
+	cancel() //the unacked messages would never be acked
+	for _, cli := range clients {
+		cli.CloseContext(abandon)
+	}
+	server.CloseContext(abandon)
+}
+
+func BenchmarkTimersIdle(b *testing.B) {
+	benchmarkTimers(b, 100, false)
+}
+
+func BenchmarkTimersUnacked(b *testing.B) {
+	benchmarkTimers(b, 100, true)
+}
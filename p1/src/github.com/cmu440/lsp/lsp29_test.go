@@ -0,0 +1,135 @@
+// LSP server dispatch tests.
+
+// These tests check that the table a server looks its clients up in finds
+// them by connID and by address, follows a client that moved and forgets
+// one that was removed without forgetting a client that moved to its old
+// address. The benchmarks measure what looking up the client of a packet
+// costs with 1,000 clients connected, and how many messages a server reads
+// per second from 1,000 clients sending at once.
+
+package lsp
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestClientTable(t *testing.T) {
+	table := newClientTable()
+	clients := make([]*s_client, 3)
+	for i := range clients {
+		clients[i] = &s_client{connID: i + 1}
+		clients[i].moveTo(memAddr("client " + strconv.Itoa(i+1)))
+		table.add(clients[i])
+	}
+	for i, sClient := range clients {
+		if got := table.get(i + 1); got != sClient {
+			t.Fatalf("get(%d) returned connection %v", i+1, got)
+		}
+		if got := table.at(sClient.remote()); got != sClient {
+			t.Fatalf("at(%s) returned connection %v", sClient.remote(), got)
+		}
+	}
+	if table.get(4) != nil || table.at(memAddr("nobody")) != nil {
+		t.Fatalf("Found a client that was never added")
+	}
+
+	// client 1 moves, client 2 takes over its old address
+	table.move(clients[0], memAddr("elsewhere"))
+	if table.at(memAddr("client 1")) != nil || table.at(memAddr("elsewhere")) != clients[0] {
+		t.Fatalf("Client 1 not found at its new address only")
+	}
+	table.move(clients[1], memAddr("client 1"))
+	if left := table.remove(1); left != 2 {
+		t.Fatalf("remove left %d clients, expected 2", left)
+	}
+	if table.get(1) != nil || table.at(memAddr("elsewhere")) != nil {
+		t.Fatalf("Client 1 still found after it was removed")
+	}
+	if table.at(memAddr("client 1")) != clients[1] {
+		t.Fatalf("Client 2 not found at the address it moved to")
+	}
+	all := table.all()
+	if len(all) != 2 || all[0] != clients[1] || all[1] != clients[2] || table.len() != 2 {
+		t.Fatalf("all returned %d clients, expected clients 2 and 3 in order", len(all))
+	}
+}
+
+// startClients connects numClients clients to a new server over an
+// in-memory network that doesn't lose packets to the server.
+func startClients(b *testing.B, numClients int, params *Params) (Server, []Client) {
+	network := newMemNetwork()
+	network.inboxSize = 4 * numClients
+	server, err := NewServerTransport(network.listen("server"), params)
+	if err != nil {
+		b.Fatalf("NewServerTransport returned %v", err)
+	}
+	clients := make([]Client, numClients)
+	for i := range clients {
+		clients[i], err = NewClientTransport(network.listen("client "+strconv.Itoa(i)), memAddr("server"), params)
+		if err != nil {
+			b.Fatalf("Client %d failed to connect: %s", i, err)
+		}
+	}
+	return server, clients
+}
+
+// abandon closes the clients and the server without waiting for acks
+func abandon(server Server, clients []Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, cli := range clients {
+		cli.CloseContext(ctx)
+	}
+	server.CloseContext(ctx)
+}
+
+// BenchmarkLookupClient1000 looks up the clients that 1,000 connections'
+// packets belong to, as readRoutine does for each packet it reads.
+func BenchmarkLookupClient1000(b *testing.B) {
+	srv, clients := startClients(b, 1000, makeParams(20, 500, 8))
+	defer abandon(srv, clients)
+	s := srv.(*server)
+	messages := make([]*Message, len(clients))
+	for i, cli := range clients {
+		messages[i] = NewAck(cli.ConnID(), 0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(clients)
+		if s.lookupClient(messages[j], memAddr("client "+strconv.Itoa(j))) == nil {
+			b.Fatalf("Client %d not found", j)
+		}
+	}
+}
+
+// BenchmarkDispatch1000 has 1,000 clients each write b.N messages at once,
+// and reports how many the server reads a second.
+func BenchmarkDispatch1000(b *testing.B) {
+	const numClients = 1000
+	server, clients := startClients(b, numClients, makeParams(20, 500, 8))
+	defer abandon(server, clients)
+	payload := []byte("dispatch me")
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for _, cli := range clients {
+		wg.Add(1)
+		go func(cli Client) {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				cli.Write(payload)
+			}
+		}(cli)
+	}
+	for i := 0; i < b.N*numClients; i++ {
+		if _, _, err := server.Read(); err != nil {
+			b.Fatalf("Server Read returned %v", err)
+		}
+	}
+	b.StopTimer()
+	wg.Wait()
+	b.ReportMetric(float64(b.N*numClients)/b.Elapsed().Seconds(), "msgs/s")
+}
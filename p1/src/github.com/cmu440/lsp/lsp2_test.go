@@ -504,6 +504,10 @@ func (ts *windowTestSystem) runMessageOrderTest() {
 // 2 epochs for grace time to compensate any time skew
 const ExponentialBackOffTestEpochToListen = 14
 
+// runExponentialBackOffTest advances the FakeClock the server and clients run
+// on an epoch at a time, waiting before and after each until the timer wheel
+// of every one of them sleeps on the one timer it keeps, rather than waiting
+// for the epochs to pass.
 func (ts *windowTestSystem) runExponentialBackOffTest() {
 	numClients := ts.numClients
 	numMsgs := ts.numMsgs
@@ -516,15 +520,36 @@ func (ts *windowTestSystem) runExponentialBackOffTest() {
 	if wsize >= numMsgs {
 		ts.t.Fatal("Number of messages must be greater than the window size.")
 	}
+	fc, ok := ts.params.Clock.(*FakeClock)
+	if !ok {
+		ts.t.Fatal("Params must run on a FakeClock.")
+	}
+	numWheels := numClients + 1 // one per endpoint
 
 	ts.t.Logf("Testing client to server...")
 	ts.setServerWriteDropPercent(100) // Don't let server send acks.
 	lspnet.StartSniff()
+	// a Write is taken by the client only once it has sent what the ones
+	// before filled its window with, so the windows are out before the clock
+	// first moves
 	for connID, cli := range ts.clientMap {
-		go ts.streamToServer(connID, cli, ts.clientSendMsgs)
+		for i, msg := range ts.clientSendMsgs {
+			if err := cli.Write([]byte(msg)); err != nil {
+				ts.t.Fatalf("Client %d failed to write message %d of %d: %s", connID, i+1, numMsgs, err)
+			}
+		}
+	}
+	for epoch := 0; epoch < ExponentialBackOffTestEpochToListen; epoch++ {
+		blockUntilExactly(fc, numWheels)
+		fc.Advance(time.Millisecond * time.Duration(epochLen))
 	}
-	time.Sleep(time.Millisecond * time.Duration(epochLen*ExponentialBackOffTestEpochToListen))
+	blockUntilExactly(fc, numWheels)
 	var sniffRes = lspnet.StopSniff()
+	clients := make([]Client, 0, numClients)
+	for _, cli := range ts.clientMap {
+		clients = append(clients, cli)
+	}
+	abandon(ts.server, clients) // the rest of the messages would be sent once acks get through
 	if sniffRes.NumSentData > wsize*numClients*6 || sniffRes.NumSentData < wsize*numClients*4 {
 		ts.t.Log(sniffRes)
 		ts.t.Fatalf("Number of trying messages does not match: expected [%d, %d], got %d",
@@ -533,56 +558,56 @@ func (ts *windowTestSystem) runExponentialBackOffTest() {
 }
 
 func TestExpBackOff1(t *testing.T) {
-	newWindowTestSystem(t, doExponentialBackOff, 1, 10, &Params{100, 2000, 5, 4}).
+	newWindowTestSystem(t, doExponentialBackOff, 1, 10, &Params{EpochLimit: 100, EpochMillis: 2000, WindowSize: 5, MaxBackOffInterval: 4, Clock: NewFakeClock(time.Now())}).
 		setDescription("TestExpBackOff1: 1 clients, backoff test").
 		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
 		runTest()
 }
 
 func TestExpBackOff2(t *testing.T) {
-	newWindowTestSystem(t, doExponentialBackOff, 10, 15, &Params{100, 2000, 5, 4}).
+	newWindowTestSystem(t, doExponentialBackOff, 10, 15, &Params{EpochLimit: 100, EpochMillis: 2000, WindowSize: 5, MaxBackOffInterval: 4, Clock: NewFakeClock(time.Now())}).
 		setDescription("TestExpBackOff2: 10 clients, backoff test").
 		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
 		runTest()
 }
 
 func TestWindow1(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 1, 10, &Params{3, 500, 5, 0}).
+	newWindowTestSystem(t, doMaxCapacity, 1, 10, &Params{EpochLimit: 3, EpochMillis: 500, WindowSize: 5, MaxBackOffInterval: 0}).
 		setDescription("TestWindow1: 1 client, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow2(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 5, 25, &Params{3, 500, 10, 0}).
+	newWindowTestSystem(t, doMaxCapacity, 5, 25, &Params{EpochLimit: 3, EpochMillis: 500, WindowSize: 10, MaxBackOffInterval: 0}).
 		setDescription("TestWindow2: 5 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow3(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 10, 25, &Params{3, 500, 10, 0}).
+	newWindowTestSystem(t, doMaxCapacity, 10, 25, &Params{EpochLimit: 3, EpochMillis: 500, WindowSize: 10, MaxBackOffInterval: 0}).
 		setDescription("TestWindow3: 10 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow4(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 1, 10, &Params{3, 1000, 20, 0}).
+	newWindowTestSystem(t, doScatteredMsgs, 1, 10, &Params{EpochLimit: 3, EpochMillis: 1000, WindowSize: 20, MaxBackOffInterval: 0}).
 		setDescription("TestWindow4: 1 client, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow5(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 5, 10, &Params{3, 1000, 20, 0}).
+	newWindowTestSystem(t, doScatteredMsgs, 5, 10, &Params{EpochLimit: 3, EpochMillis: 1000, WindowSize: 20, MaxBackOffInterval: 0}).
 		setDescription("TestWindow5: 5 clients, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow6(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 10, 10, &Params{3, 1000, 20, 0}).
+	newWindowTestSystem(t, doScatteredMsgs, 10, 10, &Params{EpochLimit: 3, EpochMillis: 1000, WindowSize: 20, MaxBackOffInterval: 0}).
 		setDescription("TestWindow6: 10 clients, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
@@ -591,7 +616,7 @@ func TestWindow6(t *testing.T) {
 func TestOutOfOrderMsg1(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 1, 10, &Params{3, 5000, 30, 0}).
+	newWindowTestSystem(t, doMessageOrder, 1, 10, &Params{EpochLimit: 3, EpochMillis: 5000, WindowSize: 30, MaxBackOffInterval: 0}).
 		setDescription("TestOutOfOrderMsg1: 1 client, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
@@ -600,7 +625,7 @@ func TestOutOfOrderMsg1(t *testing.T) {
 func TestOutOfOrderMsg2(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 5, 25, &Params{3, 5000, 30, 0}).
+	newWindowTestSystem(t, doMessageOrder, 5, 25, &Params{EpochLimit: 3, EpochMillis: 5000, WindowSize: 30, MaxBackOffInterval: 0}).
 		setDescription("TestOutOfOrderMsg2: 5 clients, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
@@ -609,7 +634,7 @@ func TestOutOfOrderMsg2(t *testing.T) {
 func TestOutOfOrderMsg3(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 10, 25, &Params{3, 5000, 30, 0}).
+	newWindowTestSystem(t, doMessageOrder, 10, 25, &Params{EpochLimit: 3, EpochMillis: 5000, WindowSize: 30, MaxBackOffInterval: 0}).
 		setDescription("TestOutOfOrderMsg3: 10 clients, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
@@ -0,0 +1,213 @@
+// LSP fake clock tests.
+
+// These tests check that a FakeClock fires timers only once it is advanced
+// past them, and that endpoints running on one keep their epochs by it: a
+// connection is lost exactly when EpochLimit epochs have been advanced
+// without hearing from the peer, and an unacked message is retransmitted
+// with exponential backoff on exactly the epochs it should be, without the
+// test waiting for any of them.
+
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEpoch is long enough that nothing the tests wait for in real time
+// could pass for an epoch.
+const fakeEpoch = time.Second
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	fc := NewFakeClock(start)
+	timer := fc.NewTimer(2 * time.Second)
+	called := make(chan time.Time, 1)
+	fc.AfterFunc(2*time.Second+time.Second/2, func() { called <- fc.Now() })
+	stopped := fc.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("Stop didn't tell a pending timer from a stopped one")
+	}
+
+	fc.Advance(time.Second + time.Second/2)
+	select {
+	case <-timer.C():
+		t.Fatalf("Timer fired before it was due")
+	case <-stopped.C():
+		t.Fatalf("Stopped timer fired")
+	default:
+	}
+	fc.Advance(time.Second)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(2 * time.Second)) {
+			t.Fatalf("Timer fired at %s, expected its due time", now.Sub(start))
+		}
+	default:
+		t.Fatalf("Timer didn't fire once it was due")
+	}
+	select {
+	case now := <-called:
+		if !now.Equal(start.Add(2*time.Second + time.Second/2)) {
+			t.Fatalf("AfterFunc read %s, expected the time Advance stopped at", now.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AfterFunc didn't call its function")
+	}
+
+	// Reset drops a time nobody received and fires again later
+	timer.Reset(time.Second)
+	fc.Advance(time.Second)
+	timer.Reset(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("Reset left the time of the last firing to be received")
+	default:
+	}
+	doneChan := make(chan int)
+	go func() {
+		fc.BlockUntil(2)
+		close(doneChan)
+	}()
+	select {
+	case <-doneChan:
+		t.Fatalf("BlockUntil returned with a single timer pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fc.NewTimer(time.Second)
+	select {
+	case <-doneChan:
+	case <-time.After(time.Second):
+		t.Fatalf("BlockUntil didn't return once two timers were pending")
+	}
+}
+
+// dataCounter counts the data messages written through a transport.
+type dataCounter struct {
+	PacketTransport
+	data atomic.Int64
+}
+
+func (t *dataCounter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var message Message
+	if decode(b, &message) == nil && message.Type == MsgData {
+		t.data.Add(1)
+	}
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+// startFakeClock connects a client to a server over an in-memory network,
+// both running on a new FakeClock. NewClient returns once both have started
+// their epochs. Once serverDeaf or clientDeaf is set, the server or the client
+// reads nothing more.
+func startFakeClock(t *testing.T, params *Params) (*FakeClock, Server, Client, *dataCounter, *atomic.Bool, *atomic.Bool) {
+	fc := NewFakeClock(time.Unix(1000, 0))
+	params.Clock = fc
+	network := newMemNetwork()
+	serverDeaf, clientDeaf := new(atomic.Bool), new(atomic.Bool)
+	server, err := NewServerTransport(&deafTransport{network.listen("server"), serverDeaf}, params)
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	counter := &dataCounter{PacketTransport: &deafTransport{network.listen("client"), clientDeaf}}
+	cli, err := NewClientTransport(counter, memAddr("server"), params)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	return fc, server, cli, counter, serverDeaf, clientDeaf
+}
+
+// blockUntilExactly waits until exactly n timers are pending, unlike
+// BlockUntil which takes any n or more.
+func blockUntilExactly(fc *FakeClock, n int) {
+	for {
+		fc.mu.Lock()
+		pending, changedChan := len(fc.timers), fc.changedChan
+		fc.mu.Unlock()
+		if pending == n {
+			return
+		}
+		<-changedChan
+	}
+}
+
+// advanceEpoch waits until the timer wheels of both endpoints sleep, each on
+// the one timer it keeps, moves the clock on by an epoch and waits until they
+// have done what came due and sleep again.
+func advanceEpoch(fc *FakeClock) {
+	blockUntilExactly(fc, 2)
+	fc.Advance(fakeEpoch)
+	blockUntilExactly(fc, 2)
+}
+
+func TestFakeClockEpochLimit(t *testing.T) {
+	fmt.Printf("=== TestFakeClockEpochLimit: a silent server is lost after exactly EpochLimit epochs\n")
+	params := makeParams(5, int(fakeEpoch/time.Millisecond), 1)
+	fc, server, cli, _, serverDeaf, clientDeaf := startFakeClock(t, params)
+	defer server.CloseContext(canceledContext())
+	defer cli.CloseContext(canceledContext())
+	serverDeaf.Store(true)
+	clientDeaf.Store(true)
+
+	started := time.Now()
+	for epoch := 1; epoch < params.EpochLimit; epoch++ {
+		advanceEpoch(fc)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cli.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Read after %d epochs returned %v, expected the connection to be up", params.EpochLimit-1, err)
+	}
+	advanceEpoch(fc)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := cli.ReadContext(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("Read after %d epochs returned %v, expected the connection to be lost", params.EpochLimit, err)
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Fatalf("%d epochs took %s", params.EpochLimit, took)
+	}
+}
+
+func TestFakeClockBackOff(t *testing.T) {
+	fmt.Printf("=== TestFakeClockBackOff: an unacked message is sent on epochs 0, 1, 3, 6, 11 and 16\n")
+	params := makeParams(100, int(fakeEpoch/time.Millisecond), 1)
+	params.MaxBackOffInterval = 4
+	fc, server, cli, counter, serverDeaf, _ := startFakeClock(t, params)
+	defer server.CloseContext(canceledContext())
+	defer cli.CloseContext(canceledContext())
+	serverDeaf.Store(true) //no acks, the server's heartbeats still get through
+
+	if err := cli.Write([]byte("never acked")); err != nil {
+		t.Fatalf("Write returned %v", err)
+	}
+	cli.ConnID() //answered once mainRoutine sent the message
+	if got := counter.data.Load(); got != 1 {
+		t.Fatalf("Client sent the message %d times on epoch 0, expected once", got)
+	}
+
+	sends := map[int]bool{1: true, 3: true, 6: true, 11: true, 16: true}
+	expected := int64(1)
+	for epoch := 1; epoch <= 18; epoch++ {
+		advanceEpoch(fc)
+		if sends[epoch] {
+			expected += 1
+		}
+		if got := counter.data.Load(); got != expected {
+			t.Fatalf("Client sent the message %d times by epoch %d, expected %d", got, epoch, expected)
+		}
+	}
+}
+
+// canceledContext returns a context that is done already, to close without
+// waiting for acks.
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
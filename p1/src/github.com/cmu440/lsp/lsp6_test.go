@@ -0,0 +1,161 @@
+// LSP context tests.
+
+// These tests check that ReadContext, WriteContext and CloseContext return
+// as soon as their context is done, and that giving up on a Close unwinds
+// every background goroutine instead of leaking it.
+
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type contextTestSystem struct {
+	t      *testing.T
+	server Server
+	client Client
+	params *Params
+}
+
+func newContextTestSystem(t *testing.T, params *Params) *contextTestSystem {
+	ts := &contextTestSystem{t: t, params: params}
+	const numTries = 5
+	var port int
+	var err error
+	for i := 0; i < numTries && ts.server == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		ts.server, err = NewServer(port, params)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	ts.client, err = NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect to server on port %d: %s.", port, err)
+	}
+	return ts
+}
+
+// waitForGoroutines fails the test if the number of running goroutines does
+// not drop back to at most n before the timeout expires.
+func (ts *contextTestSystem) waitForGoroutines(n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			ts.t.Fatalf("Leaked goroutines: %d running, expected at most %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadContext1(t *testing.T) {
+	fmt.Printf("=== TestReadContext1: Read gives up once its context is done\n")
+	ts := newContextTestSystem(t, makeParams(5, 500, 1))
+	defer ts.server.Close()
+	defer ts.client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := ts.client.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Client ReadContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	connID, _, err := ts.server.ReadContext(ctx)
+	if err != context.DeadlineExceeded || connID != 0 {
+		t.Fatalf("Server ReadContext returned (%d, %v), expected (0, %v)", connID, err, context.DeadlineExceeded)
+	}
+
+	// A read that gave up must not swallow the next message.
+	if err := ts.client.WriteContext(context.Background(), []byte("hello")); err != nil {
+		t.Fatalf("Client WriteContext returned %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	connID, data, err := ts.server.ReadContext(ctx)
+	if err != nil || string(data) != "hello" || connID != ts.client.ConnID() {
+		t.Fatalf("Server ReadContext returned (%d, %s, %v)", connID, data, err)
+	}
+}
+
+func TestWriteContext1(t *testing.T) {
+	fmt.Printf("=== TestWriteContext1: Write with a done context is not sent\n")
+	ts := newContextTestSystem(t, makeParams(5, 500, 1))
+	defer ts.server.Close()
+	defer ts.client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ts.client.WriteContext(ctx, []byte("x")); err != context.Canceled {
+		t.Fatalf("Client WriteContext returned %v, expected %v", err, context.Canceled)
+	}
+	if err := ts.server.WriteContext(ctx, ts.client.ConnID(), []byte("x")); err != context.Canceled {
+		t.Fatalf("Server WriteContext returned %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestCloseContextClient(t *testing.T) {
+	fmt.Printf("=== TestCloseContextClient: client Close gives up on unacked messages\n")
+	defer lspnet.ResetDropPercent()
+	numGoroutines := runtime.NumGoroutine()
+	ts := newContextTestSystem(t, makeParams(20, 500, 5))
+
+	lspnet.SetClientWriteDropPercent(100)
+	for i := 0; i < 3; i++ {
+		if err := ts.client.Write([]byte("lost")); err != nil {
+			t.Fatalf("Client Write returned %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ts.client.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Client CloseContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Client CloseContext took %s after its deadline", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	ts.server.CloseContext(ctx)
+	ts.waitForGoroutines(numGoroutines, 2*time.Second)
+}
+
+func TestCloseContextServer(t *testing.T) {
+	fmt.Printf("=== TestCloseContextServer: server Close gives up on unacked messages\n")
+	defer lspnet.ResetDropPercent()
+	numGoroutines := runtime.NumGoroutine()
+	ts := newContextTestSystem(t, makeParams(20, 500, 5))
+
+	connID := ts.client.ConnID()
+	lspnet.SetServerWriteDropPercent(100)
+	for i := 0; i < 3; i++ {
+		if err := ts.server.Write(connID, []byte("lost")); err != nil {
+			t.Fatalf("Server Write returned %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ts.server.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Server CloseContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Server CloseContext took %s after its deadline", elapsed)
+	}
+	// the server is gone, so the client can't get its close acked either
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	ts.client.CloseContext(ctx)
+	ts.waitForGoroutines(numGoroutines, 2*time.Second)
+}
@@ -0,0 +1,223 @@
+// LSP codec tests.
+
+// These tests check that the binary codec encodes and decodes every message
+// field, and that the connect handshake only switches a connection to the
+// binary codec when both the client and the server ask for it, so that peers
+// that only speak JSON can still talk to peers that prefer binary. A packet
+// that decodes in neither codec isn't taken for a sign of life.
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type codecTestSystem struct {
+	t      *testing.T
+	server Server
+	client Client
+}
+
+func newCodecTestSystem(t *testing.T, serverCodec, clientCodec Codec) *codecTestSystem {
+	ts := &codecTestSystem{t: t}
+	serverParams := makeParams(5, 500, 2)
+	serverParams.Codec = serverCodec
+	clientParams := makeParams(5, 500, 2)
+	clientParams.Codec = clientCodec
+
+	const numTries = 5
+	var port int
+	var err error
+	for i := 0; i < numTries && ts.server == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		ts.server, err = NewServer(port, serverParams)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	ts.client, err = NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), clientParams)
+	if err != nil {
+		t.Fatalf("Client failed to connect to server on port %d: %s.", port, err)
+	}
+	return ts
+}
+
+// echo writes a few messages from the client, has the server echo them back
+// and checks that the client reads them back unchanged and in order.
+func (ts *codecTestSystem) echo(numMsgs int) {
+	go func() {
+		for i := 0; i < numMsgs; i++ {
+			connID, data, err := ts.server.Read()
+			if err != nil {
+				return
+			}
+			ts.server.Write(connID, data)
+		}
+	}()
+	for i := 0; i < numMsgs; i++ {
+		sent := []byte("message " + strconv.Itoa(i))
+		if err := ts.client.Write(sent); err != nil {
+			ts.t.Fatalf("Client Write returned %v", err)
+		}
+		readChan := make(chan []byte, 1)
+		go func() {
+			data, _ := ts.client.Read()
+			readChan <- data
+		}()
+		select {
+		case data := <-readChan:
+			if !bytes.Equal(data, sent) {
+				ts.t.Fatalf("Client read %q, expected %q", data, sent)
+			}
+		case <-time.After(5 * time.Second):
+			ts.t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+}
+
+func (ts *codecTestSystem) close() {
+	ts.client.Close()
+	ts.server.Close()
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	payload := []byte("binary payload")
+	msgs := []*Message{
+		NewConnect(),
+		NewData(7, 42, len(payload), payload, makeCheckSum(7, 42, len(payload), payload)),
+		NewData(3, 1, 0, nil, makeCheckSum(3, 1, 0, nil)),
+		NewAck(-1, 0),
+		{Type: MsgAck, ConnID: 9, Codec: CodecBinary},
+		{Type: MsgData, ConnID: 5, SeqNum: -1, Size: 3, Checksum: makeCheckSum(5, -1, 3, []byte("abc"), 2, 4, 6, 8, 2), Payload: []byte("abc"),
+			Codec: CodecBinary, Features: 7, FragIndex: 2, FragCount: 4, SackBits: 1 << 63, Window: -2,
+			Token: 1<<64 - 1, Stream: 6, StreamSeq: 8, Mode: 2, Digest: 42, EpochLimit: 5,
+			EpochMillis: 2000, WindowSize: 32},
+	}
+	for _, msg := range msgs {
+		b := marshalBinary(msg)
+		var got Message
+		if err := decode(b, &got); err != nil {
+			t.Fatalf("decode(%s) returned %v", msg, err)
+		}
+		if !bytes.Equal(got.Payload, msg.Payload) {
+			t.Fatalf("Round trip of %s gave %s", msg, &got)
+		}
+		got.Payload = msg.Payload
+		if !reflect.DeepEqual(&got, msg) {
+			t.Fatalf("Round trip of %+v gave %+v", msg, &got)
+		}
+		if !integrityCheck(&got, nil) {
+			t.Fatalf("Round trip of %s failed the integrity check", msg)
+		}
+	}
+}
+
+func TestBinaryCodecSmaller(t *testing.T) {
+	small := []byte("hi")
+	large := bytes.Repeat([]byte{0xab}, 1000)
+	msgs := []*Message{
+		NewAck(1, 1),
+		NewAck(1, 0),
+		NewData(1, 1, len(small), small, makeCheckSum(1, 1, len(small), small)),
+		NewData(1, 1, len(large), large, makeCheckSum(1, 1, len(large), large)),
+	}
+	for _, msg := range msgs {
+		jsonBytes, _ := marshal(msg)
+		binaryBytes := marshalBinary(msg)
+		if len(binaryBytes) >= len(jsonBytes) {
+			t.Fatalf("Binary encoding of %s is %d bytes, JSON encoding is %d bytes", msg, len(binaryBytes), len(jsonBytes))
+		}
+	}
+	if n := len(marshalBinary(NewAck(1, 1))); n != binaryHeaderSize {
+		t.Fatalf("Binary encoding of an ack is %d bytes, expected %d", n, binaryHeaderSize)
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	payload := []byte("truncate me")
+	b := marshalBinary(NewData(1, 1, len(payload), payload, 0))
+	var msg Message
+	if err := decode(b[:len(b)-1], &msg); err == nil {
+		t.Fatalf("decode accepted a truncated payload")
+	}
+	if err := decode(b[:binaryHeaderSize-1], &msg); err == nil {
+		t.Fatalf("decode accepted a truncated header")
+	}
+	if err := decode(append(b[:len(b):len(b)], 0), &msg); err == nil {
+		t.Fatalf("decode accepted trailing bytes")
+	}
+	b[1] = binaryVersion + 1
+	if err := decode(b, &msg); err == nil {
+		t.Fatalf("decode accepted an unknown version")
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	tests := []struct {
+		server, client, expected Codec
+	}{
+		{CodecBinary, CodecBinary, CodecBinary},
+		{CodecJSON, CodecBinary, CodecJSON},
+		{CodecBinary, CodecJSON, CodecJSON},
+		{CodecJSON, CodecJSON, CodecJSON},
+	}
+	for _, test := range tests {
+		fmt.Printf("=== TestCodecNegotiation: %s server, %s client\n", test.server, test.client)
+		ts := newCodecTestSystem(t, test.server, test.client)
+		ts.client.ConnID() // a round trip through mainRoutine, which owns the codec
+		if codec := ts.client.(*client).codec; codec != test.expected {
+			t.Fatalf("%s server and %s client agreed on %s, expected %s",
+				test.server, test.client, codec, test.expected)
+		}
+		ts.echo(5)
+		ts.close()
+	}
+}
+
+func TestUndecodableNotHeard(t *testing.T) {
+	fmt.Printf("=== TestUndecodableNotHeard: a server heard from only as junk is lost\n")
+	params := makeParams(3, 50, 1)
+	network := newMemNetwork()
+	deaf := new(atomic.Bool)
+	server, err := NewServerTransport(&deafTransport{network.listen("server"), deaf}, params)
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	cli, err := NewClientTransport(network.listen("client"), memAddr("server"), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer abandon(server, []Client{cli})
+	deaf.Store(true) //the server loses the client and goes quiet
+
+	// the client takes whatever it reads to come from the server
+	junk := network.listen("junk")
+	defer junk.Close()
+	go func() {
+		for {
+			if _, err := junk.WriteTo([]byte("{not a message"), memAddr("client")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.ReadContext(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("Read returned %v, expected the connection to be lost", err)
+	}
+}
@@ -0,0 +1,197 @@
+// LSP fragmentation tests.
+
+// These tests check that payloads larger than a single datagram are split
+// into fragments by Write, survive packet loss and reordering, and are
+// reassembled into the original payload before Read returns them.
+
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type fragmentTestSystem struct {
+	t      *testing.T
+	server Server
+	client Client
+}
+
+func newFragmentTestSystem(t *testing.T, params *Params) *fragmentTestSystem {
+	ts := &fragmentTestSystem{t: t}
+	const numTries = 5
+	var port int
+	var err error
+	for i := 0; i < numTries && ts.server == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		ts.server, err = NewServer(port, params)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	ts.client, err = NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), params)
+	if err != nil {
+		t.Fatalf("Client failed to connect to server on port %d: %s.", port, err)
+	}
+	return ts
+}
+
+func randPayload(size int) []byte {
+	payload := make([]byte, size)
+	rand.Read(payload)
+	return payload
+}
+
+// roundTrip writes each payload from the client, has the server check and
+// echo it, and checks the echoed payloads on the client.
+func (ts *fragmentTestSystem) roundTrip(payloads [][]byte, timeout time.Duration) {
+	serverErrChan := make(chan error, 1)
+	go func() {
+		for _, expected := range payloads {
+			connID, data, err := ts.server.Read()
+			if err != nil {
+				serverErrChan <- err
+				return
+			}
+			if !bytes.Equal(data, expected) {
+				serverErrChan <- fmt.Errorf("server read %d bytes, expected %d bytes", len(data), len(expected))
+				return
+			}
+			ts.server.Write(connID, data)
+		}
+		serverErrChan <- nil
+	}()
+	clientErrChan := make(chan error, 1)
+	go func() {
+		for _, payload := range payloads {
+			if err := ts.client.Write(payload); err != nil {
+				clientErrChan <- err
+				return
+			}
+		}
+		for _, expected := range payloads {
+			data, err := ts.client.Read()
+			if err != nil {
+				clientErrChan <- err
+				return
+			}
+			if !bytes.Equal(data, expected) {
+				clientErrChan <- fmt.Errorf("client read %d bytes, expected %d bytes", len(data), len(expected))
+				return
+			}
+		}
+		clientErrChan <- nil
+	}()
+	timeoutChan := time.After(timeout)
+	for _, errChan := range []chan error{serverErrChan, clientErrChan} {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				ts.t.Fatalf("Round trip failed: %s", err)
+			}
+		case <-timeoutChan:
+			ts.t.Fatalf("Test timed out after %s", timeout)
+		}
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	payload := randPayload(2500)
+	fragments := splitPayload(payload, 1000)
+	if len(fragments) != 3 || len(fragments[2]) != 500 {
+		t.Fatalf("Split 2500 bytes into %d fragments", len(fragments))
+	}
+	if !bytes.Equal(bytes.Join(fragments, nil), payload) {
+		t.Fatalf("Fragments don't join back into the payload")
+	}
+	if fragments := splitPayload(payload[:1000], 1000); len(fragments) != 1 {
+		t.Fatalf("Split a payload that fits into %d fragments", len(fragments))
+	}
+}
+
+func TestFragmentedMsg1(t *testing.T) {
+	fmt.Printf("=== TestFragmentedMsg1: large payloads, window size 1\n")
+	ts := newFragmentTestSystem(t, makeParams(5, 200, 1))
+	ts.roundTrip([][]byte{randPayload(5000), []byte("small"), randPayload(DefaultMaxFragmentSize)}, 10*time.Second)
+}
+
+func TestFragmentedMsg2(t *testing.T) {
+	fmt.Printf("=== TestFragmentedMsg2: large payloads, window size 4, binary codec\n")
+	params := makeParams(5, 200, 4)
+	params.Codec = CodecBinary
+	params.MaxFragmentSize = 300
+	ts := newFragmentTestSystem(t, params)
+	ts.roundTrip([][]byte{randPayload(20000), randPayload(1), randPayload(3000)}, 10*time.Second)
+}
+
+func TestFragmentedMsg3(t *testing.T) {
+	fmt.Printf("=== TestFragmentedMsg3: large payloads, 20%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	ts := newFragmentTestSystem(t, makeParams(20, 100, 5))
+	lspnet.SetWriteDropPercent(20)
+	ts.roundTrip([][]byte{randPayload(12000), randPayload(7000)}, 20*time.Second)
+}
+
+func TestFragmentedMsgTooLarge(t *testing.T) {
+	fmt.Printf("=== TestFragmentedMsgTooLarge: Write rejects payloads above MaxMessageSize\n")
+	params := makeParams(5, 200, 1)
+	params.MaxMessageSize = 4096
+	ts := newFragmentTestSystem(t, params)
+	if err := ts.client.Write(randPayload(4097)); err == nil {
+		t.Fatalf("Client Write accepted a payload above MaxMessageSize")
+	}
+	if err := ts.server.Write(ts.client.ConnID(), randPayload(4097)); err == nil {
+		t.Fatalf("Server Write accepted a payload above MaxMessageSize")
+	}
+	ts.roundTrip([][]byte{randPayload(4096)}, 10*time.Second)
+}
+
+func TestFragmentedMsgReassemblyLimit(t *testing.T) {
+	fmt.Printf("=== TestFragmentedMsgReassemblyLimit: Read drops payloads reassembled past MaxMessageSize\n")
+	serverParams := makeParams(5, 200, 4)
+	serverParams.MaxMessageSize = 4096
+	serverParams.MaxFragmentSize = 1000
+	clientParams := makeParams(5, 200, 4)
+	clientParams.MaxFragmentSize = 1000
+	network := newMemNetwork()
+	server, err := NewServerTransport(network.listen("server"), serverParams)
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	defer server.Close()
+	cli, err := NewClientTransport(network.listen("client"), memAddr("server"), clientParams)
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer cli.Close()
+
+	if err := cli.Write(randPayload(4097)); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	fits := randPayload(4096)
+	if err := cli.Write(fits); err != nil {
+		t.Fatalf("Client Write returned %v", err)
+	}
+	readChan := make(chan []byte, 1)
+	go func() {
+		_, data, _ := server.Read()
+		readChan <- data
+	}()
+	select {
+	case data := <-readChan:
+		if !bytes.Equal(data, fits) {
+			t.Fatalf("Server read %d bytes, expected the %d that fit", len(data), len(fits))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server never read the payload that fit")
+	}
+}
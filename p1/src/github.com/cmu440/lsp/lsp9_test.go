@@ -0,0 +1,191 @@
+// LSP selective acknowledgement tests.
+
+// These tests check that a SACK reports the cumulative ack plus the messages
+// received out of order, that a sender retires exactly those messages from
+// its window and drops a SACK for messages it never sent, and that SACK is
+// only turned on when both the client and the server ask for it.
+
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type sackTestSystem struct {
+	t      *testing.T
+	server Server
+	client Client
+}
+
+func newSackTestSystem(t *testing.T, serverParams, clientParams *Params) *sackTestSystem {
+	ts := &sackTestSystem{t: t}
+	const numTries = 5
+	var port int
+	var err error
+	for i := 0; i < numTries && ts.server == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		ts.server, err = NewServer(port, serverParams)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	ts.client, err = NewClient(lspnet.JoinHostPort("127.0.0.1", strconv.Itoa(port)), clientParams)
+	if err != nil {
+		t.Fatalf("Client failed to connect to server on port %d: %s.", port, err)
+	}
+	return ts
+}
+
+func TestMakeSack(t *testing.T) {
+	pending := []*Message{
+		NewData(1, 7, 0, nil, 0),
+		NewData(1, 9, 0, nil, 0),
+		NewData(1, 6+sackBitmapSize, 0, nil, 0), // too far ahead to report
+	}
+	sack := makeSack(1, 5, 0, pending)
+	if sack.Type != MsgSack || sack.SeqNum != 5 {
+		t.Fatalf("makeSack returned %s", sack)
+	}
+	if got, ok := sack.sackedSeqNums(3, 9); !ok || !reflect.DeepEqual(got, []int{3, 4, 5, 7, 9}) {
+		t.Fatalf("SACK acknowledged %v, expected [3 4 5 7 9]", got)
+	}
+	if got, ok := sack.sackedSeqNums(8, 9); !ok || !reflect.DeepEqual(got, []int{9}) {
+		t.Fatalf("SACK acknowledged %v past the window start, expected [9]", got)
+	}
+	if _, ok := sack.sackedSeqNums(3, 8); ok {
+		t.Fatalf("SACK acknowledging a message never sent wasn't dropped")
+	}
+	if _, ok := makeSack(1, 1<<30, 0, nil).sackedSeqNums(3, 9); ok {
+		t.Fatalf("SACK far past the window wasn't dropped")
+	}
+	if !integrityCheck(sack, nil) {
+		t.Fatalf("SACK %s failed the integrity check", sack)
+	}
+	corrupted := *sack
+	corrupted.SackBits ^= 1 << 20
+	if integrityCheck(&corrupted, nil) {
+		t.Fatalf("Corrupted SACK %s passed the integrity check", &corrupted)
+	}
+}
+
+func TestSackCodec(t *testing.T) {
+	sack := NewSack(3, 11, 1<<63|1<<2)
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		b, err := encode(sack, codec)
+		if err != nil {
+			t.Fatalf("encode(%s) with %s returned %v", sack, codec, err)
+		}
+		var got Message
+		if err := decode(b, &got); err != nil {
+			t.Fatalf("decode(%s) with %s returned %v", sack, codec, err)
+		}
+		if got.Type != MsgSack || got.SeqNum != 11 || got.SackBits != sack.SackBits || !integrityCheck(&got, nil) {
+			t.Fatalf("Round trip of %s with %s gave %s", sack, codec, &got)
+		}
+	}
+}
+
+func TestSackNegotiation(t *testing.T) {
+	tests := []struct {
+		server, client, expected bool
+	}{
+		{true, true, true},
+		{false, true, false},
+		{true, false, false},
+	}
+	for _, test := range tests {
+		fmt.Printf("=== TestSackNegotiation: server SACK %t, client SACK %t\n", test.server, test.client)
+		serverParams := makeParams(5, 200, 4)
+		serverParams.SelectiveAck = test.server
+		clientParams := makeParams(5, 200, 4)
+		clientParams.SelectiveAck = test.client
+		ts := newSackTestSystem(t, serverParams, clientParams)
+		ts.client.ConnID() // a round trip through mainRoutine, which owns the features
+		if sack := ts.client.(*client).features&FeatureSack != 0; sack != test.expected {
+			t.Fatalf("Server SACK %t and client SACK %t agreed on %t", test.server, test.client, sack)
+		}
+		fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+		fts.roundTrip([][]byte{[]byte("one"), []byte("two"), []byte("three")}, 5*time.Second)
+		ts.client.Close()
+		ts.server.Close()
+	}
+}
+
+func TestSackWindow1(t *testing.T) {
+	fmt.Printf("=== TestSackWindow1: SACK, many messages, window size 8\n")
+	ts := newSackTestSystem(t, &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 8, SelectiveAck: true}, &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 8, SelectiveAck: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	payloads := make([][]byte, 50)
+	for i := range payloads {
+		payloads[i] = []byte("message " + strconv.Itoa(i))
+	}
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip(payloads, 10*time.Second)
+}
+
+func TestSackWindow2(t *testing.T) {
+	fmt.Printf("=== TestSackWindow2: SACK, window size 10, 30%% drop rate\n")
+	defer lspnet.ResetDropPercent()
+	ts := newSackTestSystem(t, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, SelectiveAck: true}, &Params{EpochLimit: 20, EpochMillis: 100, WindowSize: 10, SelectiveAck: true})
+	defer ts.server.Close()
+	defer ts.client.Close()
+	lspnet.SetWriteDropPercent(30)
+	payloads := make([][]byte, 40)
+	for i := range payloads {
+		payloads[i] = randPayload(1 + rand.Intn(500))
+	}
+	fts := &fragmentTestSystem{t: t, server: ts.server, client: ts.client}
+	fts.roundTrip(payloads, 30*time.Second)
+}
+
+func TestSackOutOfWindow(t *testing.T) {
+	fmt.Printf("=== TestSackOutOfWindow: SACKs for messages never sent are dropped\n")
+	network := newMemNetwork()
+	server, err := NewServerTransport(network.listen("server"), &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 4, SelectiveAck: true})
+	if err != nil {
+		t.Fatalf("NewServerTransport returned %v", err)
+	}
+	defer server.Close()
+	transport := network.listen("client")
+	cli, err := NewClientTransport(transport, memAddr("server"), &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 4, SelectiveAck: true})
+	if err != nil {
+		t.Fatalf("Client failed to connect: %s", err)
+	}
+	defer cli.Close()
+
+	if err := server.Write(cli.ConnID(), []byte("first")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+	farSack := makeSack(cli.ConnID(), 1<<30, 0, nil)
+	bitsSack := makeSack(cli.ConnID(), 0, 0, nil)
+	bitsSack.SackBits = 1<<64 - 1
+	bitsSack.Checksum = sackCheckSum(bitsSack.ConnID, bitsSack.SeqNum, bitsSack.SackBits, bitsSack.Window)
+	for _, sack := range []*Message{farSack, bitsSack} {
+		b, _ := marshal(sack)
+		transport.WriteTo(b, memAddr("server"))
+	}
+	if err := server.Write(cli.ConnID(), []byte("second")); err != nil {
+		t.Fatalf("Server Write returned %v", err)
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		data, err := cli.ReadContext(ctx)
+		cancel()
+		if err != nil || string(data) != expected {
+			t.Fatalf("Client read %q, %v, expected %q", data, err, expected)
+		}
+	}
+}
@@ -11,9 +11,13 @@ import (
 type MsgType int
 
 const (
-	MsgConnect MsgType = iota // Sent by clients to make a connection w/ the server.
-	MsgData                   // Sent by clients/servers to send data.
-	MsgAck                    // Sent by clients/servers to ack connect/data msgs.
+	MsgConnect  MsgType = iota // Sent by clients to make a connection w/ the server.
+	MsgData                    // Sent by clients/servers to send data.
+	MsgAck                     // Sent by clients/servers to ack connect/data msgs.
+	MsgSack                    // Sent by clients/servers to ack many data msgs at once.
+	MsgClose                   // Sent by clients/servers to close a connection.
+	MsgCloseAck                // Sent by clients/servers to ack close msgs.
+	MsgCookie                  // Sent by servers to make clients prove their address.
 )
 
 // Message represents a message used by the LSP protocol.
@@ -24,6 +28,65 @@ type Message struct {
 	Size     int     // Size of the payload.
 	Checksum uint16  // Message checksum.
 	Payload  []byte  // Data message payload.
+
+	// Codec is the wire format proposed by a client in its connect message
+	// and the one agreed on by the server in the connect ack.
+	Codec Codec `json:",omitempty"`
+
+	// Features is the set of optional features proposed by a client in its
+	// connect message and the set agreed on by the server in the connect ack.
+	Features Feature `json:",omitempty"`
+
+	// FragIndex and FragCount are set on data messages carrying one fragment
+	// of a payload that was too large for a single message.
+	FragIndex int `json:",omitempty"`
+	FragCount int `json:",omitempty"`
+
+	// SackBits is set on SACK messages: bit i reports that the data message
+	// with sequence number SeqNum+1+i has been received out of order.
+	SackBits uint64 `json:",omitempty"`
+
+	// Window is set on acks when flow control is on: it is the number of
+	// further data messages the sender of the ack is able to buffer.
+	Window int `json:",omitempty"`
+
+	// Token is the connection secret handed to a client in the connect ack.
+	// The client sets it on every later message, so that the server still
+	// recognizes it after its address changes.
+	Token uint64 `json:",omitempty"`
+
+	// Stream and StreamSeq are set on data messages written to a stream
+	// other than the connection's own stream 0: StreamSeq is the message's
+	// sequence number within that stream.
+	Stream    int `json:",omitempty"`
+	StreamSeq int `json:",omitempty"`
+
+	// Mode is set on data messages written with a delivery mode other than
+	// ReliableOrdered. Unreliable messages carry no sequence number and are
+	// never acked.
+	Mode DeliveryMode `json:",omitempty"`
+
+	// Nonce and MAC are set on connect messages and connect acks in secure
+	// mode: the nonces go into the connection's keys, and the MAC proves the
+	// sender holds the pre-shared key.
+	Nonce []byte `json:",omitempty"`
+	MAC   []byte `json:",omitempty"`
+
+	// Cookie is set on cookie messages by a server that wants a client to
+	// prove its address before it sets anything up, and echoed by the
+	// client in the connect messages it sends after that.
+	Cookie []byte `json:",omitempty"`
+
+	// Digest is set on data messages and SACKs when the connection agreed
+	// on an integrity algorithm stronger than Checksum: it is that
+	// algorithm's code over the whole message.
+	Digest uint64 `json:",omitempty"`
+	// EpochLimit, EpochMillis and WindowSize are set on connect messages to
+	// the settings the client proposes, and on connect acks to the ones the
+	// server agreed on for the connection.
+	EpochLimit  int `json:",omitempty"`
+	EpochMillis int `json:",omitempty"`
+	WindowSize  int `json:",omitempty"`
 }
 
 // NewConnect returns a new connect message.
@@ -69,6 +132,15 @@ func (m *Message) String() string {
 		payload = " " + string(m.Payload)
 	case MsgAck:
 		name = "Ack"
+	case MsgSack:
+		name = "Sack"
+		payload = fmt.Sprintf(" %b", m.SackBits)
+	case MsgClose:
+		name = "Close"
+	case MsgCloseAck:
+		name = "CloseAck"
+	case MsgCookie:
+		name = "Cookie"
 	}
 	return fmt.Sprintf("[%s %d %d%s%s]", name, m.ConnID, m.SeqNum, checksum, payload)
 }
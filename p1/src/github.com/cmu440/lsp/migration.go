@@ -0,0 +1,66 @@
+// Contains the connection tokens that let a client change its address.
+
+package lsp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+)
+
+// newToken returns a random, non-zero secret for a new connection. The
+// server hands it to the client in the connect ack, and the client puts it
+// on everything it sends afterwards so the server can recognize it when its
+// address changes, e.g. because a NAT mapping expired.
+func newToken() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if token := binary.BigEndian.Uint64(b[:]); token != 0 {
+			return token
+		}
+	}
+}
+
+// remote returns the address the client is at.
+func (sClient *s_client) remote() net.Addr {
+	return *sClient.addr.Load()
+}
+
+// moveTo makes addr the address the client is at.
+func (sClient *s_client) moveTo(addr net.Addr) {
+	sClient.addr.Store(&addr)
+}
+
+// lookupClient returns the client a message read from addr belongs to, or
+// nil if there is none. New connect messages are matched by address since
+// the client has no connID yet. Everything else, including the connect
+// messages of a client resuming its session, is matched by connID: a message
+// from the client's current address is accepted as long as it doesn't carry
+// a wrong token, while a message from any other address has to carry the
+// client's token and then moves the client to that address, keeping its
+// window and sequence numbers. Messages that fail the integrity check the
+// client agreed on match nothing.
+func (s *server) lookupClient(message *Message, addr net.Addr) *s_client {
+	if message.Type == MsgConnect && message.Token == 0 {
+		return s.clients.at(addr)
+	}
+	if sClient := s.clients.get(message.ConnID); sClient != nil {
+		if !integrityCheck(message, sClient.integrity) { //before it can move the client
+			sClient.stats.integrityFailures.Add(1)
+			return nil
+		}
+		if message.Token != 0 && message.Token != sClient.token {
+			return nil
+		}
+		if sClient.remote().String() == addr.String() {
+			return sClient
+		}
+		if sClient.token == 0 || message.Token != sClient.token {
+			return nil
+		}
+		s.clients.move(sClient, addr)
+		return sClient
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Contains the negotiation of per-connection settings during connect.
+
+package lsp
+
+import "errors"
+
+// ConnParams are the settings both ends of a connection have to agree on:
+// with different epochs one end declares the other lost while it is still
+// waiting to hear back, and the window bounds what the receiver buffers.
+type ConnParams struct {
+	EpochLimit  int
+	EpochMillis int
+	WindowSize  int
+}
+
+// ConnectPolicy decides the settings of a new connection. It gets the
+// client's address and the settings it proposed, with the ones a client
+// didn't propose filled in from the server's Params, and returns the
+// settings to run the connection with, or an error to refuse the client.
+// Fields left at zero keep the server's own. It is called from the server's
+// main routine, so it must not block.
+type ConnectPolicy func(addr string, proposed ConnParams) (ConnParams, error)
+
+// The most any connection runs with, whatever a policy or the peer asks for,
+// so that nobody can make an endpoint allocate a huge window or never give up
+// on a connection.
+const (
+	maxEpochLimit  = 1 << 20
+	maxEpochMillis = 60 * 60 * 1000 // an hour
+	maxWindowSize  = 1 << 16
+)
+
+// ClampPolicy returns a ConnectPolicy that accepts what the client proposes
+// within [min, max], field by field, and clamps it otherwise. A zero bound
+// leaves that end open up to a built-in maximum, so ClampPolicy(ConnParams{},
+// ConnParams{}) accepts anything sensible. Settings that aren't positive are
+// refused.
+func ClampPolicy(min, max ConnParams) ConnectPolicy {
+	clamp := func(v, lo, hi, limit int) int {
+		if hi <= 0 || hi > limit {
+			hi = limit
+		}
+		if lo > 0 && v < lo {
+			return lo
+		} else if v > hi {
+			return hi
+		}
+		return v
+	}
+	return func(addr string, proposed ConnParams) (ConnParams, error) {
+		if proposed.EpochLimit <= 0 || proposed.EpochMillis <= 0 || proposed.WindowSize <= 0 {
+			return ConnParams{}, ErrConnRefused
+		}
+		return ConnParams{
+			EpochLimit:  clamp(proposed.EpochLimit, min.EpochLimit, max.EpochLimit, maxEpochLimit),
+			EpochMillis: clamp(proposed.EpochMillis, min.EpochMillis, max.EpochMillis, maxEpochMillis),
+			WindowSize:  clamp(proposed.WindowSize, min.WindowSize, max.WindowSize, maxWindowSize),
+		}, nil
+	}
+}
+
+// ErrConnRefused is what a ConnectPolicy may return to refuse a client.
+var ErrConnRefused = errors.New("lsp: connection refused by policy")
+
+func (p *Params) connParams() ConnParams {
+	return ConnParams{EpochLimit: p.EpochLimit, EpochMillis: p.EpochMillis, WindowSize: p.WindowSize}
+}
+
+// with returns a copy of p running with the settings in cp. Fields of cp
+// that aren't positive keep the ones of p, and none goes past the built-in
+// maximum.
+func (p *Params) with(cp ConnParams) *Params {
+	params := *p
+	if cp.EpochLimit > 0 {
+		params.EpochLimit = cp.EpochLimit
+	}
+	if cp.EpochMillis > 0 {
+		params.EpochMillis = cp.EpochMillis
+	}
+	if cp.WindowSize > 0 {
+		params.WindowSize = cp.WindowSize
+	}
+	params.EpochLimit = min(params.EpochLimit, maxEpochLimit)
+	params.EpochMillis = min(params.EpochMillis, maxEpochMillis)
+	params.WindowSize = min(params.WindowSize, maxWindowSize)
+	return &params
+}
+
+// put sets the settings on a connect message or ack
+func (cp ConnParams) put(msg *Message) {
+	msg.EpochLimit = cp.EpochLimit
+	msg.EpochMillis = cp.EpochMillis
+	msg.WindowSize = cp.WindowSize
+}
+
+// messageConnParams returns the settings carried by a connect message or
+// ack, all zero if the peer doesn't negotiate them.
+func messageConnParams(msg *Message) ConnParams {
+	return ConnParams{EpochLimit: msg.EpochLimit, EpochMillis: msg.EpochMillis, WindowSize: msg.WindowSize}
+}
+
+// negotiateParams returns the params of a new connection from addr, given
+// its connect message, or an error if the policy refuses it. A client that
+// proposes negative settings is refused.
+func (s *server) negotiateParams(message *Message, addr string) (*Params, error) {
+	if message.EpochLimit < 0 || message.EpochMillis < 0 || message.WindowSize < 0 {
+		return nil, ErrConnRefused
+	}
+	if s.params.ConnectPolicy == nil {
+		return s.params.with(ConnParams{}), nil
+	}
+	proposed := s.params.with(messageConnParams(message)).connParams()
+	agreed, err := s.params.ConnectPolicy(addr, proposed)
+	if err != nil {
+		return nil, err
+	}
+	return s.params.with(agreed), nil
+}
+
+// connParams returns the params the client runs with: its own, with the
+// settings agreed on in the connect ack once that is in.
+func (c *client) connParams() *Params {
+	if params := c.agreed.Load(); params != nil {
+		return params
+	}
+	return c.params
+}
+
+// adopt switches the window and its timers to the settings agreed on in the
+// connect ack. Nothing has been written yet, so the window is empty.
+func (c *client) adopt() {
+	params := c.connParams()
+	c.window = make([]*windowElem, params.WindowSize)
+	c.rtt = newRTTEstimator(params)
+	c.congestion.reset(params)
+}
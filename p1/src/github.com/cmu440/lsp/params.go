@@ -2,7 +2,10 @@
 
 package lsp
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Default values for LSP parameters.
 const (
@@ -10,6 +13,10 @@ const (
 	DefaultEpochMillis        = 2000
 	DefaultWindowSize         = 1
 	DefaultMaxBackOffInterval = 0
+	DefaultCodec              = CodecJSON
+	DefaultMaxMessageSize     = 1 << 20
+	DefaultMaxFragmentSize    = 1024
+	DefaultMaxStreams         = 256
 )
 
 // Params defines configuration parameters for an LSP client or server.
@@ -29,6 +36,112 @@ type Params struct {
 	// The number of epochs between two epochs that transmit the same packet
 	// cannot be larger than the number
 	MaxBackOffInterval int
+
+	// Codec is the wire format this endpoint would like to use. A connection
+	// only switches to CodecBinary when both the client and the server ask
+	// for it, otherwise it falls back to CodecJSON.
+	Codec Codec
+
+	// MaxMessageSize is the largest payload, in bytes, that Write accepts.
+	// Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	// MaxFragmentSize is the largest payload, in bytes, carried by a single
+	// data message. Larger payloads are split into fragments that are sent
+	// with their own sequence numbers and reassembled before Read returns
+	// them. Zero means DefaultMaxFragmentSize, which is also the upper bound
+	// so that an encoded fragment always fits in one datagram.
+	MaxFragmentSize int
+
+	// SelectiveAck asks for cumulative plus selective acks, so that a single
+	// ack can retire many window entries. It is only used when both the
+	// client and the server ask for it.
+	SelectiveAck bool
+
+	// MinRTOMillis is the lower bound, in milliseconds, of the retransmission
+	// timeout estimated from the measured round trip times of a connection.
+	// Zero means EpochMillis, which keeps the fixed timeout of one epoch.
+	MinRTOMillis int
+
+	// MaxRTOMillis is the upper bound, in milliseconds, of the retransmission
+	// timeout, and the timeout used before the first round trip is measured.
+	// Zero means EpochMillis.
+	MaxRTOMillis int
+
+	// CongestionControl turns on AIMD congestion control: a sender starts
+	// with one message in flight and adapts how many it keeps in flight to
+	// the losses it sees, never going above WindowSize.
+	CongestionControl bool
+
+	// MaxUnreadMessages limits how many messages from the peer may wait to
+	// be read. The receiver advertises how many more it can take in its acks
+	// and drops anything past the limit, so a slow reader holds back its
+	// peer instead of buffering without bound. Zero means no limit.
+	MaxUnreadMessages int
+
+	// ResumeGraceMillis turns on session resumption when both the client and
+	// the server set it. A connection that hits the epoch limit is then kept
+	// for this many milliseconds instead of being dropped, while the client
+	// tries to connect again with the token from its connect ack. If it gets
+	// through, both sides carry on from their last acknowledged sequence
+	// numbers and resend whatever is still unacknowledged. Zero means a lost
+	// connection is dropped right away.
+	ResumeGraceMillis int
+
+	// PreSharedKey turns on secure mode: the connect handshake proves both
+	// ends hold the key and derives session keys from it, and every later
+	// message is encrypted and authenticated, so tampered, spoofed and
+	// replayed packets are dropped. A client and a server only connect if
+	// both use the same key, or neither uses one. The key must be at least
+	// 16 bytes long.
+	PreSharedKey []byte
+
+	// KeyFile names a file holding the pre-shared key, used when
+	// PreSharedKey is empty. Surrounding whitespace is ignored.
+	KeyFile string
+
+	// ConnectCookies makes a server answer a connect message from an
+	// address it doesn't know with a cookie instead of an ack. Only a client
+	// that echoes the cookie, which it can only have read at that address,
+	// gets a connection, so spoofed connect messages cost the server no
+	// state. Clients always echo cookies, the setting only matters to a
+	// server.
+	ConnectCookies bool
+
+	// MaxConnections limits how many clients a server keeps connected at
+	// once. Connect messages past the limit are ignored until a connection
+	// goes away. Zero means no limit.
+	MaxConnections int
+
+	// Integrity is the strongest algorithm this endpoint allows for checking
+	// data messages for corruption. A connection uses the strongest one both
+	// the client and the server allow, falling back to IntegrityChecksum.
+	// IntegrityKeyedHash is keyed with a token sent in the clear unless a
+	// pre-shared key is set, so on its own it stops corruption and blind
+	// spoofing, not an attacker who can see the traffic.
+	Integrity Integrity
+
+	// ConnectPolicy decides the EpochLimit, EpochMillis and WindowSize of
+	// each new connection from the ones the client proposes, and may refuse
+	// the client. Only a server uses it. Nil means every connection runs
+	// with the server's own settings, which the client then adopts.
+	ConnectPolicy ConnectPolicy
+
+	// MaxStreams limits how many streams a connection can have. OpenStream
+	// fails past it, and a server drops the messages on new streams past
+	// it, so both ends should use the same limit. Zero means
+	// DefaultMaxStreams.
+	MaxStreams int
+
+	// LocalAddr is the address a client binds to, a host and port like
+	// "[::1]:0" where port 0 lets the system pick one. Empty means the
+	// system picks both. Servers take their address from NewServerAddr.
+	LocalAddr string
+
+	// Clock is what the endpoint keeps epochs, retransmissions and timeouts
+	// by. Nil means the system clock. Tests can pass a FakeClock to run
+	// them without waiting.
+	Clock Clock
 }
 
 // NewParams returns a Params with default field values.
@@ -38,6 +151,9 @@ func NewParams() *Params {
 		EpochMillis:        DefaultEpochMillis,
 		WindowSize:         DefaultWindowSize,
 		MaxBackOffInterval: DefaultMaxBackOffInterval,
+		Codec:              DefaultCodec,
+		MaxMessageSize:     DefaultMaxMessageSize,
+		MaxFragmentSize:    DefaultMaxFragmentSize,
 	}
 }
 
@@ -46,6 +162,59 @@ func NewParams() *Params {
 //     params := NewParams()
 //     fmt.Printf("New params: %s\n", params)
 func (p *Params) String() string {
-	return fmt.Sprintf("[EpochLimit: %d, EpochMillis: %d, WindowSize: %d, MaxBackOffInterval: %d]",
-		p.EpochLimit, p.EpochMillis, p.WindowSize, p.MaxBackOffInterval)
+	return fmt.Sprintf("[EpochLimit: %d, EpochMillis: %d, WindowSize: %d, MaxBackOffInterval: %d, Codec: %s, "+
+		"MaxMessageSize: %d, MaxFragmentSize: %d, SelectiveAck: %t, MinRTOMillis: %d, MaxRTOMillis: %d, "+
+		"CongestionControl: %t, MaxUnreadMessages: %d, ResumeGraceMillis: %d, Secure: %t, "+
+		"ConnectCookies: %t, MaxConnections: %d, Integrity: %s, ConnectPolicy: %t, MaxStreams: %d, "+
+		"LocalAddr: %q, Clock: %t]",
+		p.EpochLimit, p.EpochMillis, p.WindowSize, p.MaxBackOffInterval, p.Codec,
+		p.MaxMessageSize, p.MaxFragmentSize, p.SelectiveAck, p.MinRTOMillis, p.MaxRTOMillis,
+		p.CongestionControl, p.MaxUnreadMessages, p.ResumeGraceMillis, p.features()&FeatureSecure != 0,
+		p.ConnectCookies, p.MaxConnections, p.Integrity, p.ConnectPolicy != nil, p.MaxStreams,
+		p.LocalAddr, p.Clock != nil)
+}
+
+func (p *Params) clock() Clock {
+	if p.Clock == nil {
+		return systemClock{}
+	}
+	return p.Clock
+}
+
+func (p *Params) maxMessageSize() int {
+	if p.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return p.MaxMessageSize
+}
+
+func (p *Params) maxStreams() int {
+	if p.MaxStreams <= 0 {
+		return DefaultMaxStreams
+	}
+	return p.MaxStreams
+}
+
+func (p *Params) maxFragmentSize() int {
+	if p.MaxFragmentSize <= 0 || p.MaxFragmentSize > DefaultMaxFragmentSize {
+		return DefaultMaxFragmentSize
+	}
+	return p.MaxFragmentSize
+}
+
+func (p *Params) maxRTO() time.Duration {
+	if p.MaxRTOMillis <= 0 {
+		return time.Duration(p.EpochMillis) * time.Millisecond
+	}
+	return time.Duration(p.MaxRTOMillis) * time.Millisecond
+}
+
+func (p *Params) minRTO() time.Duration {
+	if p.MinRTOMillis <= 0 {
+		return time.Duration(p.EpochMillis) * time.Millisecond
+	}
+	if minRTO := time.Duration(p.MinRTOMillis) * time.Millisecond; minRTO < p.maxRTO() {
+		return minRTO
+	}
+	return p.maxRTO()
 }
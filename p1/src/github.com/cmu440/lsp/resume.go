@@ -0,0 +1,91 @@
+// Contains session resumption after a connection has been declared lost.
+
+package lsp
+
+import "time"
+
+// resumeGrace is how long a lost connection is kept around to be resumed.
+func resumeGrace(params *Params) time.Duration {
+	return time.Duration(params.ResumeGraceMillis) * time.Millisecond
+}
+
+// canResume tells whether the session can be resumed once the server is lost
+func (c *client) canResume() bool {
+	return c.features&FeatureResume != 0 && c.token != 0
+}
+
+// suspend keeps the window and sequence numbers of a lost connection and
+// keeps sending a connect message with the connID and token of the session
+// until the server acks it or the grace period is over. Messages written in
+// the meantime are buffered.
+func (c *client) suspend() {
+	for _, elem := range c.window {
+		if elem != nil {
+			elem.stop() //pause, resume starts it again
+		}
+	}
+	c.suspended = true
+	c.graceChan = c.wheel.clock.NewTimer(resumeGrace(c.params)).C()
+	msg := NewConnect()
+	msg.ConnID = c.connID
+	msg.Token = c.token
+	msg.Codec = c.params.Codec
+	msg.Features = c.params.features()
+	byteMsg, _ := marshal(msg)
+	c.resumeConnect = &windowElem{
+		seqNum: 0,
+		msg:    byteMsg,
+	}
+	c.resend(c.resumeConnect, c.connParams().maxRTO())
+}
+
+// resume continues a suspended session once the server acked the connect,
+// retransmitting everything that is still unacked.
+func (c *client) resume() {
+	c.stopResumeConnect()
+	c.suspended = false
+	c.graceChan = nil
+	for _, elem := range c.window {
+		if elem != nil {
+			c.resend(elem, c.rtt.timeout())
+		}
+	}
+	c.fillWindow()
+}
+
+func (c *client) stopResumeConnect() {
+	if c.resumeConnect != nil {
+		c.resumeConnect.stop()
+		c.resumeConnect = nil
+	}
+}
+
+// canResume tells whether the session can be resumed once the client is lost
+func (sClient *s_client) canResume() bool {
+	return sClient.features&FeatureResume != 0 && sClient.token != 0
+}
+
+// suspend keeps the window and sequence numbers of a lost client for the
+// grace period, in case it connects again with its token.
+func (sClient *s_client) suspend(s *server) {
+	for _, elem := range sClient.window {
+		if elem != nil {
+			elem.stop() //pause, resume starts it again
+		}
+	}
+	sClient.suspended = true
+	sClient.graceChan = s.wheel.clock.NewTimer(resumeGrace(s.params)).C()
+}
+
+// resume continues a suspended session once the client connected again,
+// retransmitting everything that is still unacked.
+func (sClient *s_client) resume(s *server) {
+	sClient.suspended = false
+	sClient.graceChan = nil
+	for _, elem := range sClient.window {
+		if elem != nil {
+			sClient.resend(elem, sClient.rtt.timeout(), s)
+		}
+	}
+	sClient.fillWindow(s)
+}
@@ -0,0 +1,77 @@
+// Contains the round trip time estimator that drives retransmissions.
+
+package lsp
+
+import "time"
+
+// rttEstimator keeps the smoothed round trip time of a connection and its
+// variation, and derives the retransmission timeout from them the way TCP
+// does (RFC 6298). It is only used by the routine that owns the window, so
+// it needs no locking.
+type rttEstimator struct {
+	srtt    time.Duration // smoothed round trip time
+	rttvar  time.Duration // smoothed mean deviation of the round trip time
+	rto     time.Duration // current retransmission timeout
+	minRTO  time.Duration
+	maxRTO  time.Duration
+	sampled bool // false until the first measurement
+	clock   Clock
+}
+
+func newRTTEstimator(params *Params) *rttEstimator {
+	return &rttEstimator{
+		rto:    params.maxRTO(),
+		minRTO: params.minRTO(),
+		maxRTO: params.maxRTO(),
+		clock:  params.clock(),
+	}
+}
+
+// sample folds one measured round trip time into the estimate.
+func (r *rttEstimator) sample(rtt time.Duration) {
+	if !r.sampled {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+		r.sampled = true
+	} else {
+		delta := r.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+	rto := r.srtt + 4*r.rttvar
+	if rto < r.minRTO {
+		rto = r.minRTO
+	}
+	if rto > r.maxRTO {
+		rto = r.maxRTO
+	}
+	r.rto = rto
+}
+
+// observe takes a sample from a message that was just acked. Following
+// Karn's algorithm, messages that were sent more than once are skipped since
+// there's no telling which transmission the ack was for. It must only be
+// called after elem has been stopped.
+func (r *rttEstimator) observe(elem *windowElem) {
+	if !elem.retransmitted && !elem.sentAt.IsZero() {
+		r.sample(r.clock.Now().Sub(elem.sentAt))
+	}
+}
+
+// timeout returns the timeout for the first transmission of a message.
+func (r *rttEstimator) timeout() time.Duration {
+	return r.rto
+}
+
+// nextTimeout doubles the timeout of a message that had to be sent again,
+// up to the upper bound, so that a timeout that turned out too short for
+// the path doesn't keep flooding it.
+func nextTimeout(timeout time.Duration, params *Params) time.Duration {
+	if timeout*2 > params.maxRTO() {
+		return params.maxRTO()
+	}
+	return timeout * 2
+}
@@ -0,0 +1,74 @@
+// Contains the helpers for cumulative plus selective acknowledgements.
+
+package lsp
+
+import "time"
+
+// sackBitmapSize is the number of out-of-order messages past the cumulative
+// ack that a single SACK can report.
+const sackBitmapSize = 64
+
+// NewSack returns a new selective acknowledgement message with the specified
+// connection ID, the sequence number up to which every data message has been
+// received, and the bitmap of data messages received past it.
+func NewSack(connID, seqNum int, bits uint64) *Message {
+	return &Message{
+		Type:     MsgSack,
+		ConnID:   connID,
+		SeqNum:   seqNum,
+		Checksum: sackCheckSum(connID, seqNum, bits, 0),
+		SackBits: bits,
+	}
+}
+
+// sackDelay is how long a receiver holds back the ack for a lone in-order
+// data message, hoping to cover the next one with the same SACK.
+func sackDelay(params *Params) time.Duration {
+	return time.Duration(min(20, params.EpochMillis/2)) * time.Millisecond
+}
+
+// makeSack returns the SACK for a receiver that has every data message up to
+// through, plus the out-of-order messages held in pending, advertising the
+// receive window if it isn't zero.
+func makeSack(connID, through, window int, pending []*Message) *Message {
+	var bits uint64
+	for _, message := range pending {
+		offset := message.SeqNum - through - 1
+		if offset > 0 && offset < sackBitmapSize {
+			bits |= 1 << uint(offset)
+		}
+	}
+	sack := NewSack(connID, through, bits)
+	sack.Window = window
+	sack.Checksum = sackCheckSum(connID, through, bits, window)
+	return sack
+}
+
+// sackedSeqNums returns the sequence numbers from from through through, the
+// highest one sent, that are acknowledged by this SACK in increasing order.
+// A SACK for messages that were never sent is bogus, and false is returned.
+func (m *Message) sackedSeqNums(from, through int) ([]int, bool) {
+	if m.SeqNum > through {
+		return nil, false
+	}
+	seqNums := make([]int, 0)
+	for seqNum := from; seqNum <= m.SeqNum; seqNum++ {
+		seqNums = append(seqNums, seqNum)
+	}
+	for i := 0; i < sackBitmapSize; i++ {
+		if m.SackBits&(1<<uint(i)) == 0 || m.SeqNum+1+i < from {
+			continue
+		}
+		if m.SeqNum+1+i > through {
+			return nil, false
+		}
+		seqNums = append(seqNums, m.SeqNum+1+i)
+	}
+	return seqNums, true
+}
+
+// sackCheckSum protects the cumulative ack, the bitmap and the window of a
+// SACK, since a corrupted one could retire messages that never arrived.
+func sackCheckSum(connID, seqNum int, bits uint64, window int) uint16 {
+	return makeCheckSum(connID, seqNum, 0, nil, int(bits&0xffffffff), int(bits>>32), window)
+}
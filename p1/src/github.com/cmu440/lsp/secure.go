@@ -0,0 +1,296 @@
+// Contains the secure mode, which authenticates and encrypts connections
+// with a pre-shared key.
+
+package lsp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// In secure mode the connect message and its ack each carry a random nonce
+// and a MAC computed with the pre-shared key, so only a peer holding the key
+// can open a connection or answer one. Both sides then derive one AES-GCM
+// key per direction from the key and the two nonces, and every later
+// message, including the connect messages of a client resuming its session,
+// goes out sealed:
+//
+//	magic(1) connID(4) counter(8) ciphertext
+//
+// The header is authenticated along with the ciphertext, and the counter is
+// both the AEAD nonce and what replayed packets are recognized by. Anything
+// that isn't sealed with the right key, or was opened before, is dropped
+// before it reaches clientMain or mainRoutine.
+const (
+	sealedMagic      = 0xd5
+	sealedHeaderSize = 13
+	nonceSize        = 16
+	minKeySize       = 16
+	replayWindow     = 64 // counters this far behind the highest one opened can still be opened once
+)
+
+// preSharedKey returns the key secure mode uses, nil if it is off. A key
+// file holds the key itself, surrounding whitespace is ignored.
+func (p *Params) preSharedKey() ([]byte, error) {
+	key := p.PreSharedKey
+	if len(key) == 0 && p.KeyFile != "" {
+		b, err := os.ReadFile(p.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = bytes.TrimSpace(b)
+	}
+	if len(key) == 0 && p.KeyFile == "" {
+		return nil, nil
+	}
+	if len(key) < minKeySize {
+		return nil, errors.New("lsp: pre-shared key must be at least 16 bytes")
+	}
+	return key, nil
+}
+
+// newNonce returns a random nonce for the handshake.
+func newNonce() []byte {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+func keyedHash(key []byte, label string, fields ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, field := range fields {
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// connParamsBytes returns the connection settings carried by a connect
+// message or ack, for its MAC.
+func connParamsBytes(msg *Message) []byte {
+	b := make([]byte, 0, 24)
+	for _, v := range []int{msg.EpochLimit, msg.EpochMillis, msg.WindowSize} {
+		b = append(b, uint64Bytes(uint64(v))...)
+	}
+	return b
+}
+
+// connectMAC authenticates a connect message.
+func connectMAC(key []byte, msg *Message) []byte {
+	return keyedHash(key, "lsp connect", msg.Nonce,
+		uint64Bytes(uint64(msg.Codec)), uint64Bytes(uint64(msg.Features)), connParamsBytes(msg))
+}
+
+// ackMAC authenticates the connect ack for a connect message, covering
+// everything the ack tells the client.
+func ackMAC(key []byte, clientNonce []byte, ack *Message) []byte {
+	return keyedHash(key, "lsp connect ack", clientNonce, ack.Nonce,
+		uint64Bytes(uint64(ack.ConnID)), uint64Bytes(ack.Token),
+		uint64Bytes(uint64(ack.Codec)), uint64Bytes(uint64(ack.Features)), connParamsBytes(ack))
+}
+
+// secureSession holds the keys of a connection in secure mode. Sealing is
+// safe from any routine, opening is only done by the routine reading from
+// the network.
+type secureSession struct {
+	connID      int
+	sendAEAD    cipher.AEAD
+	recvAEAD    cipher.AEAD
+	sendCounter atomic.Uint64 // last counter sealed
+	recvHighest uint64        // highest counter opened
+	recvSeen    uint64        // bit i: counter recvHighest-i has been opened
+}
+
+// newSecureSession derives the keys of a connection from the pre-shared key
+// and the nonces of its connect message and ack.
+func newSecureSession(key, clientNonce, serverNonce []byte, connID int, isClient bool) *secureSession {
+	id := uint64Bytes(uint64(connID))
+	toServer := newAEAD(keyedHash(key, "lsp client to server", clientNonce, serverNonce, id))
+	toClient := newAEAD(keyedHash(key, "lsp server to client", clientNonce, serverNonce, id))
+	session := &secureSession{connID: connID, sendAEAD: toClient, recvAEAD: toServer}
+	if isClient {
+		session.sendAEAD, session.recvAEAD = toServer, toClient
+	}
+	return session
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key) //always 32 bytes
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// seal returns the encoded message b sealed under the next counter.
+func (session *secureSession) seal(b []byte) []byte {
+	counter := session.sendCounter.Add(1)
+	header := make([]byte, sealedHeaderSize, sealedHeaderSize+len(b)+session.sendAEAD.Overhead())
+	header[0] = sealedMagic
+	binary.BigEndian.PutUint32(header[1:5], uint32(session.connID))
+	binary.BigEndian.PutUint64(header[5:13], counter)
+	return session.sendAEAD.Seal(header, counterNonce(counter), b, header)
+}
+
+// open returns the encoded message sealed in packet, or false if it wasn't
+// sealed for this session, was tampered with or has been opened before.
+func (session *secureSession) open(packet []byte) ([]byte, bool) {
+	if !isSealed(packet) || sealedConnID(packet) != session.connID {
+		return nil, false
+	}
+	counter := binary.BigEndian.Uint64(packet[5:13])
+	if counter == 0 || session.replayed(counter) {
+		return nil, false
+	}
+	header := packet[:sealedHeaderSize]
+	b, err := session.recvAEAD.Open(nil, counterNonce(counter), packet[sealedHeaderSize:], header)
+	if err != nil {
+		return nil, false
+	}
+	session.markOpened(counter)
+	return b, true
+}
+
+func (session *secureSession) replayed(counter uint64) bool {
+	if counter > session.recvHighest {
+		return false
+	}
+	behind := session.recvHighest - counter
+	return behind >= replayWindow || session.recvSeen&(1<<behind) != 0
+}
+
+func (session *secureSession) markOpened(counter uint64) {
+	if counter > session.recvHighest {
+		shift := counter - session.recvHighest
+		if shift >= replayWindow {
+			session.recvSeen = 0
+		} else {
+			session.recvSeen <<= shift
+		}
+		session.recvHighest = counter
+	}
+	session.recvSeen |= 1 << (session.recvHighest - counter)
+}
+
+func isSealed(packet []byte) bool {
+	return len(packet) >= sealedHeaderSize && packet[0] == sealedMagic
+}
+
+func sealedConnID(packet []byte) int {
+	return int(binary.BigEndian.Uint32(packet[1:5]))
+}
+
+// send writes an encoded message to the server, sealed once there are keys.
+func (c *client) send(b []byte) {
+	if session := c.session.Load(); session != nil {
+		b = session.seal(b)
+	}
+	c.transport.WriteTo(b, c.serverAddr)
+}
+
+// open returns the encoded message in a packet read from the server. Without
+// a pre-shared key it is the packet itself. In secure mode it is nil unless
+// the packet was sealed for this connection, or is the connect ack the keys
+// are derived from, or a connect cookie.
+func (c *client) open(packet []byte) []byte {
+	if c.psk == nil {
+		return packet
+	}
+	if session := c.session.Load(); session != nil {
+		b, _ := session.open(packet)
+		return b
+	}
+	var ack Message
+	if isSealed(packet) || decode(packet, &ack) != nil {
+		return nil
+	}
+	if ack.Type == MsgCookie { //proves nothing, it is only echoed back
+		return packet
+	}
+	if ack.Type != MsgAck || ack.SeqNum != 0 || !hmac.Equal(ack.MAC, ackMAC(c.psk, c.nonce, &ack)) {
+		return nil
+	}
+	c.session.Store(newSecureSession(c.psk, c.nonce, ack.Nonce, ack.ConnID, true))
+	return packet
+}
+
+// writeTo writes an encoded message to the client, sealed in secure mode.
+func (sClient *s_client) writeTo(b []byte, s *server) {
+	if sClient.session != nil {
+		b = sClient.session.seal(b)
+	}
+	s.transport.WriteTo(b, sClient.remote())
+}
+
+// open returns the encoded message in a packet read from a client, and
+// whether it was sealed. Without a pre-shared key it is the packet itself.
+// In secure mode it is nil unless the packet was sealed for a connected
+// client, or is a connect message carrying a valid MAC.
+func (s *server) open(packet []byte) ([]byte, bool) {
+	if s.psk == nil {
+		return packet, false
+	}
+	if isSealed(packet) {
+		sClient := s.clients.get(sealedConnID(packet))
+		if sClient == nil || sClient.session == nil {
+			return nil, false
+		}
+		b, _ := sClient.session.open(packet)
+		return b, true
+	}
+	var connect Message
+	if decode(packet, &connect) != nil || connect.Type != MsgConnect || connect.Token != 0 ||
+		!hmac.Equal(connect.MAC, connectMAC(s.psk, &connect)) {
+		return nil, false
+	}
+	return packet, false
+}
+
+// secureConnect sets up the keys of a new client in secure mode, from the
+// nonce in its connect message.
+func (sClient *s_client) secureConnect(message *Message, s *server) {
+	if s.psk == nil {
+		return
+	}
+	sClient.clientNonce = message.Nonce
+	sClient.nonce = newNonce()
+	sClient.session = newSecureSession(s.psk, sClient.clientNonce, sClient.nonce, sClient.connID, false)
+}
+
+// writeConnectAck writes the ack for a connect message. The ack for one that
+// wasn't sealed goes out unsealed, since the client has no keys until it
+// reads it, and in secure mode carries the server's nonce and a MAC. The
+// binary format has no room for those, so it is JSON, which the client can
+// always decode.
+func (sClient *s_client) writeConnectAck(ack *Message, plain bool, s *server) {
+	codec := sClient.codec
+	if plain && sClient.session != nil {
+		ack.Nonce = sClient.nonce
+		ack.MAC = ackMAC(s.psk, sClient.clientNonce, ack)
+		codec = CodecJSON
+	}
+	byteMessage, _ := encode(ack, codec)
+	if plain {
+		s.transport.WriteTo(byteMessage, sClient.remote())
+	} else {
+		sClient.writeTo(byteMessage, s)
+	}
+}
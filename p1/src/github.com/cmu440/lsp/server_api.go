@@ -2,6 +2,8 @@
 
 package lsp
 
+import "context"
+
 // Server defines the interface for a LSP server.
 type Server interface {
 	// Read reads a data message from a client and returns its payload,
@@ -36,4 +38,47 @@ type Server interface {
 	// You may assume that Read, Write, CloseConn, or Close will not be called after
 	// calling this method.
 	Close() error
+
+	// ReadContext behaves like Read, but returns an ID with value 0 and
+	// ctx.Err() if ctx is done before a message is ready to be returned.
+	ReadContext(ctx context.Context) (int, []byte, error)
+
+	// WriteContext behaves like Write, but returns ctx.Err() if ctx is done
+	// before the payload has been handed off to the server.
+	WriteContext(ctx context.Context, connID int, payload []byte) error
+
+	// CloseContext behaves like Close, but stops waiting once ctx is done.
+	// Any messages that are still unacknowledged at that point are abandoned,
+	// all clients are dropped, all background goroutines are shut down, and
+	// ctx.Err() is returned.
+	CloseContext(ctx context.Context) error
+
+	// CongestionWindow returns the number of messages the server currently
+	// lets be in flight to the client with the specified connection ID,
+	// returning a non-nil error if the connection ID does not exist. It is
+	// WindowSize unless Params.CongestionControl is set.
+	CongestionWindow(connID int) (int, error)
+
+	// AcceptStream returns the next stream opened by the client with the
+	// specified connection ID. It blocks until the first message on a new
+	// stream arrives, and returns a non-nil error if the connection ID does
+	// not exist or the client is gone.
+	AcceptStream(connID int) (Stream, error)
+
+	// WriteMode sends a message to the client with the specified connection
+	// ID with the given delivery mode, the same way as Client.WriteMode.
+	WriteMode(connID int, payload []byte, mode DeliveryMode) error
+
+	// Stats returns a snapshot of the counters and gauges of the connection
+	// with the specified connection ID, returning a non-nil error if the
+	// connection ID does not exist or the client is gone.
+	Stats(connID int) (ConnStats, error)
+
+	// Events returns the channel the server reports connection lifecycle
+	// events on: a ConnOpened event with the remote address for each new
+	// client, and one ConnLost, ConnClosedByPeer or ConnClosedLocally event
+	// once it ends. Events wait for the channel to be read, up to a limit
+	// past which the oldest are dropped. The channel is closed once the
+	// server has shut down.
+	Events() <-chan ConnEvent
 }
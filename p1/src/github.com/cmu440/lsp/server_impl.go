@@ -3,10 +3,13 @@
 package lsp
 
 import (
+	"context"
 	"errors"
 	"github.com/cmu440/lspnet"
+	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,82 +21,141 @@ type readReturn struct {
 }
 type connectRequest struct {
 	message *Message
-	addr    *lspnet.UDPAddr
+	addr    net.Addr
 }
 
 type s_client struct { //server side client structure
-	addr          *lspnet.UDPAddr
+	addr          atomic.Pointer[net.Addr] // changes when the client migrates, see remote
+	token         uint64                   // secret the client migrates with, zero without FeatureMigration
 	seqExpected   int //start with one
 	connID        int
+	codec         Codec   // wire format agreed during connect
+	features      Feature // optional features agreed during connect
+	params        *Params // the server's params with the settings agreed during connect
 	writeSeqNum   int // used for writing, start with 1
 	messageToPush *readReturn
+	unordered     unorderedQueue //messages read ahead of the in-order ones
 	//received data messages that is not read yet, no duplicates
 	// seq number of messages in pendingMessages >= seqExpected
 	//no corrupted messages as well
 	pendingMessages []*Message
+	fragments       reassembly    //the fragmented message being reassembled
 	messageChan     chan *Message //receive message from readRoutine
 	clientCloseChan chan int
+	clientDoneChan  chan int //closed once clientMain returns
 
 	// this is for the rest of partA
-	window              []*windowElem
-	windowStart         int
-	addToWindowChan     chan []byte
-	writeBuffer         []*windowElem
-	resendSuccessChan   chan int
-	connDropChan        chan int //notify clientMain that connection dropped
-	gotMessageChan      chan int //notify clientTime that got message from this client
-	aboutToClose        bool
-	clientTimeCloseChan chan int
+	window            []*windowElem
+	windowStart       int
+	addToWindowChan   chan *writeRequest
+	writeBuffer       sendQueue
+	streams           map[int]*streamState // streams opened by the client, by ID
+	accepted          []*stream            // new streams waiting for AcceptStream
+	acceptChan        chan *stream
+	statsChan         chan int
+	statsReturnChan   chan ConnStats
+	stats             connCounters
+	resendSuccessChan chan *Message
+	peerWindow        int              // receive window last advertised by the client
+	sackChan          chan *Message    // selective acks, each may retire many window elements
+	unackedData       int              // in-order data messages not acked yet, only with SACK
+	sackTimerChan     <-chan time.Time // fires to ack a lone in-order data message, only with SACK
+	rtt               *rttEstimator    // retransmission timeout for this client, owned by clientMain
+	congestion        *congestionWindow
+	timeouts          *timeoutQueue    // seqNums of messages that timed out, for the congestion window
+	resumeChan        chan int         // the client presented its token in a new connect
+	suspended         bool             // lost the client, waiting for it to resume
+	graceChan         <-chan time.Time // fires when it's too late to resume
+	closeElem         *windowElem      // close message resent until the client acks it
+	peerClosed        bool             // the client closed the connection
+	peerCloseChan     chan int         // the client sent a close message
+	closeAckChan      chan int         // the client acked our close message
+	counted           bool             // a message for Read is counted in readyClients
+	held              atomic.Bool      // Read takes nothing from the client, see holdReads
+	heldChan          chan int         // held changed
+	connDropChan      chan int         //notify clientMain that connection dropped
+	epochs            *epochTimer      // heartbeats and drop detection on the server's wheel
+	aboutToClose      bool
+	endReported       bool           // how the connection ended was reported to Events
+	session           *secureSession // keys of the connection in secure mode, nil otherwise
+	nonce             []byte         // sent in the connect ack in secure mode
+	clientNonce       []byte         // from the connect message in secure mode
+	integrity         *integrity     // how data messages are checked, agreed during connect
 }
 
 type writeAckRequest struct {
 	ack    *Message
 	client *s_client
+	plain  bool // answers a connect message that wasn't sealed
 }
 
 type windowElem struct {
-	seqNum  int
-	ackChan chan int
-	msg     []byte
+	seqNum int
+	msg    []byte
+	data   *Message    // data message waiting in the writeBuffer, encoded once it gets a seqNum
+	timer  *wheelTimer // resends msg until stopped, see start
+	// only written by the timer, read by whoever stopped it
+	sentAt        time.Time // first transmission
+	retransmitted bool
+	timeout       time.Duration // until the next retransmission
+	backOffEpochs int           // timeouts to let pass between retransmissions
+	epochsPassed  int
 }
 
 type writeRequest struct {
 	connID  int
+	stream  int
 	payload []byte
+	mode    DeliveryMode
 }
 
 type server struct {
 	// TODO: implement this!
-	serverConn       *lspnet.UDPConn
-	serverAddr       *lspnet.UDPAddr
-	connectedClients []*s_client
+	transport PacketTransport
+	clients   *clientTable
 	//start at 1, sequence number of data messages sent from server
 	curDataSeqNum int
 	//start at 1, connID to be assigned when next new connection is made
 	curClientConnID int
 
-	newClientChan           chan *s_client
-	connectChan             chan *connectRequest // channel to set up new connections
-	readReturnChan          chan *readReturn     //channel to send message to Read() back
-	params                  *Params
-	writeRequestChan        chan *writeRequest
-	writeAckChan            chan *writeAckRequest
-	writeBackChan           chan error
-	searchClientRequestChan chan *lspnet.UDPAddr
-	searchClientReturnChan  chan *s_client
-	searchClientCloseChan   chan int
-	serverFinishCloseChan   chan int
+	newClientChan         chan *s_client
+	connectChan           chan *connectRequest // channel to set up new connections
+	readReturnChan        chan *readReturn     //channel to send message to Read() back
+	closedReturnChan      chan *readReturn     // clients that closed, read once nothing else is left
+	readyClients          atomic.Int32         // clients with a message for Read
+	idleChan              chan int             // readyClients dropped to zero
+	params                *Params
+	writeAckChan          chan *writeAckRequest
+	serverFinishCloseChan chan int
+	wheel                 *timerWheel // runs the retransmissions and epochs of every client
 
 	clientRemoveChan chan int //client  dropped
 	mainCloseChan    chan int
 	readCloseChan    chan int
+	cancelChan       chan int // closed by CloseContext to abandon pending messages
+	quitChan         chan int // closed once the server has shut down
 	aboutToClose     bool
+	psk              []byte         // pre-shared key, nil unless in secure mode
+	cookieSecret     []byte         // keys the connect cookies
+	eventMu          sync.Mutex     // guards eventChan and eventsClosed
+	eventChan        chan ConnEvent // events for the application, see Events
+	eventsClosed     bool
 
 	// below is for the rest of partA
 	//clientWriteErrorChan chan error
 
 }
 
+// readBufferSize returns the size of the readReturnChan shared by all clients.
+// With MaxUnreadMessages set it holds nothing, so unread messages stay with
+// their own client where they count towards its receive window.
+func readBufferSize(params *Params) int {
+	if params.MaxUnreadMessages > 0 {
+		return 0
+	}
+	return 500
+}
+
 // NewServer creates, initiates, and returns a new server. This function should
 // NOT block. Instead, it should spawn one or more goroutines (to handle things
 // like accepting incoming client connections, triggering epoch events at
@@ -101,74 +163,213 @@ type server struct {
 // project 0, etc.) and immediately return. It should return a non-nil error if
 // there was an error resolving or listening on the specified port number.
 func NewServer(port int, params *Params) (Server, error) {
-	s := server{
-		serverConn:              nil,
-		serverAddr:              nil,
-		connectedClients:        make([]*s_client, 0),
-		curDataSeqNum:           1,
-		curClientConnID:         1,
-		newClientChan:           make(chan *s_client),
-		connectChan:             make(chan *connectRequest),
-		readReturnChan:          make(chan *readReturn, 500),
-		params:                  params,
-		writeRequestChan:        make(chan *writeRequest),
-		writeAckChan:            make(chan *writeAckRequest),
-		writeBackChan:           make(chan error),
-		clientRemoveChan:        make(chan int),
-		mainCloseChan:           make(chan int),
-		readCloseChan:           make(chan int),
-		searchClientCloseChan:   make(chan int),
-		searchClientRequestChan: make(chan *lspnet.UDPAddr),
-		searchClientReturnChan:  make(chan *s_client),
-		serverFinishCloseChan:   make(chan int),
-		aboutToClose:            false,
-	}
-	adr, err := lspnet.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(port))
+	return NewServerAddr(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+}
+
+// NewServerAddr behaves like NewServer, but listens on the given address
+// instead of localhost. The address is a host and port like "0.0.0.0:9999"
+// for every IPv4 interface, "[::1]:9999" for the IPv6 loopback, or
+// "[::]:9999" for every interface, which takes IPv4 clients as well where
+// the system allows dual-stack sockets.
+func NewServerAddr(addr string, params *Params) (Server, error) {
+	transport, err := listenUDP(addr)
 	if err != nil {
 		return nil, err
 	}
-	s.serverAddr = adr
-	conn, err := lspnet.ListenUDP("udp", s.serverAddr)
+	return NewServerTransport(transport, params)
+}
+
+// NewServerTransport behaves like NewServer, but serves clients over the
+// given transport, which it closes once the server is closed, or right away
+// if it returns an error.
+func NewServerTransport(transport PacketTransport, params *Params) (Server, error) {
+	s := server{
+		transport:             transport,
+		clients:               newClientTable(),
+		curDataSeqNum:         1,
+		curClientConnID:       1,
+		newClientChan:         make(chan *s_client),
+		connectChan:           make(chan *connectRequest),
+		readReturnChan:        make(chan *readReturn, readBufferSize(params)),
+		closedReturnChan:      make(chan *readReturn),
+		idleChan:              make(chan int, 1),
+		params:                params,
+		writeAckChan:          make(chan *writeAckRequest),
+		clientRemoveChan:      make(chan int),
+		mainCloseChan:         make(chan int),
+		readCloseChan:         make(chan int),
+		cancelChan:            make(chan int),
+		quitChan:              make(chan int),
+		serverFinishCloseChan: make(chan int),
+		wheel:                 newTimerWheel(params.clock()),
+		aboutToClose:          false,
+		cookieSecret:          newCookieSecret(),
+		eventChan:             make(chan ConnEvent, maxQueuedEvents),
+	}
+	psk, err := params.preSharedKey()
 	if err != nil {
+		transport.Close()
+		s.wheel.close()
 		return nil, err
 	}
-	s.serverConn = conn
+	s.psk = psk
 	go s.mainRoutine()
 	go s.readRoutine()
 	return &s, nil
 }
 
 func (s *server) Read() (int, []byte, error) {
-	// TODO: remove this line when you are ready to begin implementing this method.
-	message := <-s.readReturnChan
-	return message.connID, message.payload, message.err
-
+	return s.ReadContext(context.Background())
 }
 
 func (s *server) Write(connID int, payload []byte) error {
-	request := &writeRequest{
-		connID:  connID,
-		payload: payload,
-	}
-	s.writeRequestChan <- request
-	err := <-s.writeBackChan
-	return err
+	return s.WriteContext(context.Background(), connID, payload)
 }
 
 func (s *server) CloseConn(connID int) error {
-	s.searchClientCloseChan <- connID
-	sClient := <-s.searchClientReturnChan
+	sClient := s.clients.get(connID)
 	if sClient != nil {
-		sClient.clientCloseChan <- 1
+		select {
+		case sClient.clientCloseChan <- 1:
+		case <-sClient.clientDoneChan: //already gone, nothing left to close
+		}
 		return nil
 	}
 	return errors.New("connID doesn't exist")
 }
 
+func (s *server) CongestionWindow(connID int) (int, error) {
+	sClient := s.clients.get(connID)
+	if sClient == nil {
+		return 0, errors.New("connID doesn't exist")
+	}
+	return int(sClient.congestion.effective.Load()), nil
+}
+
 func (s *server) Close() error {
-	s.mainCloseChan <- 1
-	<-s.serverFinishCloseChan
-	return nil
+	return s.CloseContext(context.Background())
+}
+
+func (s *server) ReadContext(ctx context.Context) (int, []byte, error) {
+	for {
+		select {
+		case message := <-s.readReturnChan:
+			return message.connID, message.payload, message.err
+		default:
+		}
+		//a client that closed is only reported once every message from the
+		//other clients has been read, like a lost client would be much later
+		var closedReturnChan chan *readReturn
+		if s.readyClients.Load() == 0 {
+			closedReturnChan = s.closedReturnChan
+		}
+		select {
+		case message := <-s.readReturnChan:
+			return message.connID, message.payload, message.err
+		case message := <-closedReturnChan:
+			return message.connID, message.payload, message.err
+		case <-s.idleChan: //look again
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+func (s *server) WriteContext(ctx context.Context, connID int, payload []byte) error {
+	return s.write(ctx, connID, 0, payload)
+}
+
+func (s *server) WriteMode(connID int, payload []byte, mode DeliveryMode) error {
+	if err := checkMode(s.params, mode, payload); err != nil {
+		return err
+	}
+	return s.submit(context.Background(), &writeRequest{connID: connID, payload: payload, mode: mode})
+}
+
+func (s *server) AcceptStream(connID int) (Stream, error) {
+	sClient := s.clients.get(connID)
+	if sClient == nil {
+		return nil, errors.New("connID doesn't exist")
+	}
+	select {
+	case st := <-sClient.acceptChan:
+		return st, nil
+	case <-sClient.clientDoneChan:
+		return nil, errors.New("This client dropped")
+	}
+}
+
+func (s *server) Stats(connID int) (ConnStats, error) {
+	sClient := s.clients.get(connID)
+	if sClient == nil {
+		return ConnStats{}, errors.New("connID doesn't exist")
+	}
+	select {
+	case sClient.statsChan <- 1:
+		return <-sClient.statsReturnChan, nil
+	case <-sClient.clientDoneChan:
+		return ConnStats{}, errors.New("This client dropped")
+	}
+}
+
+// write hands a payload for the given stream of a client to mainRoutine
+func (s *server) write(ctx context.Context, connID, stream int, payload []byte) error {
+	request := &writeRequest{
+		connID:  connID,
+		stream:  stream,
+		payload: payload,
+	}
+	return s.submit(ctx, request)
+}
+
+func (s *server) submit(ctx context.Context, request *writeRequest) error {
+	if err := ctx.Err(); err != nil { //don't race a done context against a ready channel
+		return err
+	}
+	if len(request.payload) > s.params.maxMessageSize() {
+		return errors.New("Payload exceeds MaxMessageSize")
+	}
+	sClient := s.clients.get(request.connID)
+	if sClient == nil {
+		return errors.New("This client dropped")
+	}
+	select {
+	case sClient.addToWindowChan <- request:
+		return nil
+	case <-sClient.clientDoneChan:
+		return errors.New("This client dropped")
+	case <-s.cancelChan:
+		return errors.New("Server closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *server) CloseContext(ctx context.Context) error {
+	select {
+	case s.mainCloseChan <- 1:
+	case <-ctx.Done():
+		close(s.cancelChan) //every routine gives up on pending messages
+		<-s.serverFinishCloseChan
+		return ctx.Err()
+	}
+	select {
+	case <-s.serverFinishCloseChan:
+		return nil
+	case <-ctx.Done():
+		close(s.cancelChan)
+		<-s.serverFinishCloseChan
+		return ctx.Err()
+	}
+}
+
+func (s *server) finishClose() { //stop readRoutine and let Close() return
+	s.transport.Close()
+	s.wheel.close()
+	close(s.quitChan)
+	s.closeEvents()
+	s.readCloseChan <- 1
+	s.serverFinishCloseChan <- 1
 }
 
 func (s *server) mainRoutine() {
@@ -176,84 +377,79 @@ func (s *server) mainRoutine() {
 		select {
 
 		case <-s.mainCloseChan: //close
-			for i := 0; i < len(s.connectedClients); i++ {
-				s.connectedClients[i].clientCloseChan <- 1
+			for _, sClient := range s.clients.all() {
+				select {
+				case sClient.clientCloseChan <- 1:
+				case <-sClient.clientDoneChan:
+				case <-s.cancelChan:
+				}
 			}
 			s.aboutToClose = true
-			if len(s.connectedClients) == 0 {
-				s.serverConn.Close()
-				s.readCloseChan <- 1
-				s.serverFinishCloseChan <- 1
+			if s.clients.len() == 0 {
+				s.finishClose()
 				return
 			}
-		case connID := <-s.searchClientCloseChan:
-			sClient := s.searchClientToClose(connID)
-			s.searchClientReturnChan <- sClient
-
-		case addr := <-s.searchClientRequestChan:
-			c := s.searchClient(addr)
-			s.searchClientReturnChan <- c
-
+		case <-s.cancelChan: //CloseContext gave up, clients clean up on their own
+			s.finishClose()
+			return
 		case connID := <-s.clientRemoveChan: //gets called after sClient has finished sending all pendingMessages
-			for i := 0; i < len(s.connectedClients); i++ {
-				if s.connectedClients[i].connID == connID {
-					s.connectedClients = append(s.connectedClients[:i], s.connectedClients[i+1:]...)
-					break
-				}
-			}
-			if s.aboutToClose && len(s.connectedClients) == 0 {
-				s.serverConn.Close()
-				s.readCloseChan <- 1
-				s.serverFinishCloseChan <- 1
+			left := s.clients.remove(connID)
+			if s.aboutToClose && left == 0 {
+				s.finishClose()
 				return
 			}
 		case request := <-s.connectChan: //set up connection
 			message := request.message
-			if message.Type == MsgConnect { //start a new server side client
+			if s.full() { //no room, the client may try again later
+				s.newClientChan <- nil
+			} else if params, err := s.negotiateParams(message, request.addr.String()); err != nil {
+				s.newClientChan <- nil //refused by the policy, ignore it like when full
+			} else if message.Type == MsgConnect { //start a new server side client
 				c := &s_client{ //need to adapt to new struct
-					addr:                request.addr,
-					seqExpected:         1,
-					writeSeqNum:         1,
-					connID:              s.curClientConnID,
-					messageToPush:       nil,
-					pendingMessages:     make([]*Message, 0),
-					messageChan:         make(chan *Message),
-					clientCloseChan:     make(chan int),
-					window:              make([]*windowElem, s.params.WindowSize),
-					windowStart:         1,
-					addToWindowChan:     make(chan []byte),
-					connDropChan:        make(chan int), //notify clientMain that connection dropped
-					gotMessageChan:      make(chan int),
-					writeBuffer:         make([]*windowElem, 0),
-					resendSuccessChan:   make(chan int),
-					aboutToClose:        false,
-					clientTimeCloseChan: make(chan int),
+					seqExpected:       1,
+					writeSeqNum:       1,
+					connID:            s.curClientConnID,
+					codec:             negotiateCodec(message.Codec, s.params.Codec),
+					features:          negotiateFeatures(message.Features, s.params.features()),
+					messageToPush:     nil,
+					pendingMessages:   make([]*Message, 0),
+					messageChan:       make(chan *Message),
+					clientCloseChan:   make(chan int),
+					clientDoneChan:    make(chan int),
+					params:            params,
+					window:            make([]*windowElem, params.WindowSize),
+					windowStart:       1,
+					addToWindowChan:   make(chan *writeRequest),
+					connDropChan:      make(chan int, 1), //notify clientMain that connection dropped
+					streams:           make(map[int]*streamState),
+					accepted:          make([]*stream, 0),
+					acceptChan:        make(chan *stream),
+					statsChan:         make(chan int),
+					statsReturnChan:   make(chan ConnStats),
+					resendSuccessChan: make(chan *Message),
+					peerWindow:        unlimitedWindow,
+					sackChan:          make(chan *Message),
+					rtt:               newRTTEstimator(params),
+					congestion:        newCongestionWindow(params),
+					timeouts:          newTimeoutQueue(),
+					resumeChan:        make(chan int),
+					peerCloseChan:     make(chan int, 1),
+					closeAckChan:      make(chan int, 1),
+					heldChan:          make(chan int, 1),
+					aboutToClose:      false,
 				}
+				c.moveTo(request.addr)
+				if c.features&FeatureMigration != 0 {
+					c.token = newToken()
+				}
+				c.integrity = newIntegrity(c.features, s.psk, c.connID, c.token)
+				c.secureConnect(message, s)
 				s.curClientConnID += 1
-				s.connectedClients = append(s.connectedClients, c)
-				s.newClientChan <- c //let read routine create ack request
+				s.clients.add(c)
+				s.report(ConnOpened, c.connID, request.addr.String())
+				c.epochs = newEpochTimer(s.wheel, &c.stats.lastHeard, params, func() { c.heartbeat(s) }, func() { notify(c.connDropChan) })
+				s.newClientChan <- c //let read routine create ack request, with the epochs running
 				go c.clientMain(s)
-				go c.clientTime(s)
-			}
-
-		case request := <-s.writeRequestChan: //deal with Write() request, don't actually send to clients
-			// write data to client
-			connID := request.connID
-			payload := request.payload
-			var sClient *s_client = nil
-			for i := 0; i < len(s.connectedClients); i++ {
-				if s.connectedClients[i].connID == connID {
-					sClient = s.connectedClients[i]
-					break
-				}
-			}
-			if sClient != nil {
-
-				sClient.addToWindowChan <- payload
-				s.writeBackChan <- nil
-			} else {
-				err := errors.New("This client dropped")
-				s.writeBackChan <- err
 			}
 
 		// write ack to client when getting a data message
@@ -261,59 +457,38 @@ func (s *server) mainRoutine() {
 			ack := ackRequest.ack
 			sClient := ackRequest.client
 
-			byteMessage, err := marshal(ack)
-			_ = err                //deal with later?
-			message1 := &Message{} //store message
-
-			unmarshal(byteMessage, message1) //unMarshall returns *Message
-			s.serverConn.WriteToUDP(byteMessage, sClient.addr)
+			sClient.writeConnectAck(ack, ackRequest.plain, s)
 		}
 	}
 }
-func (s *server) searchClientToClose(connID int) *s_client {
-	for i := 0; i < len(s.connectedClients); i++ {
-		sClient := s.connectedClients[i]
-		if sClient.connID == connID {
-			return sClient
-		}
-	}
-	return nil
-}
-
-func (s *server) searchClient(addr *lspnet.UDPAddr) *s_client {
-	for i := 0; i < len(s.connectedClients); i++ {
-		sClient := s.connectedClients[i]
-		if strings.Compare(sClient.addr.String(), addr.String()) == 0 {
-			return sClient
-		}
-	}
-	return nil
-}
 func (s *server) readRoutine() {
 	for {
 		select {
 		case <-s.readCloseChan:
 			return
 		default:
-			serverConn := s.serverConn
-			b := make([]byte, 2000)
-			size, addr, err := serverConn.ReadFromUDP(b)
-			if err == nil { //deal with error later
-				var message Message           //store message
-				unmarshal(b[:size], &message) //unMarshall returns *Message
-				if integrityCheck(&message) { //check integrity here with checksum and size
-					//notify c.clientTime that got some message from this client
-					s.searchClientRequestChan <- addr
-
-					sClient := <-s.searchClientReturnChan
+			b := make([]byte, maxPacketSize)
+			size, addr, err := s.transport.ReadFrom(b)
+			if err != nil { //deal with error later
+				continue
+			}
+			packet, sealed := s.open(b[:size]) //nil unless it came from a client in secure mode
+			if packet != nil {
+				var message Message                  //store message
+				if decode(packet, &message) == nil { //lookupClient checks integrity, counting failures against the client
+					sClient := s.lookupClient(&message, addr)
+					//every send below gives up once CloseContext has been cancelled
 					if sClient != nil {
-						sClient.gotMessageChan <- 1
-
+						sClient.stats.heard(s.wheel.clock.Now()) //the epoch timer looks at it
 					}
 					//deal with differenet types of messages
 					if message.Type == MsgData {
 						if sClient != nil {
-							sClient.messageChan <- &message
+							select {
+							case sClient.messageChan <- &message:
+							case <-s.cancelChan:
+							case <-sClient.clientDoneChan:
+							}
 							//else if seq <seqExpected, then don't worry about returning it to Read()
 
 						}
@@ -323,27 +498,81 @@ func (s *server) readRoutine() {
 							addr,
 						}
 						//check if the client is already connected on the server end
-						//newClient := s.searchClient(addr)
 						var newClient *s_client = nil
-						if sClient == nil { //first connect message
-							s.connectChan <- request
+						if sClient == nil && message.Token != 0 { //resuming a session that is gone
+							continue
+						} else if sClient == nil { //first connect message
+							if !s.admit(&message, addr) { //no state until the client proves its address
+								continue
+							}
+							select {
+							case s.connectChan <- request:
+							case <-s.cancelChan:
+								continue
+							}
 							newClient = <-s.newClientChan //wait for new client from main
+							if newClient == nil {         //too many clients already
+								continue
+							}
 						} else {
 							newClient = sClient
+							if message.Token != 0 { //the client is resuming its session
+								select {
+								case sClient.resumeChan <- 1:
+								case <-s.cancelChan:
+									continue
+								case <-sClient.clientDoneChan:
+									continue
+								}
+							}
 						}
 						//make new server side client struct in mainRoutine
 						ack := NewAck(newClient.connID, 0)
+						ack.Codec = newClient.codec //tell the client which codec to use
+						ack.Features = newClient.features
+						ack.Token = newClient.token
+						newClient.params.connParams().put(ack)
 						ackRequest := &writeAckRequest{
 							ack:    ack,
 							client: newClient,
+							plain:  !sealed,
+						}
+						select {
+						case s.writeAckChan <- ackRequest:
+						case <-s.cancelChan:
 						}
-						s.writeAckChan <- ackRequest
 						//if its ACK, do sth later for epoch
 					} else if message.Type == MsgAck {
-						//sClient := s.searchClient(addr)
 
 						if sClient != nil && message.SeqNum != 0 { //check if it's not just a reminder message
-							sClient.resendSuccessChan <- message.SeqNum
+							select {
+							case sClient.resendSuccessChan <- &message:
+							case <-s.cancelChan:
+							case <-sClient.clientDoneChan:
+							}
+						} else if sClient != nil { //a reminder shows a suspended client is back
+							select {
+							case sClient.resumeChan <- 1:
+							case <-s.cancelChan:
+							case <-sClient.clientDoneChan:
+							}
+						}
+					} else if message.Type == MsgSack {
+						if sClient != nil {
+							select {
+							case sClient.sackChan <- &message:
+							case <-s.cancelChan:
+							case <-sClient.clientDoneChan:
+							}
+						}
+					} else if message.Type == MsgClose {
+						s.sendCloseAck(&message, sClient, addr)
+						if sClient != nil {
+							notify(sClient.peerCloseChan)
+						}
+					} else if message.Type == MsgCloseAck {
+						if sClient != nil {
+							notify(sClient.closeAckChan)
 						}
 					}
 
@@ -362,78 +591,326 @@ func (c *s_client) alreadyReceived(seq int) bool {
 	return false
 }
 
-func (sClient *s_client) resendRoutine(elem *windowElem, s *server) {
-	//wrtie to client, potentially sending message to server's main routine to handle
+// resend sends elem and keeps sending it on the server's timer wheel, every
+// timeout at first, until it is stopped.
+func (sClient *s_client) resend(elem *windowElem, timeout time.Duration, s *server) {
+	elem.sentAt = s.wheel.clock.Now()
+	sClient.writeTo(elem.msg, s)
+	elem.start(s.wheel, timeout, func() { sClient.retransmit(elem, s) })
+}
 
-	s.serverConn.WriteToUDP(elem.msg, sClient.addr)
-	maxBackOff := s.params.MaxBackOffInterval
-	curBackOff := 0
-	epochPassed := 0
-	timer := time.NewTimer(time.Duration(s.params.EpochMillis) * time.Millisecond)
+// retransmit sends elem again once its timeout is up. It runs on the timer
+// wheel.
+func (sClient *s_client) retransmit(elem *windowElem, s *server) {
+	if elem.backOff(s.params.MaxBackOffInterval) {
+		sClient.writeTo(elem.msg, s)
+		elem.retransmitted = true
+		if elem.seqNum != 0 { //not a close message
+			sClient.stats.retransmissions.Add(1)
+		}
+		elem.timeout = nextTimeout(elem.timeout, sClient.params)
+		if s.params.CongestionControl && elem.seqNum != 0 {
+			sClient.timeouts.push(elem.seqNum) //let clientMain shrink the congestion window
+		}
+	}
+	elem.timer.reset(elem.timeout)
+}
 
-	for {
-		select {
-		case <-elem.ackChan:
-			return
-		case <-timer.C: //resend
-			if epochPassed >= curBackOff {
-				epochPassed = 0
-				s.serverConn.WriteToUDP(elem.msg, sClient.addr)
-				if curBackOff == 0 {
-					curBackOff = min(curBackOff+1, maxBackOff)
-				} else {
-					curBackOff = min(curBackOff*2, maxBackOff)
-				}
-			} else {
-				epochPassed += 1
+// heartbeat reminds the client we're still here. It runs on the timer wheel
+// every epoch the client isn't heard from.
+func (sClient *s_client) heartbeat(s *server) {
+	if msg, err := encode(NewAck(sClient.connID, 0), sClient.codec); err == nil {
+		sClient.writeTo(msg, s)
+	}
+}
+func (sClient *s_client) checkAllSent(s *server) bool {
+	ifAllNil := true
+	for i := 0; i < sClient.params.WindowSize; i++ {
+		if sClient.window[i] != nil {
+			ifAllNil = false
+		}
+	}
+	if ifAllNil {
+		return sClient.writeBuffer.len() == 0
+	}
+	return false
+}
+func (sClient *s_client) stopResending(s *server) { //stop the resend routine for each message in the window
+	for i := 0; i < sClient.params.WindowSize; i++ {
+		if sClient.window[i] != nil {
+			if !sClient.suspended { //a suspended window has no resend routines
+				sClient.window[i].stop()
 			}
+			sClient.window[i] = nil
+		}
+	}
+	sClient.stopClosing()
+	sClient.suspended = false
+}
 
-			timer = time.NewTimer(time.Duration(s.params.EpochMillis+500) * time.Millisecond)
-
+// lost gives up on the client after the epoch limit. It returns true if
+// clientMain terminated.
+func (sClient *s_client) lost(s *server) bool {
+	sClient.stopResending(s)
+	sClient.ended(ConnLost, s)
+	if sClient.aboutToClose { //if closeConn called
+		//ignore pendingMessages
+		sClient.clientTerminateAll(s) //might block
+		return true
+	}
+	//regular timeout
+	sClient.aboutToClose = true
+	sClient.endStreams()
+	if sClient.drained() { //no more message to Push to Read()
+		sClient.clientTerminateAll(s) //might block
+		select {
+		case s.readReturnChan <- sClient.droppedMessage():
+		case <-s.cancelChan:
+		case <-s.quitChan: //the server closed, nobody reads it any more
 		}
+		return true //terminate clientMain since won't be used anymore
 	}
+	return false
 }
-func (sClient *s_client) clientTime(s *server) {
-	epoch := s.params.EpochMillis
-	epochLimit := s.params.EpochLimit
-	reminderTimer := time.NewTimer(time.Duration(epoch) * time.Millisecond)
-	connDropTimer := time.NewTimer(time.Duration(epoch*epochLimit) * time.Millisecond)
-	ack := NewAck(sClient.connID, 0) //reminder ack
-	msg, err := marshal(ack)         //message to be sent to client
-	_ = err
+func (sClient *s_client) clientTerminateAll(s *server) { //terminate all routine
+	sClient.ended(ConnClosedLocally, s) //unless it was lost or closed by the client
+	sClient.endStreams()
+	sClient.epochs.stop()
 	for {
 		select {
-		case <-sClient.clientTimeCloseChan:
+		case s.clientRemoveChan <- sClient.connID: //remove it self from connectedClient
+			return
+		case <-sClient.clientCloseChan: //Close is telling every client, this one is going anyway
+		case <-s.cancelChan: //mainRoutine no longer waits for clients
 			return
-		case <-reminderTimer.C: //haven't received anything from this client for a epoch
-			s.serverConn.WriteToUDP(msg, sClient.addr)
-			reminderTimer = time.NewTimer(time.Duration(epoch) * time.Millisecond)
-		case <-connDropTimer.C: //connection dropped
+		}
+	}
+}
 
-			sClient.connDropChan <- 1
+func (sClient *s_client) queueData(stream int, payload []byte, fragIndex, fragCount int, mode DeliveryMode, s *server) {
+	data := newFragment(sClient.connID, 0, payload, fragIndex, fragCount)
+	data.Mode = mode
+	if st := sClient.streams[stream]; st != nil {
+		data.Stream = stream
+		data.StreamSeq = st.writeSeqNum
+		st.writeSeqNum += 1
+	}
+	sClient.writeBuffer.push(newQueuedData(data)) //gets its seqNum once it fits in the window
+	sClient.fillWindow(s)
+}
+
+// fillWindow moves messages from the writeBuffer into the window and sends
+// them, as long as they fit in the window and the congestion window allows
+// more messages in flight
+func (sClient *s_client) fillWindow(s *server) {
+	if sClient.suspended { //nothing goes out until the session is resumed
+		return
+	}
+	inFlight := 0
+	for _, elem := range sClient.window {
+		if elem != nil {
+			inFlight += 1
+		}
+	}
+	for sClient.writeBuffer.len() > 0 && inFlight < sendLimit(sClient.congestion.size(), sClient.peerWindow) {
+		if sClient.writeSeqNum >= sClient.windowStart+sClient.params.WindowSize {
+			break
+		}
+		elem := sClient.writeBuffer.pop()
+		elem.seal(sClient.writeSeqNum, sClient.codec, sClient.integrity)
+		sClient.stats.dataSent += 1
+		sClient.writeSeqNum += 1
+		sClient.window[elem.seqNum-sClient.windowStart] = elem
+		inFlight += 1
+		sClient.resend(elem, sClient.rtt.timeout(), s)
+	}
+}
 
-		case <-sClient.gotMessageChan: //got sth, reset timmer
-			reminderTimer = time.NewTimer(time.Duration(epoch) * time.Millisecond)
-			connDropTimer = time.NewTimer(time.Duration(epoch*epochLimit) * time.Millisecond)
+// takeMessage makes the in-order data message the next one for Read. A
+// fragment is only buffered and the next message is looked up, until the
+// last fragment completes the original payload.
+func (sClient *s_client) takeMessage(message *Message) {
+	if message.Stream != 0 || message.Mode == ReliableUnordered { //already delivered
+		sClient.seqExpected += 1
+		sClient.takePending()
+		return
+	}
+	if message.FragCount <= 1 {
+		sClient.messageToPush = &readReturn{
+			connID:  message.ConnID,
+			seqNum:  message.SeqNum,
+			payload: message.Payload,
+			err:     nil,
 		}
+		return
+	}
+	payload, ok := sClient.fragments.add(message, sClient.params.maxMessageSize())
+	if !ok {
+		sClient.seqExpected += 1 //fragments never reach Read on their own
+		sClient.takePending()
+		return
+	}
+	sClient.messageToPush = &readReturn{
+		connID:  message.ConnID,
+		seqNum:  message.SeqNum,
+		payload: payload,
+		err:     nil,
 	}
 }
-func (sClient *s_client) checkAllSent(s *server) bool {
-	ifAllNil := true
-	for i := 0; i < s.params.WindowSize; i++ {
-		if sClient.window[i] != nil {
-			ifAllNil = false
+
+// takePending moves the message with seqExpected out of pendingMessages
+func (sClient *s_client) takePending() {
+	for i := 0; i < len(sClient.pendingMessages); i++ {
+		message := sClient.pendingMessages[i]
+		if message.SeqNum == sClient.seqExpected {
+			//cut this message off pendingMessages
+			sClient.pendingMessages = append(sClient.pendingMessages[:i], sClient.pendingMessages[i+1:]...)
+			sClient.takeMessage(message)
+			break //make sure only push one message to the read()
 		}
 	}
-	if ifAllNil {
-		return len(sClient.writeBuffer) == 0
+}
+
+// retire removes the acked message from the window, slides the window and
+// moves buffered messages into it. It returns true if the client terminated
+// because this was the last message pending before CloseConn or Close.
+func (sClient *s_client) retire(seqNum int, s *server) bool {
+	if seqNum < sClient.windowStart || seqNum >= sClient.windowStart+sClient.params.WindowSize { //if sth already passed
+		return false
+	}
+	index := seqNum - sClient.windowStart
+	if sClient.window[index] == nil { //duplicate ack
+		return false
+	}
+	if !sClient.suspended {
+		sClient.window[index].stop()
 	}
+	sClient.rtt.observe(sClient.window[index])
+	if !sClient.window[index].retransmitted {
+		sClient.congestion.onAck()
+	}
+	sClient.window[index] = nil
+	window := sClient.window
+
+	if sClient.aboutToClose && sClient.checkAllSent(s) { //no more pending messages
+		return sClient.flushed(s)
+	}
+	//if the flag is true, check if window is all nil, len(writeBuffer ) ==0
+	//all resending should be stopped, and stop the epochs for this client
+	//and send itself to s.clientRemoveChan
+
+	if index == 0 { //need to update windowStart
+		offset := 0
+		for i := 0; i < sClient.params.WindowSize; i++ {
+			if window[i] == nil {
+				offset += 1
+			} else {
+				break
+			}
+		}
+		// for cleaniness and garbage recollection purpose, remake
+		// the window every time we slide the window
+		// never slide past the next message to send
+		offset = min(sClient.writeSeqNum-sClient.windowStart, offset)
+		windowSize := sClient.params.WindowSize
+		newWindow := make([]*windowElem, windowSize)
+		for i := offset; i < windowSize; i++ {
+			newWindow[i-offset] = window[i]
+		}
+		//change windowStart
+		sClient.windowStart += offset
+		sClient.window = newWindow
+	}
+	// add elements in the buffer to the window
+	sClient.fillWindow(s)
 	return false
 }
-func (sClient *s_client) clientTerminateAll(s *server) { //terminate all routine
-	sClient.clientTimeCloseChan <- 1
-	s.clientRemoveChan <- sClient.connID //remove it self from connectedClient
 
+// unread returns the number of messages from the client waiting for Read
+func (sClient *s_client) unread() int {
+	unread := len(sClient.pendingMessages) + len(sClient.unordered.reliable) + streamsUnread(sClient.streams)
+	if sClient.messageToPush != nil {
+		unread += 1
+	}
+	return unread
+}
+
+// receiveWindow returns the window to advertise in acks, zero if the client
+// doesn't do flow control
+func (sClient *s_client) receiveWindow(s *server) int {
+	if sClient.features&FeatureFlowControl == 0 {
+		return 0
+	}
+	return receiveWindow(s.params, sClient.unread())
+}
+
+// updatePeerWindow takes the receive window advertised in an ack from the
+// client, a larger window may let buffered messages go out
+func (sClient *s_client) updatePeerWindow(ack *Message, s *server) {
+	if sClient.features&FeatureFlowControl == 0 {
+		return
+	}
+	sClient.peerWindow = ack.Window
+	sClient.fillWindow(s)
+}
+
+// ackData acknowledges a data message, the same way as the client does.
+func (sClient *s_client) ackData(seqNum int, duplicate bool, s *server) {
+	if sClient.features&FeatureSack == 0 {
+		ack := NewAck(sClient.connID, seqNum)
+		ack.Window = sClient.receiveWindow(s)
+		sClient.sendAck(ack, s)
+		return
+	}
+	sClient.unackedData += 1
+	if duplicate || len(sClient.pendingMessages) > 0 || sClient.unackedData >= 2 {
+		sClient.sendSack(s)
+	} else if sClient.sackTimerChan == nil {
+		sClient.sackTimerChan = s.wheel.clock.NewTimer(sackDelay(sClient.params)).C()
+	}
+}
+
+func (sClient *s_client) sendSack(s *server) {
+	sClient.sendAck(makeSack(sClient.connID, sClient.ackedThrough(), sClient.receiveWindow(s), sClient.pendingMessages), s)
+	sClient.unackedData = 0
+	sClient.sackTimerChan = nil
+}
+
+// sendAck writes the ack straight to the client like retransmit does, since
+// going through mainRoutine could deadlock while it waits on addToWindowChan
+func (sClient *s_client) sendAck(ack *Message, s *server) {
+	sClient.integrity.sign(ack)
+	byteMessage, _ := encode(ack, sClient.codec)
+	sClient.writeTo(byteMessage, s)
+}
+
+// ackedThrough returns the highest seqNum such that every data message up to
+// it has been received
+func (sClient *s_client) ackedThrough() int {
+	through := sClient.seqExpected - 1
+	if sClient.messageToPush != nil {
+		through = sClient.seqExpected
+	}
+	for sClient.alreadyReceived(through + 1) {
+		through += 1
+	}
+	return through
+}
+
+// afterRead lets Read fail once the client is gone and every message from
+// it has been read. It returns true if clientMain has to terminate.
+func (sClient *s_client) afterRead(s *server) bool {
+	if !sClient.drained() || !sClient.aboutToClose { //more to read, or the client is still here
+		return false
+	}
+	sClient.countReady(s)
+	select {
+	case sClient.droppedChan(s) <- sClient.droppedMessage(): //might block
+	case <-s.cancelChan:
+		sClient.stopResending(s)
+	case <-s.quitChan: //the server closed, nobody reads it any more
+	}
+	return true
 }
 
 //would block until Read() is called
@@ -441,43 +918,76 @@ func (sClient *s_client) clientTerminateAll(s *server) { //terminate all routine
 //append out of order messages to pendingMessages, try to push the correct
 //message to s.readReturnChan when have one
 func (sClient *s_client) clientMain(s *server) {
+	defer close(sClient.clientDoneChan)
 	for {
 		var readReturnChan chan *readReturn
 		readReturnChan = nil
+		sClient.countReady(s)
 
 		if sClient.messageToPush != nil && sClient.messageToPush.seqNum == sClient.seqExpected {
 			readReturnChan = s.readReturnChan
 		}
+		var unorderedChan chan *readReturn
+		if sClient.unordered.len() > 0 {
+			unorderedChan = s.readReturnChan
+		}
+		if sClient.held.Load() { //kept with the client until it is let go
+			readReturnChan = nil
+			unorderedChan = nil
+		}
+		var acceptChan chan *stream
+		var nextStream *stream
+		if len(sClient.accepted) > 0 {
+			acceptChan = sClient.acceptChan
+			nextStream = sClient.accepted[0]
+		}
 
 		select {
 		case <-sClient.clientCloseChan: //CloseConn or Close called
 			//set sth to true
 			sClient.aboutToClose = true
-			if sClient.checkAllSent(s) { //no resend routine around
-				sClient.clientTerminateAll(s)
+			if sClient.checkAllSent(s) && sClient.flushed(s) { //no resend routine around
 				return
 			}
+		case <-s.cancelChan: //CloseContext gave up waiting for pending messages
+			sClient.stopResending(s)
+			return
 		case message := <-sClient.messageChan:
+			if sClient.suspended { //the client is back
+				sClient.resume(s)
+			}
 			if sClient.aboutToClose == false { //ignore incoming data messages from the client if it's closed here
-				ack := NewAck(message.ConnID, message.SeqNum)
-				ackRequest := &writeAckRequest{
-					ack:    ack,
-					client: sClient,
+				if message.Mode == Unreliable { //never acked
+					sClient.stats.received(false)
+					sClient.unordered.push(message)
+					continue
+				}
+				duplicate := message.SeqNum < sClient.seqExpected || sClient.alreadyReceived(message.SeqNum) ||
+					(message.SeqNum == sClient.seqExpected && sClient.messageToPush != nil)
+				if !duplicate && message.SeqNum > sClient.seqExpected && overLimit(s.params, sClient.unread()) {
+					continue //no room, the client sends it again later
+				}
+				if !duplicate && message.Mode == ReliableUnordered && overLimit(s.params, len(sClient.unordered.reliable)) {
+					continue //taken at once, so only held back by the ones Read has yet to take
+				}
+				if !duplicate && streamFull(s.params, sClient.streams, message) {
+					continue //likewise held back by its stream
+				}
+				sClient.stats.received(duplicate)
+				if !duplicate && message.Stream != 0 { //streams don't wait for stream 0
+					sClient.receiveStream(message, s)
+				}
+				if !duplicate && message.Mode == ReliableUnordered { //read at once, still acked in order
+					sClient.unordered.push(message)
 				}
-				s.writeAckChan <- ackRequest
 				if message.SeqNum > sClient.seqExpected {
 					if !sClient.alreadyReceived(message.SeqNum) {
 						sClient.pendingMessages = append(sClient.pendingMessages, message)
 					}
-				} else if message.SeqNum == sClient.seqExpected {
-					wrapMessage := &readReturn{
-						connID:  message.ConnID,
-						seqNum:  message.SeqNum,
-						payload: message.Payload,
-						err:     nil,
-					}
-					sClient.messageToPush = wrapMessage
+				} else if message.SeqNum == sClient.seqExpected && sClient.messageToPush == nil {
+					sClient.takeMessage(message)
 				}
+				sClient.ackData(message.SeqNum, duplicate, s)
 			}
 		case readReturnChan <- sClient.messageToPush:
 			//if entered here, means we just pushed the message with seqNum
@@ -489,145 +999,101 @@ func (sClient *s_client) clientMain(s *server) {
 			//go through pending messages and check if already received the next
 			//message in order, check againt client.seqExpected
 			sClient.messageToPush = nil
-			for i := 0; i < len(sClient.pendingMessages); i++ {
-				message := sClient.pendingMessages[i]
-				if message.SeqNum == sClient.seqExpected {
-					//make sure sending messages out in order
-					wrapMessage := &readReturn{
-						connID:  message.ConnID,
-						seqNum:  message.SeqNum,
-						payload: message.Payload,
-						err:     nil,
-					}
-					sClient.messageToPush = wrapMessage
-					//cut this message off pendingMessages
-					sClient.pendingMessages = append(sClient.pendingMessages[:i], sClient.pendingMessages[i+1:]...)
-
-					break //make sure only push one message to the read()
-				}
+			sClient.takePending() //make sure sending messages out in order
+			if sClient.afterRead(s) {
+				return
 			}
-			if sClient.messageToPush == nil && sClient.aboutToClose { //no more message to Push to Read()
-				droppedMsg := &readReturn{
-					connID:  sClient.connID,
-					seqNum:  -1,
-					payload: nil,
-					err:     errors.New("This client disconnected"),
-				}
-				s.readReturnChan <- droppedMsg //might block
+		case unorderedChan <- sClient.unordered.next():
+			sClient.unordered.pop()
+			if sClient.afterRead(s) {
 				return
-
 			}
 		// below two cases are for partA
-		case payload := <-sClient.addToWindowChan:
+		case request := <-sClient.addToWindowChan:
 			//don't do Write() application call when closeConn is closed
 			if sClient.aboutToClose == false {
-				seqNum := sClient.writeSeqNum
-				sClient.writeSeqNum += 1
-				size := len(payload)
-				checksum := makeCheckSum(sClient.connID, seqNum, size, payload)
-				original := NewData(sClient.connID, seqNum, size, payload, checksum)
-				msg, err := marshal(original)
-				if err != nil {
-					//don't do anything?
-					//s.writeBackChan <- err
-					continue
+				mode := request.mode
+				if sClient.features&FeatureModes == 0 { //the client reads everything in order
+					mode = ReliableOrdered
 				}
-
-				elem := &windowElem{
-					seqNum:  seqNum,
-					ackChan: make(chan int),
-					msg:     msg,
+				if mode == Unreliable {
+					sClient.sendDatagram(request.payload, s)
+					continue
 				}
-				// the below condition is ** key **
-				if seqNum < sClient.windowStart+s.params.WindowSize && sClient.window[seqNum-sClient.windowStart] == nil {
-					// can be put into the window
-					sClient.window[seqNum-sClient.windowStart] = elem
-					go sClient.resendRoutine(elem, s) // NOTE: the first time sending is also done in resendRoutine
-				} else {
-					sClient.writeBuffer = append(sClient.writeBuffer, elem)
-
+				//large payloads go out as several fragments, each with its own seqNum
+				fragments := splitPayload(request.payload, s.params.maxFragmentSize())
+				for i, fragment := range fragments {
+					sClient.queueData(request.stream, fragment, i, len(fragments), mode, s)
 				}
 			}
+		case acceptChan <- nextStream:
+			sClient.accepted = sClient.accepted[1:]
+		case <-sClient.statsChan:
+			sClient.statsReturnChan <- sClient.stats.snapshot(sClient.window, &sClient.writeBuffer, sClient.pendingMessages, sClient.rtt)
 
-		case seqNum := <-sClient.resendSuccessChan:
-			if seqNum < sClient.windowStart { //if sth already passed
-				continue
+		case ack := <-sClient.resendSuccessChan:
+			if sClient.suspended {
+				sClient.resume(s)
 			}
-			index := seqNum - sClient.windowStart
-			sClient.window[index].ackChan <- 1 //let resendRoutine for this message stop
-			sClient.window[index] = nil
-			window := sClient.window
-
-			if sClient.aboutToClose && sClient.checkAllSent(s) { //no more pending messages
-				sClient.clientTerminateAll(s)
+			sClient.updatePeerWindow(ack, s)
+			if sClient.retire(ack.SeqNum, s) {
 				return
 			}
-			//if the flag is true, check if window is all nil, len(writeBuffer ) ==0
-			//all resendRoutine should be stopped, and stop the timeRoutine for this client
-			//and send itself to s.clientRemoveChan
-
-			if index == 0 { //need to update windowStart
-				buffer := sClient.writeBuffer
-				offset := 0
-				for i := 0; i < s.params.WindowSize; i++ {
-					if window[i] == nil {
-						offset += 1
-					} else {
-						break
-					}
-				}
-				// for cleaniness and garbage recollection purpose, remake
-				// the window every time we slide the window
-				offset = min(sClient.writeSeqNum-sClient.windowStart, offset)
-				windowSize := s.params.WindowSize
-				newWindow := make([]*windowElem, windowSize)
-				for i := offset; i < windowSize; i++ {
-					newWindow[i-offset] = window[i]
-				}
-
-				// add element in the buffer to the window
-				emptyStartIndex := windowSize - offset
-				bufferToCopy := min(len(sClient.writeBuffer), offset)
-				for i := 0; i < bufferToCopy; i++ {
-					newWindow[i+emptyStartIndex] = buffer[i]
-					go sClient.resendRoutine(buffer[i], s)
+		case sack := <-sClient.sackChan:
+			seqNums, ok := sack.sackedSeqNums(sClient.windowStart, sClient.writeSeqNum-1)
+			if !ok {
+				continue
+			}
+			if sClient.suspended {
+				sClient.resume(s)
+			}
+			sClient.updatePeerWindow(sack, s)
+			terminated := false
+			for _, seqNum := range seqNums {
+				if terminated = sClient.retire(seqNum, s); terminated {
+					break
 				}
-				// shrink the buffer
-				newBuffer := buffer[bufferToCopy:]
-				//change windowStart
-				sClient.windowStart += offset
-				//update window, buffer
-				sClient.window = newWindow
-				sClient.writeBuffer = newBuffer
 			}
+			if terminated {
+				return
+			}
+		case <-sClient.timeouts.readyChan:
+			for _, seqNum := range sClient.timeouts.take() {
+				sClient.congestion.onTimeout(seqNum, sClient.writeSeqNum)
+			}
+		case <-sClient.sackTimerChan:
+			sClient.sendSack(s)
 		case <-sClient.connDropChan: //conneciton dropped
-
-			for i := 0; i < s.params.WindowSize; i++ {
-				if sClient.window[i] != nil {
-					sClient.window[i].ackChan <- 1 //stop the resend routine
-
-				}
+			if sClient.suspended { //the grace period decides
+				continue
+			}
+			if !sClient.aboutToClose && sClient.canResume() {
+				sClient.suspend(s) //give the client a chance to resume the session
+				continue
 			}
-			if sClient.aboutToClose { //if closeConn called
-				//ignore pendingMessages
-				sClient.clientTerminateAll(s) //might block
-				//s.readReturnChan <- droppedMsg
+			if sClient.lost(s) {
 				return
 			}
-			//regular timeout
-			sClient.aboutToClose = true
-			if sClient.messageToPush == nil { //no more message to Push to Read()
-				droppedMsg := &readReturn{
-					connID:  sClient.connID,
-					seqNum:  -1,
-					payload: nil,
-					err:     errors.New("This client disconnected"),
-				}
-				sClient.clientTerminateAll(s) //might block
-				s.readReturnChan <- droppedMsg
-				return //terminate clientMain since won't be used anymore
+		case <-sClient.graceChan: //client didn't come back in time
+			sClient.graceChan = nil
+			if sClient.lost(s) {
+				return
+			}
+		case <-sClient.heldChan: //look again
+		case <-sClient.resumeChan:
+			if sClient.suspended {
+				sClient.resume(s)
+			}
+		case <-sClient.peerCloseChan:
+			if sClient.closedByPeer(s) {
+				return
+			}
+		case <-sClient.closeAckChan:
+			if sClient.closeElem != nil { //the client knows we're gone
+				sClient.stopResending(s)
+				sClient.clientTerminateAll(s)
+				return
 			}
-
 		}
 	}
 }
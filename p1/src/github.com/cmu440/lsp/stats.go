@@ -0,0 +1,75 @@
+// Contains the statistics a client and a server keep about each connection.
+
+package lsp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of the health of one connection, as seen from the
+// end it was taken at.
+type ConnStats struct {
+	DataSent          uint64        // data messages sent, not counting retransmissions
+	DataReceived      uint64        // data messages received, not counting duplicates
+	Retransmissions   uint64        // data messages sent again because no ack came in time
+	Duplicates        uint64        // data messages received again after they were acked
+	IntegrityFailures uint64        // messages dropped because they failed the integrity check
+	WindowInUse       int           // data messages sent and not acked yet
+	WriteBuffered     int           // data messages waiting for room in the window
+	OutOfOrder        int           // data messages received ahead of one still missing
+	LastHeard         time.Time     // when anything last arrived from the peer, zero if nothing has
+	RTT               time.Duration // smoothed round trip time, zero before the first ack
+	RTO               time.Duration // current retransmission timeout
+}
+
+// connCounters are the counters behind ConnStats. The plain ones are only
+// touched by the connection's own event loop. The atomic ones are bumped by
+// the routines around it, so that none of them needs a lock.
+type connCounters struct {
+	dataSent          uint64
+	dataReceived      uint64
+	duplicates        uint64
+	retransmissions   atomic.Uint64 // the timer wheel
+	integrityFailures atomic.Uint64 // readRoutine, or lookupClient on the server
+	lastHeard         atomic.Int64  // unix nanoseconds, readRoutine
+}
+
+// received counts a data message handed to the event loop
+func (cc *connCounters) received(duplicate bool) {
+	if duplicate {
+		cc.duplicates += 1
+	} else {
+		cc.dataReceived += 1
+	}
+}
+
+// heard records that something arrived from the peer at now
+func (cc *connCounters) heard(now time.Time) {
+	cc.lastHeard.Store(now.UnixNano())
+}
+
+// snapshot returns the statistics of a connection, given the state only its
+// event loop may look at.
+func (cc *connCounters) snapshot(window []*windowElem, writeBuffer *sendQueue, pending []*Message, rtt *rttEstimator) ConnStats {
+	stats := ConnStats{
+		DataSent:          cc.dataSent,
+		DataReceived:      cc.dataReceived,
+		Retransmissions:   cc.retransmissions.Load(),
+		Duplicates:        cc.duplicates,
+		IntegrityFailures: cc.integrityFailures.Load(),
+		WriteBuffered:     writeBuffer.len(),
+		OutOfOrder:        len(pending),
+		RTT:               rtt.srtt,
+		RTO:               rtt.timeout(),
+	}
+	for _, elem := range window {
+		if elem != nil {
+			stats.WindowInUse += 1
+		}
+	}
+	if heard := cc.lastHeard.Load(); heard != 0 {
+		stats.LastHeard = time.Unix(0, heard)
+	}
+	return stats
+}
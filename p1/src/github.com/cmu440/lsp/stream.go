@@ -0,0 +1,352 @@
+// Contains the streams multiplexed over a single LSP connection.
+
+package lsp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Stream is one of several independently ordered sequences of messages
+// carried by a single LSP connection. Every stream has its own sequence
+// space, so messages on a stream are read in the order they were written to
+// it no matter how far behind the connection's other streams are, and a long
+// transfer on one stream doesn't hold back messages written to another. The
+// epoch heartbeats, liveness detection and close handshake belong to the
+// connection, which is why a stream has no Close of its own: it ends with
+// its connection.
+//
+// Clients open streams with OpenStream, and the server gets each of them
+// from AcceptStream once its first message arrives. The connection's own
+// Read and Write use stream 0, which is never returned as a Stream.
+type Stream interface {
+	// ID returns the stream ID, unique within its connection.
+	ID() int
+
+	// Read reads the next message written to this stream by the other end.
+	// It blocks until a message is ready, and returns a non-nil error once
+	// the connection has been closed or lost and every message received on
+	// the stream has been read. On a server, messages still unread once its
+	// own Read has returned the error for the connection are dropped.
+	// Messages waiting on a stream count against MaxUnreadMessages like
+	// the connection's, and once a stream alone holds that many, the
+	// connection takes nothing more until it is read.
+	Read() ([]byte, error)
+
+	// Write sends a message on this stream. Like the connection's Write it
+	// doesn't block, and returns a non-nil error if the connection is gone.
+	Write(payload []byte) error
+
+	// ReadContext behaves like Read, but returns ctx.Err() if ctx is done
+	// before a message is ready to be returned.
+	ReadContext(ctx context.Context) ([]byte, error)
+
+	// WriteContext behaves like Write, but returns ctx.Err() if ctx is done
+	// before the payload has been handed off.
+	WriteContext(ctx context.Context, payload []byte) error
+}
+
+type stream struct {
+	id             int
+	readReturnChan chan *readReturn // streamRoutine hands messages to Read
+	endedChan      chan int         // closed once every message was read, err is set by then
+	err            error            // what every Read returns once the stream ended
+	quitChan       chan int         // closed once the connection is done with
+	queued         atomic.Int64     // messages delivered that Read has yet to take
+	write          func(ctx context.Context, stream int, payload []byte) error
+}
+
+func (st *stream) ID() int {
+	return st.id
+}
+
+func (st *stream) Read() ([]byte, error) {
+	return st.ReadContext(context.Background())
+}
+
+func (st *stream) Write(payload []byte) error {
+	return st.WriteContext(context.Background(), payload)
+}
+
+func (st *stream) ReadContext(ctx context.Context) ([]byte, error) {
+	select {
+	case message := <-st.readReturnChan:
+		return message.payload, message.err
+	case <-st.endedChan:
+		return nil, st.err
+	case <-st.quitChan:
+		return nil, errors.New("Connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (st *stream) WriteContext(ctx context.Context, payload []byte) error {
+	return st.write(ctx, st.id, payload)
+}
+
+// streamState is what the routine owning a connection keeps for each of its
+// streams.
+type streamState struct {
+	stream      *stream
+	writeSeqNum int              // StreamSeq of the next message written, start with 1
+	seqExpected int              // StreamSeq of the next message to deliver, start with 1
+	pending     []*Message       // received out of order
+	fragments   reassembly       // the fragmented message being reassembled
+	maxSize     int              // the largest payload reassembled, MaxMessageSize
+	deliverChan chan *readReturn // hands messages to streamRoutine
+	ended       bool             // the connection's error has been delivered
+}
+
+func newStreamState(id int, quitChan chan int, maxSize int, write func(context.Context, int, []byte) error) *streamState {
+	st := &streamState{
+		stream: &stream{
+			id:             id,
+			readReturnChan: make(chan *readReturn),
+			endedChan:      make(chan int),
+			quitChan:       quitChan,
+			write:          write,
+		},
+		writeSeqNum: 1,
+		seqExpected: 1,
+		pending:     make([]*Message, 0),
+		maxSize:     maxSize,
+		deliverChan: make(chan *readReturn),
+	}
+	go streamRoutine(st.stream, st.deliverChan)
+	return st
+}
+
+// streamRoutine queues the messages delivered to a stream until Read takes
+// them, so the routine owning the connection never waits for a slow reader.
+// Once only the error is left it ends the stream, which returns the error to
+// every Read after.
+func streamRoutine(st *stream, deliverChan chan *readReturn) {
+	queue := make([]*readReturn, 0)
+	for {
+		var readChan chan *readReturn
+		var next *readReturn
+		if len(queue) > 0 {
+			if queue[0].err != nil {
+				st.err = queue[0].err
+				close(st.endedChan)
+				return
+			}
+			readChan = st.readReturnChan
+			next = queue[0]
+		}
+		select {
+		case message := <-deliverChan:
+			queue = append(queue, message)
+		case readChan <- next:
+			queue = queue[1:]
+			st.queued.Add(-1)
+		case <-st.quitChan:
+			return
+		}
+	}
+}
+
+// receive takes a data message for the stream that isn't a duplicate and
+// delivers every message that is now complete and in order.
+func (st *streamState) receive(message *Message) {
+	st.pending = append(st.pending, message)
+	for {
+		index := -1
+		for i, pending := range st.pending {
+			if pending.StreamSeq == st.seqExpected {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return
+		}
+		next := st.pending[index]
+		st.pending = append(st.pending[:index], st.pending[index+1:]...)
+		st.seqExpected += 1
+		payload := next.Payload
+		if next.FragCount > 1 {
+			var ok bool
+			if payload, ok = st.fragments.add(next, st.maxSize); !ok {
+				continue
+			}
+		}
+		st.deliver(&readReturn{
+			connID:  next.ConnID,
+			seqNum:  next.StreamSeq,
+			payload: payload,
+			err:     nil,
+		})
+	}
+}
+
+// end lets Read on the stream fail with err once the messages already
+// delivered have been read.
+func (st *streamState) end(err error) {
+	if st.ended {
+		return
+	}
+	st.ended = true
+	st.deliver(&readReturn{
+		connID:  -1,
+		seqNum:  -1,
+		payload: nil,
+		err:     err,
+	})
+}
+
+func (st *streamState) deliver(message *readReturn) {
+	if message.err == nil {
+		st.stream.queued.Add(1)
+	}
+	select {
+	case st.deliverChan <- message:
+	case <-st.stream.endedChan:
+	case <-st.stream.quitChan:
+	}
+}
+
+// unread returns the number of messages received on the stream that Read
+// has yet to take, counted against MaxUnreadMessages like the connection's.
+func (st *streamState) unread() int {
+	return len(st.pending) + int(st.stream.queued.Load())
+}
+
+// streamsUnread returns the number of messages waiting on any of the streams
+func streamsUnread(streams map[int]*streamState) int {
+	unread := 0
+	for _, st := range streams {
+		unread += st.unread()
+	}
+	return unread
+}
+
+// streamFull tells whether a data message for a stream has to be dropped
+// without acking it, because the stream holds as many unread messages as a
+// receiver may.
+func streamFull(params *Params, streams map[int]*streamState, message *Message) bool {
+	st := streams[message.Stream]
+	return message.Stream != 0 && st != nil && overLimit(params, st.unread())
+}
+
+// sendQueue holds the messages that were written but haven't got a seqNum
+// yet, one queue per stream. The window is filled from the streams in turn,
+// so a long transfer on one stream doesn't hold back messages written to
+// another. With only stream 0 it is a plain FIFO.
+type sendQueue struct {
+	queues map[int][]*windowElem
+	order  []int // streams with queued messages, the next one to send from first
+	size   int
+}
+
+func (q *sendQueue) push(elem *windowElem) {
+	if q.queues == nil {
+		q.queues = make(map[int][]*windowElem)
+	}
+	id := elem.data.Stream
+	if len(q.queues[id]) == 0 {
+		q.order = append(q.order, id)
+	}
+	q.queues[id] = append(q.queues[id], elem)
+	q.size += 1
+}
+
+func (q *sendQueue) pop() *windowElem {
+	id := q.order[0]
+	q.order = q.order[1:]
+	queue := q.queues[id]
+	elem := queue[0]
+	if len(queue) > 1 {
+		q.queues[id] = queue[1:]
+		q.order = append(q.order, id) //back of the line
+	} else {
+		delete(q.queues, id)
+	}
+	q.size -= 1
+	return elem
+}
+
+func (q *sendQueue) len() int {
+	return q.size
+}
+
+// newQueuedData returns the window element for a data message that is queued
+// without a seqNum yet.
+func newQueuedData(data *Message) *windowElem {
+	return &windowElem{
+		data: data,
+	}
+}
+
+// seal gives a queued data message its seqNum and encodes it, just before it
+// goes out for the first time.
+func (elem *windowElem) seal(seqNum int, codec Codec, ig *integrity) {
+	data := elem.data
+	data.SeqNum = seqNum
+	data.Checksum = makeCheckSum(data.ConnID, seqNum, data.Size, data.Payload,
+		data.FragIndex, data.FragCount, data.Stream, data.StreamSeq, int(data.Mode))
+	ig.sign(data)
+	elem.seqNum = seqNum
+	elem.msg, _ = encode(data, codec)
+	elem.data = nil
+}
+
+// openStream returns a new stream for OpenStream, or nil if the server
+// doesn't do streams or the connection is gone.
+func (c *client) openStream() *stream {
+	if c.features&FeatureStreams == 0 || c.connDropped || c.closeReturn != nil || c.aboutToClose ||
+		len(c.streams) >= c.params.maxStreams() {
+		return nil
+	}
+	id := len(c.streams) + 1
+	st := newStreamState(id, c.quitChan, c.params.maxMessageSize(), c.write)
+	c.streams[id] = st
+	return st.stream
+}
+
+// receiveStream hands a data message to the stream it was written to.
+func (c *client) receiveStream(message *Message) {
+	if st := c.streams[message.Stream]; st != nil {
+		st.receive(message)
+	}
+}
+
+// endStreams lets Read fail with err on every stream.
+func (c *client) endStreams(err error) {
+	for _, st := range c.streams {
+		st.end(err)
+	}
+}
+
+// receiveStream hands a data message to the stream it was written to. The
+// first message on a stream opens it, and AcceptStream returns it. Messages
+// on streams no client opens, or on new streams past MaxStreams, are dropped.
+func (sClient *s_client) receiveStream(message *Message, s *server) {
+	if sClient.features&FeatureStreams == 0 || message.Stream <= 0 || message.Stream > s.params.maxStreams() {
+		return
+	}
+	st := sClient.streams[message.Stream]
+	if st == nil {
+		if len(sClient.streams) >= s.params.maxStreams() {
+			return
+		}
+		connID := sClient.connID
+		st = newStreamState(message.Stream, sClient.clientDoneChan, s.params.maxMessageSize(), func(ctx context.Context, stream int, payload []byte) error {
+			return s.write(ctx, connID, stream, payload)
+		})
+		sClient.streams[message.Stream] = st
+		sClient.accepted = append(sClient.accepted, st.stream)
+	}
+	st.receive(message)
+}
+
+// endStreams lets Read fail on every stream of a client that is gone, with
+// the same error Read gets for it.
+func (sClient *s_client) endStreams() {
+	err := sClient.droppedMessage().err
+	for _, st := range sClient.streams {
+		st.end(err)
+	}
+}
@@ -0,0 +1,128 @@
+// Contains the packet transports LSP runs over.
+
+package lsp
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/cmu440/lspnet"
+)
+
+// PacketTransport is what a client or server sends and receives packets
+// over. It is the packet half of net.PacketConn, so a Unix datagram socket
+// or any other net.PacketConn can be used as it is. A server reads packets
+// from any number of clients and tells them apart by the addresses ReadFrom
+// returns, whose String must stay the same for the same peer. A client
+// takes every packet its transport reads to come from the server.
+//
+// Packets are at most maxPacketSize bytes long. ReadFrom must return an
+// error once Close has been called, which is how the routine reading from
+// the transport finds out it is done.
+type PacketTransport interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// udpAddr makes an lspnet address a net.Addr.
+type udpAddr struct {
+	*lspnet.UDPAddr
+}
+
+func (a udpAddr) Network() string {
+	return "udp"
+}
+
+// udpTransport is the default transport, a socket from lspnet, which is
+// what the tests use to drop and corrupt packets. A dialed socket only
+// talks to the peer it was dialed to. The tests only look inside JSON
+// messages, so packets in the binary codec or sealed in secure mode go
+// around them and are only ever delayed or dropped.
+type udpTransport struct {
+	conn   *lspnet.UDPConn
+	dialed bool
+	peer   net.Addr // the peer of a dialed socket
+}
+
+func (t *udpTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	if t.dialed {
+		n, err := t.conn.Read(b)
+		return n, t.peer, err
+	}
+	n, addr, err := t.conn.ReadFromUDP(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, udpAddr{addr}, nil
+}
+
+func (t *udpTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	opaque := !isJSON(b)
+	if t.dialed && opaque {
+		return t.conn.WriteOpaque(b, nil)
+	} else if t.dialed {
+		return t.conn.Write(b)
+	}
+	a, ok := addr.(udpAddr)
+	if !ok { //not one read from this socket
+		resolved, err := lspnet.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		a = udpAddr{resolved}
+	}
+	if opaque {
+		return t.conn.WriteOpaque(b, a.UDPAddr)
+	}
+	return t.conn.WriteToUDP(b, a.UDPAddr)
+}
+
+// isJSON tells whether a packet is a message in the JSON codec, which is the
+// only thing the lspnet test hooks can look inside.
+func isJSON(b []byte) bool {
+	return len(b) > 0 && b[0] == '{' && json.Valid(b)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *udpTransport) LocalAddr() net.Addr {
+	return udpAddr{t.conn.LocalAddr()}
+}
+
+// listenUDP returns a transport for a server listening on addr.
+func listenUDP(addr string) (*udpTransport, error) {
+	local, err := lspnet.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+// dialUDP returns a transport for a client bound to localAddr, any address
+// if it is empty, that talks to the server at hostport.
+func dialUDP(localAddr, hostport string) (*udpTransport, error) {
+	peer, err := lspnet.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	if localAddr == "" {
+		localAddr = ":0"
+	}
+	local, err := lspnet.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.DialUDP("udp", local, peer)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn, dialed: true, peer: udpAddr{peer}}, nil
+}
@@ -0,0 +1,321 @@
+// Contains the timer wheel that drives retransmissions and epochs.
+
+package lsp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wheelTick  = time.Millisecond // timers fire up to a tick late
+	wheelSlots = 1024             // ticks in one turn of the wheel
+)
+
+// timerWheel runs the timers of one endpoint, a client or a server with all
+// of its clients, from a single goroutine instead of a goroutine and a timer
+// for each. Timers are hashed into slots by the tick they are due at, so
+// starting and stopping one costs the same however many there are, and the
+// goroutine sleeps until the next tick that has a timer due. Starting a
+// timer due before then sets the goroutine's clock timer forward right away,
+// so a FakeClock advanced after reset returned fires it.
+//
+// Timers run on the wheel's goroutine, so they must not block: a timer that
+// is waiting for an event loop that is stopping it never returns.
+type timerWheel struct {
+	clock    Clock
+	mu       sync.Mutex
+	start    time.Time
+	slots    [wheelSlots]*wheelTimer // each a list of timers
+	current  int64                   // the next tick to look at
+	wakeAt   int64                   // the tick the goroutine sleeps until
+	sleep    Timer                   // the goroutine waits on it while sleeping
+	sleeping bool
+	quitChan chan int
+
+	closeOnce sync.Once
+}
+
+// wheelTimer calls fn once it is due, every time it is reset.
+type wheelTimer struct {
+	wheel   *timerWheel
+	fn      func()
+	running sync.Mutex // held while fn runs, so that stop can wait for it
+
+	// below is guarded by wheel.mu
+	gen        uint64 // bumped by reset and stop, so a firing they overtook is skipped
+	due        int64  // tick
+	scheduled  bool
+	prev, next *wheelTimer
+}
+
+// wheelFiring is a timer taken off the wheel to be run.
+type wheelFiring struct {
+	timer *wheelTimer
+	gen   uint64
+}
+
+func newTimerWheel(clock Clock) *timerWheel {
+	w := &timerWheel{
+		clock:    clock,
+		start:    clock.Now(),
+		sleep:    clock.NewTimer(time.Hour),
+		quitChan: make(chan int),
+	}
+	go w.run()
+	return w
+}
+
+// newTimer returns a timer calling fn, which doesn't run until it is reset.
+func (w *timerWheel) newTimer(fn func()) *wheelTimer {
+	return &wheelTimer{wheel: w, fn: fn}
+}
+
+// close stops the wheel. Its timers never fire again.
+func (w *timerWheel) close() {
+	w.closeOnce.Do(func() { close(w.quitChan) })
+}
+
+func (w *timerWheel) run() {
+	defer w.sleep.Stop()
+	for {
+		fired := w.expire(w.clock.Now())
+		for _, f := range fired {
+			f.timer.fire(f.gen)
+		}
+		if len(fired) > 0 { //they may have been reset to fire right away
+			continue
+		}
+		select {
+		case <-w.sleep.C():
+		case <-w.quitChan:
+			return
+		}
+	}
+}
+
+// tick returns the tick t falls in.
+func (w *timerWheel) tick(t time.Time) int64 {
+	return int64(t.Sub(w.start) / wheelTick)
+}
+
+// expire takes the timers due at now off the wheel. If there are none, it
+// sets the goroutine to sleep until the next one is.
+func (w *timerWheel) expire(now time.Time) []wheelFiring {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sleeping = false
+	var fired []wheelFiring
+	tick := w.tick(now)
+	from := w.current
+	if tick-from >= wheelSlots { //slept through a whole turn, look at each slot once
+		from = tick - wheelSlots + 1
+	}
+	for t := from; t <= tick; t++ {
+		for timer := w.slots[t%wheelSlots]; timer != nil; {
+			next := timer.next
+			if timer.due <= tick {
+				w.unlink(timer)
+				fired = append(fired, wheelFiring{timer, timer.gen})
+			}
+			timer = next
+		}
+	}
+	w.current = tick + 1
+	// sleep until the first tick in the next turn that has a timer due, or
+	// a whole turn if the timers there are all due in later turns
+	w.wakeAt = w.current + wheelSlots
+	for t := w.current; t < w.current+wheelSlots && w.wakeAt == w.current+wheelSlots; t++ {
+		for timer := w.slots[t%wheelSlots]; timer != nil; timer = timer.next {
+			if timer.due <= t {
+				w.wakeAt = t
+				break
+			}
+		}
+	}
+	if len(fired) == 0 {
+		w.sleeping = true
+		w.sleep.Reset(w.start.Add(time.Duration(w.wakeAt) * wheelTick).Sub(now))
+	}
+	return fired
+}
+
+func (w *timerWheel) unlink(timer *wheelTimer) {
+	if timer.prev != nil {
+		timer.prev.next = timer.next
+	} else {
+		w.slots[timer.due%wheelSlots] = timer.next
+	}
+	if timer.next != nil {
+		timer.next.prev = timer.prev
+	}
+	timer.prev, timer.next = nil, nil
+	timer.scheduled = false
+}
+
+// reset makes the timer fire once d has passed, instead of when it was due
+// before, if at all. Unlike stop it may be called from the timer's own fn.
+func (timer *wheelTimer) reset(d time.Duration) {
+	w := timer.wheel
+	w.mu.Lock()
+	if timer.scheduled {
+		w.unlink(timer)
+	}
+	timer.gen += 1
+	timer.due = int64((w.clock.Now().Sub(w.start) + d + wheelTick - 1) / wheelTick) //round up
+	if timer.due < w.current {
+		timer.due = w.current
+	}
+	slot := timer.due % wheelSlots
+	timer.next = w.slots[slot]
+	if timer.next != nil {
+		timer.next.prev = timer
+	}
+	w.slots[slot] = timer
+	timer.scheduled = true
+	if timer.due < w.wakeAt {
+		w.wakeAt = timer.due
+		if w.sleeping { //otherwise the goroutine looks again before it sleeps
+			w.sleep.Reset(w.start.Add(time.Duration(timer.due) * wheelTick).Sub(w.clock.Now()))
+		}
+	}
+	w.mu.Unlock()
+}
+
+// stop keeps the timer from firing until it is reset again. If fn is
+// running, stop waits for it to return, so whatever fn touched can be looked
+// at once stop returns.
+func (timer *wheelTimer) stop() {
+	timer.running.Lock()
+	defer timer.running.Unlock()
+	w := timer.wheel
+	w.mu.Lock()
+	if timer.scheduled {
+		w.unlink(timer)
+	}
+	timer.gen += 1
+	w.mu.Unlock()
+}
+
+func (timer *wheelTimer) fire(gen uint64) {
+	timer.running.Lock()
+	defer timer.running.Unlock()
+	w := timer.wheel
+	w.mu.Lock()
+	current := timer.gen == gen
+	w.mu.Unlock()
+	if current {
+		timer.fn()
+	}
+}
+
+// epochTimer keeps the epochs of one connection on a timer wheel. It sends
+// a heartbeat once an epoch has passed without hearing from the peer or
+// sending one, and reports the peer lost once EpochLimit epochs have passed
+// without hearing from it. Rather than being reset for every message, it
+// looks at when the peer was last heard from whenever it fires, so it fires
+// about once an epoch however busy the connection is.
+type epochTimer struct {
+	timer     *wheelTimer
+	lastHeard *atomic.Int64 // unix nanoseconds, zero if nothing was heard yet
+
+	// below is only touched by the timer, or with it stopped
+	epoch        time.Duration
+	limit        time.Duration // EpochLimit epochs
+	since        time.Time     // silence is counted from here at most
+	lastReminder time.Time
+	lostSince    time.Time // the silence the peer was reported lost for
+	heartbeat    func()    // nil while there's nothing to send
+	lost         func()
+}
+
+// newEpochTimer starts the epochs of a connection. lastHeard is stored to by
+// whoever reads from the peer, lost must not block.
+func newEpochTimer(wheel *timerWheel, lastHeard *atomic.Int64, params *Params, heartbeat, lost func()) *epochTimer {
+	et := &epochTimer{lastHeard: lastHeard, lost: lost}
+	et.timer = wheel.newTimer(et.fire)
+	et.restart(params, heartbeat)
+	return et
+}
+
+// restart starts counting epochs of the given length from now on, sending
+// heartbeat from now on.
+func (et *epochTimer) restart(params *Params, heartbeat func()) {
+	et.timer.stop()
+	et.epoch = time.Duration(params.EpochMillis) * time.Millisecond
+	et.limit = et.epoch * time.Duration(params.EpochLimit)
+	et.since = et.timer.wheel.clock.Now()
+	et.lastReminder = time.Time{}
+	et.lostSince = time.Time{}
+	et.heartbeat = heartbeat
+	et.timer.reset(et.epoch)
+}
+
+func (et *epochTimer) stop() {
+	et.timer.stop()
+}
+
+func (et *epochTimer) fire() {
+	now := et.timer.wheel.clock.Now()
+	heard := et.since
+	if nanos := et.lastHeard.Load(); nanos != 0 && time.Unix(0, nanos).After(heard) {
+		heard = time.Unix(0, nanos)
+	}
+	if !heard.Equal(et.lostSince) && now.Sub(heard) >= et.limit {
+		et.lostSince = heard //once for each silence
+		et.lost()
+	}
+	reminded := heard
+	if et.lastReminder.After(reminded) {
+		reminded = et.lastReminder
+	}
+	if now.Sub(reminded) >= et.epoch {
+		if et.heartbeat != nil {
+			et.heartbeat()
+		}
+		et.lastReminder = now
+		reminded = now
+	}
+	next := reminded.Add(et.epoch)
+	if !heard.Equal(et.lostSince) && heard.Add(et.limit).Before(next) {
+		next = heard.Add(et.limit)
+	}
+	et.timer.reset(next.Sub(now))
+}
+
+// start has the timer wheel call retransmit every timeout until elem is
+// stopped, with the backoff starting over.
+func (elem *windowElem) start(wheel *timerWheel, timeout time.Duration, retransmit func()) {
+	elem.timeout = timeout
+	elem.backOffEpochs = 0
+	elem.epochsPassed = 0
+	if elem.timer == nil {
+		elem.timer = wheel.newTimer(retransmit)
+	}
+	elem.timer.reset(timeout)
+}
+
+// stop stops resending elem, if it is being resent at all.
+func (elem *windowElem) stop() {
+	if elem.timer != nil {
+		elem.timer.stop()
+	}
+}
+
+// backOff tells whether elem is to be sent again now that its timeout is
+// up. After each retransmission it lets one more timeout pass than before,
+// doubling up to maxBackOff.
+func (elem *windowElem) backOff(maxBackOff int) bool {
+	if elem.epochsPassed < elem.backOffEpochs {
+		elem.epochsPassed += 1
+		return false
+	}
+	elem.epochsPassed = 0
+	if elem.backOffEpochs == 0 {
+		elem.backOffEpochs = min(1, maxBackOff)
+	} else {
+		elem.backOffEpochs = min(elem.backOffEpochs*2, maxBackOff)
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+// Contains the UDPConn methods LSP needs beyond the ones above.
+
+package lspnet
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// LocalAddr returns the local address the connection is bound to, with the
+// port the system picked if it was bound to port 0.
+func (c *UDPConn) LocalAddr() *UDPAddr {
+	return &UDPAddr{naddr: c.nconn.LocalAddr().(*net.UDPAddr)}
+}
+
+// WriteOpaque writes a packet that isn't a JSON message, such as one in a
+// binary codec or sealed in secure mode, like Write if addr is nil and like
+// WriteToUDP otherwise. The test hooks only understand JSON messages, so
+// such a packet is only ever delayed or dropped: sniffing doesn't count it,
+// and it is never shortened, lengthened or corrupted.
+func (c *UDPConn) WriteOpaque(b []byte, addr *UDPAddr) (int, error) {
+	if sometimes(int(atomic.LoadUint32(&delayMessagePercent))) {
+		if isLoggingEnabled() {
+			log.Printf("DELAYING written packet of length %d\n", len(b))
+		}
+		var clonedB = append(make([]byte, 0), b...)
+		go func() {
+			time.Sleep(time.Millisecond * time.Duration(500))
+			c.writeOpaque(clonedB, addr)
+		}()
+		return len(b), nil
+	}
+	return c.writeOpaque(b, addr)
+}
+
+func (c *UDPConn) writeOpaque(b []byte, addr *UDPAddr) (int, error) {
+	if sometimes(writeDropPercent(c)) {
+		if isLoggingEnabled() {
+			log.Printf("DROPPING written packet of length %d\n", len(b))
+		}
+		return len(b), nil
+	}
+	if addr == nil {
+		n, err := c.nconn.Write(b)
+		if err != nil {
+			return 0, nil
+		}
+		return n, nil
+	}
+	return c.nconn.WriteToUDP(b, addr.toNet())
+}